@@ -2,43 +2,128 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
 	"io"
 	"os"
+	"strings"
 	"sync"
 	"time"
 )
 
+// autoAofRewritePercentage is the growth of the append-only file since the last rewrite,
+// as a percentage of its size after that rewrite, that triggers an automatic rewrite.
+// It is protected by the ConfigMu mutex.
+var autoAofRewritePercentage = 100
+
+// autoAofRewriteMinSize is the size in bytes the append-only file must exceed before it
+// is rewritten automatically. It is protected by the ConfigMu mutex.
+var autoAofRewriteMinSize int64 = 64 << 20
+
+// aofWriteQueue makes the append-only file queue the commands written to it in memory,
+// so a writer goroutine appends them to the file in batches and commands never wait for
+// the disk. Only the file write is deferred: the command itself still changes the data
+// before it is replied to, see execute, so a connection always reads its own writes. It
+// can only be set on startup, and is protected by the ConfigMu mutex.
+//
+// NOTE: Commands that were replied to but are still queued are lost if the server
+// crashes, on top of the ones not synced to disk yet. FSYNC writes the queue out first.
+var aofWriteQueue = false
+
+// applyMu is held by write commands from the moment they are appended to the append-only
+// file (AOF) until they have been applied, and by the deletions of expired and evicted
+// keys, so changes are appended in the same order they are made. Otherwise two
+// connections writing the same key could append their commands in one order and apply
+// them in the other, and replaying the AOF would not give the value that was in memory.
+// It is acquired after persistMu, and never while holding any of the map locks.
+var applyMu = sync.Mutex{}
 
 // Aof is a struct that represents an append-only file. It contains an underlying
 // os.File and a bufio.Reader, as well as a sync.Mutex for synchronizing access.
+// It also tracks the size of the file, and its size after the last rewrite, for the
+// automatic rewrites. While a rewrite is in progress, written commands are also
+// buffered in rewriteBuf.
+// With the write queue enabled, written commands are buffered in pending, and the
+// writer goroutine is woken up through queue to append them to the file. The fileMu
+// mutex serializes the writes to the file with syncing and replacing it, without
+// blocking the commands that hold the mu mutex. It is always acquired before mu.
 type Aof struct {
-	file *os.File
-	rd   *bufio.Reader
-	mu   sync.Mutex
+	file   *os.File
+	rd     *bufio.Reader
+	mu     sync.Mutex
+	fileMu sync.Mutex
+
+	pending bytes.Buffer
+	queue   chan struct{}
+
+	path     string
+	size     int64
+	baseSize int64
+
+	rewriting  bool
+	rewriteBuf bytes.Buffer
+
+	txs map[*aofTx]struct{}
+
+	// replicas are the connections that issued SYNC, see feedReplicas.
+	replicas map[*replica]struct{}
+}
+
+// aofTx holds the write commands of a transaction while EXEC runs them, so they are
+// written to the append-only file together, between MULTI and EXEC, once it is done.
+// skip is the number of commands that were already applied when the snapshot of the
+// rewrite in progress was taken, so they are left out of the rewritten file.
+type aofTx struct {
+	values []Value
+	skip   int
 }
 
 // NewAof creates a new Aof instance with the given file path. It opens the file
 // for reading and writing, and starts a goroutine that syncs the file to disk
-// every 1 second.
+// every 1 second. If aof-write-queue is enabled, it also starts the writer goroutine
+// that appends the queued commands to the file.
 func NewAof(path string) (*Aof, error) {
 	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0666)
 	if err != nil {
 		return nil, err
 	}
 
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
 	aof := &Aof{
-		file: f,
-		rd:   bufio.NewReader(f),
+		file:     f,
+		rd:       bufio.NewReader(f),
+		path:     path,
+		size:     info.Size(),
+		baseSize: info.Size(),
+		txs:      map[*aofTx]struct{}{},
+		replicas: map[*replica]struct{}{},
+	}
+
+	ConfigMu.RLock()
+	queued := aofWriteQueue
+	ConfigMu.RUnlock()
+
+	if queued {
+		aof.queue = make(chan struct{}, 1)
+		go func() {
+			for range aof.queue {
+				if err := aof.flush(); err != nil {
+					fmt.Println("Error writing to the AOF: ", err)
+				}
+			}
+		}()
 	}
 
 	// start go routine to sync aof to disk every 1 second
 	go func() {
 		for {
-			aof.mu.Lock()
-
-			aof.file.Sync()
-
-			aof.mu.Unlock()
+			aof.Sync()
 
 			time.Sleep(time.Second)
 		}
@@ -47,9 +132,96 @@ func NewAof(path string) (*Aof, error) {
 	return aof, nil
 }
 
+// Sync flushes everything written to the append-only file so far to disk, and only
+// returns once the file has been synced. It is called every second in the background,
+// and by FSYNC for writes that must be durable before the client proceeds. Queued
+// commands are appended to the file first. Commands can still be written while the file
+// is synced, since it does not hold the mu mutex.
+func (aof *Aof) Sync() error {
+	if err := aof.flush(); err != nil {
+		return err
+	}
+
+	aof.fileMu.Lock()
+	defer aof.fileMu.Unlock()
+
+	return aof.file.Sync()
+}
+
+// flush appends the commands queued so far to the file, in the order they were written.
+// The queue is swapped for an empty one under the mu mutex, and only the fileMu mutex is
+// held while writing it out, so commands can be queued in the meantime.
+func (aof *Aof) flush() error {
+	aof.fileMu.Lock()
+	defer aof.fileMu.Unlock()
+
+	aof.mu.Lock()
+	data := aof.pending.Bytes()
+	aof.pending = bytes.Buffer{}
+	aof.mu.Unlock()
+
+	if len(data) == 0 {
+		return nil
+	}
+
+	_, err := aof.file.Write(data)
+
+	return err
+}
+
+// append writes data to the file, or queues it for the writer goroutine if the write
+// queue is enabled. The caller must hold the lock on the mu mutex.
+func (aof *Aof) append(data []byte) error {
+	if aof.queue != nil {
+		aof.pending.Write(data)
+		aof.size += int64(len(data))
+
+		select {
+		case aof.queue <- struct{}{}:
+		default:
+			// the writer is already due to run, and will pick this data up too
+		}
+
+		return nil
+	}
+
+	n, err := aof.file.Write(data)
+	aof.size += int64(n)
+
+	return err
+}
+
+// fsync is a command handler that syncs the append-only file (AOF) to disk with Sync,
+// so every write command that was acknowledged before it is durable. It takes no
+// arguments. If the sync fails, it returns an error.
+// It returns "OK" once the file has been synced.
+func fsync(args []Value) Value {
+	if len(args) != 0 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'fsync' command"}
+	}
+
+	if snapshotAof == nil {
+		return Value{typ: "error", str: "ERR the append-only file is not open yet"}
+	}
+
+	if err := snapshotAof.Sync(); err != nil {
+		return Value{typ: "error", str: "ERR " + err.Error()}
+	}
+
+	return Value{typ: "string", str: "OK"}
+}
+
 // Close closes the underlying file for the Aof instance. This method is thread-safe
 // and ensures that the file is properly closed and synced to disk before returning.
+// Queued commands are appended to the file before it is closed.
 func (aof *Aof) Close() error {
+	if err := aof.flush(); err != nil {
+		return err
+	}
+
+	aof.fileMu.Lock()
+	defer aof.fileMu.Unlock()
+
 	aof.mu.Lock()
 	defer aof.mu.Unlock()
 
@@ -57,26 +229,105 @@ func (aof *Aof) Close() error {
 }
 
 // Write appends the given Value to the append-only file. It acquires a lock to
-// ensure thread-safety, writes the marshaled value to the file, and then
-// releases the lock. Any errors encountered during the write operation are
+// ensure thread-safety, writes the marshaled value to the file, or queues it if the
+// write queue is enabled, and then releases the lock. If a rewrite is in progress, the
+// value is also buffered for the file that will replace this one. It is also streamed to
+// the replicas, see feedReplicas. Any errors encountered during the write operation are
 // returned.
 func (aof *Aof) Write(value Value) error {
 	aof.mu.Lock()
 	defer aof.mu.Unlock()
 
-	_, err := aof.file.Write(value.Marshal())
-	if err != nil {
+	data := value.Marshal()
+
+	if err := aof.append(data); err != nil {
+		return err
+	}
+
+	if aof.rewriting {
+		aof.rewriteBuf.Write(data)
+	}
+
+	aof.feedReplicas(data)
+
+	return nil
+}
+
+// beginTx starts collecting the write commands of a transaction, which are written to
+// the file by commitTx once EXEC has run them all.
+func (aof *Aof) beginTx() *aofTx {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	tx := &aofTx{}
+	aof.txs[tx] = struct{}{}
+
+	return tx
+}
+
+// writeTx adds the given Value to the commands of the transaction, instead of appending
+// it to the file right away.
+func (aof *Aof) writeTx(tx *aofTx, value Value) {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	tx.values = append(tx.values, value)
+}
+
+// commitTx appends the commands of the transaction to the append-only file wrapped in
+// MULTI and EXEC, in a single write, so they are replayed together or not at all. Nothing
+// is written if the transaction did not change anything. If a rewrite is in progress,
+// only the commands applied after its snapshot was taken are buffered for the new file,
+// and the same goes for the commands streamed to the replicas.
+func (aof *Aof) commitTx(tx *aofTx) error {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	delete(aof.txs, tx)
+
+	if len(tx.values) == 0 {
+		return nil
+	}
+
+	data := wrapTx(tx.values)
+
+	if err := aof.append(data); err != nil {
 		return err
 	}
 
+	if aof.rewriting && tx.skip < len(tx.values) {
+		aof.rewriteBuf.Write(wrapTx(tx.values[tx.skip:]))
+	}
+
+	aof.feedReplicasTx(tx)
+
 	return nil
 }
 
+// wrapTx returns the RESP representation of the given commands between a MULTI and an
+// EXEC command.
+func wrapTx(values []Value) []byte {
+	data := request("MULTI").Marshal()
+	for _, value := range values {
+		data = append(data, value.Marshal()...)
+	}
+
+	return append(data, request("EXEC").Marshal()...)
+}
+
 // Read reads all values from the append-only file and calls the provided
 // function for each value. It acquires a lock to ensure thread-safety,
 // seeks to the start of the file, and then reads each value, passing it
 // to the provided function. Any errors encountered during the read
 // operation are returned.
+// If the file ends with a truncated command, which happens when the server is killed in
+// the middle of a write, the command is dropped and the file is truncated after the last
+// complete one, like Redis does with aof-load-truncated, so new commands are not appended
+// after the partial one.
+// The commands between MULTI and EXEC are only passed to fn once EXEC has been read, and
+// a transaction that is not complete at the end of the file is dropped and truncated the
+// same way, like Redis does, since it was never acknowledged to the client.
+// The AOF-BASE command a rewritten file starts with is skipped, see matchSnapshot.
 //
 // NOTE: This is very slow when starting up when the DB has a lot of data.
 func (aof *Aof) Read(fn func(value Value)) error {
@@ -87,18 +338,383 @@ func (aof *Aof) Read(fn func(value Value)) error {
 
 	reader := NewResp(aof.file)
 
+	// complete is the offset just after the last complete command read so far, and
+	// queued holds the commands of a transaction whose EXEC has not been read yet
+	var complete int64
+	var queued []Value
+	inMulti := false
+
 	for {
 		value, err := reader.Read()
 		if err != nil {
-			if err == io.EOF {
+			if err == io.EOF && !inMulti {
 				break
 			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return aof.truncateTail(complete)
+			}
 
 			return err
 		}
 
-		fn(value)
+		switch txMarker(value) {
+		case "MULTI":
+			inMulti = true
+			queued = nil
+		case "EXEC":
+			inMulti = false
+			for _, value := range queued {
+				fn(value)
+			}
+			queued = nil
+		default:
+			if _, ok := baseID(value); ok {
+				break
+			}
+
+			if inMulti {
+				queued = append(queued, value)
+			} else {
+				fn(value)
+			}
+		}
+
+		if inMulti {
+			continue
+		}
+
+		pos, err := aof.file.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		complete = pos - int64(reader.reader.Buffered())
+	}
+
+	return nil
+}
+
+// txMarker returns "MULTI" or "EXEC" if the value read from the append-only file is one
+// of the commands that wrap a transaction, and an empty string otherwise.
+func txMarker(value Value) string {
+	if value.typ != "array" || len(value.array) != 1 {
+		return ""
+	}
+
+	switch name := strings.ToUpper(value.array[0].bulk); name {
+	case "MULTI", "EXEC":
+		return name
+	default:
+		return ""
+	}
+}
+
+// truncateTail drops the partial command or transaction at the end of the append-only file by
+// truncating the file at offset, and moves the write position there. The caller must
+// hold the lock on the mu mutex.
+func (aof *Aof) truncateTail(offset int64) error {
+	fmt.Printf("AOF ends with a truncated command or transaction, truncating it from %d to %d bytes\n", aof.size, offset)
+
+	if err := aof.file.Truncate(offset); err != nil {
+		return err
+	}
+	if _, err := aof.file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	aof.size = offset
+	if aof.baseSize > offset {
+		aof.baseSize = offset
+	}
+
+	return nil
+}
+
+// beginRewrite starts buffering the commands written to the append-only file, so they
+// can be written to the file that replaces it in finishRewrite. It is called while
+// the data set is captured for a snapshot, which will contain everything written to the
+// file before that point.
+func (aof *Aof) beginRewrite() error {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	if aof.rewriting {
+		return errors.New("AOF rewrite already in progress")
+	}
+
+	aof.rewriting = true
+	aof.rewriteBuf.Reset()
+
+	// the commands of the running transactions so far are already in the snapshot
+	for tx := range aof.txs {
+		tx.skip = len(tx.values)
 	}
 
 	return nil
-}
\ No newline at end of file
+}
+
+// abortRewrite stops buffering commands after the snapshot of a rewrite could not be
+// saved. The current file is kept as is, since it still contains every command.
+func (aof *Aof) abortRewrite() {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	aof.resetRewrite()
+}
+
+// resetRewrite stops buffering commands for a rewrite. The caller must hold the lock on
+// the mu mutex.
+func (aof *Aof) resetRewrite() {
+	aof.rewriting = false
+	aof.rewriteBuf.Reset()
+
+	for tx := range aof.txs {
+		tx.skip = 0
+	}
+}
+
+// finishRewrite replaces the append-only file with one that only contains the commands
+// buffered since beginRewrite, once the snapshot taken at that point has been written.
+// The new file starts with the AOF-BASE command of the generation id of the snapshot, and
+// is written to a temporary path and synced before publish renames the snapshot into
+// place, so the rewritten file is always on disk once the snapshot is. It is then renamed
+// over the old one. Writes are blocked meanwhile, so no command is lost.
+// If the new file cannot be written, or publish fails, the rewrite is aborted and the old
+// file is kept along with the old snapshot. If the rename fails once the snapshot is
+// published, the commands are appended to the new file at its temporary path from then
+// on, which matchSnapshot picks up on the next startup.
+func (aof *Aof) finishRewrite(id string, publish func() error) error {
+	aof.fileMu.Lock()
+	defer aof.fileMu.Unlock()
+
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	tmp := aof.path + ".rewrite"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0666)
+	if err != nil {
+		aof.resetRewrite()
+		return err
+	}
+
+	data := append(baseMarker(id), aof.rewriteBuf.Bytes()...)
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		aof.resetRewrite()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		aof.resetRewrite()
+		return err
+	}
+
+	if err := publish(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		aof.resetRewrite()
+		return err
+	}
+
+	// the snapshot is published, so the new file is the one to append to even if the
+	// rename fails
+	renameErr := os.Rename(tmp, aof.path)
+
+	// the queued commands are not needed in the old file anymore: those written before
+	// beginRewrite are in the snapshot, and the others are in the new file
+	aof.pending.Reset()
+
+	aof.file.Close()
+	aof.file = f
+	aof.rd = bufio.NewReader(f)
+	aof.size = int64(len(data))
+	aof.baseSize = aof.size
+
+	// the commands of the running transactions that are in the snapshot must not be
+	// written to the new file
+	for tx := range aof.txs {
+		tx.values = tx.values[tx.skip:]
+		tx.skip = 0
+	}
+
+	aof.rewriting = false
+	aof.rewriteBuf.Reset()
+
+	return renameErr
+}
+
+// baseCommand is the name of the command a snapshot saved with the append-only file (AOF)
+// open starts with, followed by a generation id, and the AOF rewritten along with it
+// starts with the same one. They tell on startup whether the AOF continues the snapshot
+// that was loaded, see matchSnapshot.
+const baseCommand = "AOF-BASE"
+
+// baseMarker returns the AOF-BASE command of the generation id, as it is written to the
+// snapshot and the AOF.
+func baseMarker(id string) []byte {
+	return request(baseCommand, id).Marshal()
+}
+
+// baseID returns the generation id of value, if it is an AOF-BASE command.
+func baseID(value Value) (string, bool) {
+	if value.typ != "array" || len(value.array) != 2 || strings.ToUpper(value.array[0].bulk) != baseCommand {
+		return "", false
+	}
+
+	return value.array[1].bulk, true
+}
+
+// fileBase returns the generation id the file at path starts with, or an empty string if
+// the file is missing, empty or does not start with an AOF-BASE command.
+func fileBase(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", nil
+		}
+
+		return "", err
+	}
+	defer f.Close()
+
+	value, err := NewResp(f).Read()
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	id, _ := baseID(value)
+
+	return id, nil
+}
+
+// matchSnapshot makes sure the append-only file continues the snapshot of the generation
+// id loaded on startup, before the file is read. A file of another generation is older
+// than the snapshot, which was published but not followed by the rewritten file because
+// of a crash or a failed rename, and replaying it would apply commands the snapshot
+// already contains a second time. The rewritten file, which is on disk before the
+// snapshot is published, replaces it then. If there is none, every command of the file is
+// in the snapshot, so the file is started over.
+// A snapshot without a generation id, saved before the file was open, is followed by the
+// file as is.
+func (aof *Aof) matchSnapshot(id string) error {
+	if id == "" {
+		return nil
+	}
+
+	aof.fileMu.Lock()
+	defer aof.fileMu.Unlock()
+
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	current, err := fileBase(aof.path)
+	if err != nil || current == id {
+		return err
+	}
+
+	tmp := aof.path + ".rewrite"
+	rewritten, err := fileBase(tmp)
+	if err != nil {
+		return err
+	}
+
+	if rewritten == id {
+		fmt.Println("AOF is older than the snapshot, replacing it with the rewritten AOF")
+
+		if err := os.Rename(tmp, aof.path); err != nil {
+			return err
+		}
+
+		f, err := os.OpenFile(aof.path, os.O_RDWR, 0666)
+		if err != nil {
+			return err
+		}
+
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return err
+		}
+
+		aof.file.Close()
+		aof.file = f
+		aof.rd = bufio.NewReader(f)
+		aof.size = info.Size()
+		aof.baseSize = aof.size
+
+		return nil
+	}
+
+	fmt.Println("AOF is older than the snapshot, which contains all of it, starting it over")
+
+	if err := aof.file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := aof.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	n, err := aof.file.Write(baseMarker(id))
+	aof.size = int64(n)
+	aof.baseSize = aof.size
+	if err != nil {
+		return err
+	}
+
+	return aof.file.Sync()
+}
+
+// Rewrite shrinks the append-only file. The snapshot is the base state the file applies
+// to, so the file is rewritten by saving a new snapshot to the configured dbfilename, and
+// replacing the file with the commands executed while the snapshot was being written.
+// Those commands are buffered in memory until the snapshot is on disk.
+func (aof *Aof) Rewrite() error {
+	ConfigMu.RLock()
+	path := dbFilename
+	ConfigMu.RUnlock()
+
+	return SaveSnapshot(path)
+}
+
+// Size returns the number of bytes written to the append-only file so far, including
+// the commands that are still queued.
+func (aof *Aof) Size() int64 {
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	return aof.size
+}
+
+// rewriteNeeded reports whether the append-only file has grown enough since the last
+// rewrite to be rewritten automatically: it must be larger than
+// auto-aof-rewrite-min-size, and it must have grown by at least
+// auto-aof-rewrite-percentage percent of its size after the last rewrite.
+// A percentage of 0 disables automatic rewrites.
+func (aof *Aof) rewriteNeeded() bool {
+	ConfigMu.RLock()
+	percentage := autoAofRewritePercentage
+	minSize := autoAofRewriteMinSize
+	ConfigMu.RUnlock()
+
+	aof.mu.Lock()
+	size := aof.size
+	base := aof.baseSize
+	rewriting := aof.rewriting
+	aof.mu.Unlock()
+
+	if percentage == 0 || rewriting || size <= minSize {
+		return false
+	}
+
+	if base == 0 {
+		base = 1
+	}
+
+	return (size-base)*100/base >= int64(percentage)
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"math/bits"
+	"strconv"
+	"strings"
+)
+
+// maxBitOffset is the largest bit offset accepted by SETBIT and GETBIT, which limits
+// a string grown by SETBIT to 512MB like Redis does.
+const maxBitOffset = 1<<32 - 1
+
+// parseBitOffset parses a bit offset argument, which must be an integer between 0 and
+// maxBitOffset.
+func parseBitOffset(arg string) (int, bool) {
+	offset, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || offset < 0 || offset > maxBitOffset {
+		return 0, false
+	}
+
+	return int(offset), true
+}
+
+// setbit is a command handler that sets or clears the bit at an offset of a string.
+// It takes three arguments: the key, the bit offset and the bit value (0 or 1).
+// If the number of arguments is not exactly 3, the offset or the value is invalid, or
+// the key holds a value of another type, it returns an error.
+// The string is treated as an array of bytes, where bit 0 is the most significant bit
+// of the first byte. If the offset is beyond the end of the string, the string is
+// grown and padded with zero bytes first.
+// The function acquires a write lock on the SETsMu mutex before modifying the SETs map,
+// and releases the lock after the operation is complete.
+// It returns the previous value of the bit as an integer.
+func setbit(args []Value) Value {
+	if len(args) != 3 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'setbit' command"}
+	}
+
+	key := args[0].bulk
+
+	offset, ok := parseBitOffset(args[1].bulk)
+	if !ok {
+		return Value{typ: "error", str: "ERR bit offset is not an integer or out of range"}
+	}
+
+	bit := args[2].bulk
+	if bit != "0" && bit != "1" {
+		return Value{typ: "error", str: "ERR bit is not an integer or out of range"}
+	}
+
+	if t := keyType(key); t != "string" && t != "none" {
+		return Value{typ: "error", str: "WRONGTYPE Operation against a key holding the wrong kind of value"}
+	}
+
+	SETsMu.Lock()
+	defer SETsMu.Unlock()
+
+	value := SETs[key]
+	index := offset / 8
+	if index >= len(value) {
+		value = append(value, make([]byte, index+1-len(value))...)
+	}
+
+	mask := byte(0x80) >> (offset % 8)
+	old := 0
+	if value[index]&mask != 0 {
+		old = 1
+	}
+
+	if bit == "1" {
+		value[index] |= mask
+	} else {
+		value[index] &^= mask
+	}
+	SETs[key] = value
+
+	touch(key)
+
+	return Value{typ: "integer", num: old}
+}
+
+// getbit is a command handler that returns the bit at an offset of a string.
+// It takes two arguments: the key and the bit offset.
+// If the number of arguments is not exactly 2, the offset is invalid, or the key holds
+// a value of another type, it returns an error.
+// Bits are numbered like in SETBIT. A missing key, or an offset beyond the end of the
+// string, has a bit value of 0.
+// The function acquires a read lock on the SETsMu mutex before accessing the SETs map,
+// and releases the lock after the operation is complete.
+func getbit(args []Value) Value {
+	if len(args) != 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'getbit' command"}
+	}
+
+	key := args[0].bulk
+
+	offset, ok := parseBitOffset(args[1].bulk)
+	if !ok {
+		return Value{typ: "error", str: "ERR bit offset is not an integer or out of range"}
+	}
+
+	if t := keyType(key); t != "string" && t != "none" {
+		return Value{typ: "error", str: "WRONGTYPE Operation against a key holding the wrong kind of value"}
+	}
+
+	SETsMu.RLock()
+	defer SETsMu.RUnlock()
+
+	value, exists := SETs[key]
+	if exists {
+		touch(key)
+	}
+
+	index := offset / 8
+	if index >= len(value) || value[index]&(0x80>>(offset%8)) == 0 {
+		return Value{typ: "integer", num: 0}
+	}
+
+	return Value{typ: "integer", num: 1}
+}
+
+// bitcount is a command handler that counts the bits set to 1 in a string.
+// It takes the key and an optional byte range: BITCOUNT key [start end].
+// Like in LRANGE, start and end are inclusive byte indices, and negative indices
+// count back from the end of the string, so -1 is the last byte.
+// If the number of arguments is not 1 or 3, the range is not made of integers, or the
+// key holds a value of another type, it returns an error.
+// The function acquires a read lock on the SETsMu mutex before accessing the SETs map,
+// and releases the lock after the operation is complete.
+// A missing key, or an empty range, has a count of 0.
+func bitcount(args []Value) Value {
+	if len(args) != 1 && len(args) != 3 {
+		return Value{typ: "error", str: "ERR syntax error"}
+	}
+
+	key := args[0].bulk
+
+	if t := keyType(key); t != "string" && t != "none" {
+		return Value{typ: "error", str: "WRONGTYPE Operation against a key holding the wrong kind of value"}
+	}
+
+	SETsMu.RLock()
+	defer SETsMu.RUnlock()
+
+	value, exists := SETs[key]
+	if !exists {
+		return Value{typ: "integer", num: 0}
+	}
+
+	touch(key)
+
+	from, to := 0, len(value)
+	if len(args) == 3 {
+		start, err := strconv.Atoi(args[1].bulk)
+		if err != nil {
+			return Value{typ: "error", str: "ERR value is not an integer or out of range"}
+		}
+		end, err := strconv.Atoi(args[2].bulk)
+		if err != nil {
+			return Value{typ: "error", str: "ERR value is not an integer or out of range"}
+		}
+
+		var ok bool
+		from, to, ok = listRange(start, end, len(value))
+		if !ok {
+			return Value{typ: "integer", num: 0}
+		}
+	}
+
+	count := 0
+	for i := from; i < to; i++ {
+		count += bits.OnesCount8(value[i])
+	}
+
+	return Value{typ: "integer", num: count}
+}
+
+// bitop is a command handler that performs a bitwise operation between strings and
+// stores the result in a destination key: BITOP <AND | OR | XOR | NOT> destkey key [key ...].
+// AND, OR and XOR take one or more source keys, and NOT takes exactly one. Shorter
+// strings and missing keys are treated as if they were padded with zero bytes to the
+// length of the longest string.
+// If the operation is unknown, NOT is given several keys, or a source key holds a value
+// of another type, it returns an error.
+// The destination key is replaced whatever its type, and loses its expiry. If every
+// source key is missing, the result is empty, so the destination key is deleted instead.
+// The function acquires a read lock on the SETsMu mutex while computing the result from
+// the sources, and a write lock while storing it.
+// It returns the length of the stored string in bytes as an integer.
+func bitop(args []Value) Value {
+	if len(args) < 3 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'bitop' command"}
+	}
+
+	op := strings.ToUpper(args[0].bulk)
+	dest := args[1].bulk
+	sources := args[2:]
+
+	switch op {
+	case "AND", "OR", "XOR":
+	case "NOT":
+		if len(sources) != 1 {
+			return Value{typ: "error", str: "ERR BITOP NOT must be called with a single source key."}
+		}
+	default:
+		return Value{typ: "error", str: "ERR syntax error"}
+	}
+
+	for _, source := range sources {
+		if t := keyType(source.bulk); t != "string" && t != "none" {
+			return Value{typ: "error", str: "WRONGTYPE Operation against a key holding the wrong kind of value"}
+		}
+	}
+
+	// the sources can be changed in place, so they are only read while the lock is held
+	SETsMu.RLock()
+	values := make([][]byte, 0, len(sources))
+	length := 0
+	for _, source := range sources {
+		value := SETs[source.bulk]
+		values = append(values, value)
+		if len(value) > length {
+			length = len(value)
+		}
+	}
+
+	// bytes past the end of a shorter string count as zero
+	byteAt := func(value []byte, i int) byte {
+		if i < len(value) {
+			return value[i]
+		}
+		return 0
+	}
+
+	result := make([]byte, length)
+	for i := range result {
+		b := byteAt(values[0], i)
+		for _, value := range values[1:] {
+			switch op {
+			case "AND":
+				b &= byteAt(value, i)
+			case "OR":
+				b |= byteAt(value, i)
+			case "XOR":
+				b ^= byteAt(value, i)
+			}
+		}
+		if op == "NOT" {
+			b = ^b
+		}
+
+		result[i] = b
+	}
+	SETsMu.RUnlock()
+
+	deleteKey(dest)
+
+	if length == 0 {
+		return Value{typ: "integer", num: 0}
+	}
+
+	SETsMu.Lock()
+	SETs[dest] = result
+	SETsMu.Unlock()
+
+	touch(dest)
+
+	return Value{typ: "integer", num: length}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// listWaiters is a map of list names to the channels of the connections blocked in
+// BLPOP or BRPOP until an element is pushed to that list. A connection waiting on several
+// lists registers the same channel on each of them.
+var listWaiters = map[string]map[chan struct{}]struct{}{}
+
+// listWaitersMu is a mutex that protects access to the listWaiters map. It may be
+// acquired while holding the LISTsMu lock, but not the other way around.
+var listWaitersMu = sync.Mutex{}
+
+// BlockingHandlers is a map of command names to handler functions that may block the
+// connection until another connection changes the data. They need the append-only file
+// (AOF), because they are not written to it themselves: replaying a blocking command on
+// startup could block forever, so the handlers write the change they actually made.
+var BlockingHandlers = map[string]func(*Session, *Aof, []Value) Value{
+	"BLPOP": blpop,
+	"BRPOP": brpop,
+}
+
+// waitForPush registers a channel that is signalled when an element is pushed to any of
+// the given lists. It must be removed with stopWaiting once the caller stops waiting.
+func waitForPush(keys []string) chan struct{} {
+	ch := make(chan struct{}, 1)
+
+	listWaitersMu.Lock()
+	defer listWaitersMu.Unlock()
+
+	for _, key := range keys {
+		waiters, ok := listWaiters[key]
+		if !ok {
+			waiters = map[chan struct{}]struct{}{}
+			listWaiters[key] = waiters
+		}
+		waiters[ch] = struct{}{}
+	}
+
+	return ch
+}
+
+// stopWaiting removes the channel registered by waitForPush from the given lists.
+func stopWaiting(keys []string, ch chan struct{}) {
+	listWaitersMu.Lock()
+	defer listWaitersMu.Unlock()
+
+	for _, key := range keys {
+		delete(listWaiters[key], ch)
+		if len(listWaiters[key]) == 0 {
+			delete(listWaiters, key)
+		}
+	}
+}
+
+// signalPush wakes up every connection waiting for an element to be pushed to key. The
+// channels are buffered, so a connection that is not waiting yet still sees the signal.
+func signalPush(key string) {
+	listWaitersMu.Lock()
+	defer listWaitersMu.Unlock()
+
+	for ch := range listWaiters[key] {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// blpop is a command handler that removes and returns the first element of the first
+// non-empty list among the given ones, blocking until one is pushed if they are all empty:
+// BLPOP key [key ...] timeout. See blockingPop.
+func blpop(s *Session, aof *Aof, args []Value) Value {
+	return blockingPop(s, aof, "blpop", "LPOP", lpop, args)
+}
+
+// brpop is a command handler that removes and returns the last element of the first
+// non-empty list among the given ones, blocking until one is pushed if they are all empty:
+// BRPOP key [key ...] timeout. See blockingPop.
+func brpop(s *Session, aof *Aof, args []Value) Value {
+	return blockingPop(s, aof, "brpop", "RPOP", rpop, args)
+}
+
+// blockingPop implements BLPOP and BRPOP, popping with the pop handler of the given
+// non-blocking command.
+// The lists are tried in order, and the first element found is returned with its list as
+// an array of two bulk strings. If all the lists are empty, the connection waits until
+// an element is pushed to one of them, or until the timeout elapses, in which case it
+// returns a null value. The timeout is in seconds and may be fractional; 0 waits forever.
+// Inside a transaction, the lists are tried once without waiting, like Redis does.
+// If the timeout is invalid, or a key holds a value of another type, it returns an error.
+// Every pop is written to the append-only file (AOF) as the non-blocking command.
+// The wait is bounded by a context derived from the session's, with the timeout as its
+// deadline, which is also cancelled when the client goes away, see watchDisconnect, so
+// the connection's goroutine unwinds instead of waiting forever.
+//
+// NOTE: A client that sends another request while it waits is no longer watched, since
+// the request is left for the connection to read once the command returns.
+func blockingPop(s *Session, aof *Aof, command, name string, pop func([]Value) Value, args []Value) Value {
+	if len(args) < 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for '" + command + "' command"}
+	}
+
+	seconds, err := strconv.ParseFloat(args[len(args)-1].bulk, 64)
+	if err != nil || math.IsNaN(seconds) || math.IsInf(seconds, 0) {
+		return Value{typ: "error", str: "ERR timeout is not a float or out of range"}
+	}
+	if seconds < 0 {
+		return Value{typ: "error", str: "ERR timeout is negative"}
+	}
+
+	keys := make([]string, 0, len(args)-1)
+	for _, arg := range args[:len(args)-1] {
+		keys = append(keys, arg.bulk)
+	}
+
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if seconds > 0 {
+		ctx, cancel = context.WithTimeout(s.ctx, time.Duration(seconds*float64(time.Second)))
+	} else {
+		ctx, cancel = context.WithCancel(s.ctx)
+	}
+	defer cancel()
+
+	// there is no waiting inside a transaction, so the client is not watched either
+	if !s.inExec {
+		var stop func()
+		ctx, stop = s.watchDisconnect(ctx)
+		defer stop()
+	}
+
+	for {
+		// the channel is registered before the lists are checked, so a push that happens
+		// in between is not missed
+		ch := waitForPush(keys)
+
+		expireArgs(s, aof, args[:len(args)-1])
+		result, ok := popFirst(s, aof, name, pop, keys)
+		if ok || s.inExec {
+			stopWaiting(keys, ch)
+			return result
+		}
+
+		select {
+		case <-ch:
+			stopWaiting(keys, ch)
+		case <-ctx.Done():
+			stopWaiting(keys, ch)
+			return Value{typ: "null"}
+		}
+	}
+}
+
+// watchDisconnect returns a context that is done once ctx is, or once the client of the
+// session closes the connection while no request is being read from it, such as while a
+// blocking command waits. A goroutine peeks at the session's reader, which reveals a
+// closed connection without consuming any pipelined request. The returned stop function
+// must be called before the connection is read from again: it wakes the goroutine up by
+// setting a read deadline in the past, waits for it to return, and clears the deadline.
+func (s *Session) watchDisconnect(ctx context.Context) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	if s.resp == nil {
+		return ctx, cancel
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		_, err := s.resp.reader.Peek(1)
+		var nerr net.Error
+		if err != nil && !(errors.As(err, &nerr) && nerr.Timeout()) {
+			cancel()
+		}
+	}()
+
+	return ctx, func() {
+		s.conn.SetReadDeadline(time.Now())
+		<-done
+		s.conn.SetReadDeadline(time.Time{})
+		cancel()
+	}
+}
+
+// popFirst pops an element with the pop handler from the first non-empty list among
+// keys, and writes the pop to the append-only file (AOF) as the named command with
+// propagate, so a pop inside a transaction is written along with it. It returns
+// false, with a null value, if all the lists are empty, and an error if a key holds a
+// value of another type.
+func popFirst(s *Session, aof *Aof, name string, pop func([]Value) Value, keys []string) (Value, bool) {
+	// EXEC already holds the locks for the commands of a transaction
+	inTx := s.inTx()
+	if !inTx {
+		persistMu.RLock()
+		defer persistMu.RUnlock()
+	}
+
+	for _, key := range keys {
+		switch keyType(key) {
+		case "list":
+		case "none":
+			continue
+		default:
+			return Value{typ: "error", str: "WRONGTYPE Operation against a key holding the wrong kind of value"}, true
+		}
+
+		if !inTx {
+			applyMu.Lock()
+		}
+		element := pop([]Value{{typ: "bulk", bulk: key}})
+		if element.typ != "bulk" {
+			// another connection emptied the list since it was checked
+			if !inTx {
+				applyMu.Unlock()
+			}
+			continue
+		}
+
+		s.propagate(aof, request(name, key))
+		notify(notifyList, strings.ToLower(name), key)
+		if !inTx {
+			applyMu.Unlock()
+		}
+		atomic.AddInt64(&dirty, 1)
+
+		return Value{typ: "array", array: []Value{{typ: "bulk", bulk: key}, element}}, true
+	}
+
+	return Value{typ: "null"}, false
+}
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// commandSpec describes a command for COMMAND INFO and COMMAND DOCS. The arity counts the
+// command name itself, and is negative when it is a minimum rather than an exact number
+// of arguments. The key positions give the index of the first and last key arguments
+// and the step between keys, where a negative last key counts back from the end of the
+// arguments; they are all 0 for commands without keys.
+type commandSpec struct {
+	arity    int
+	firstKey int
+	lastKey  int
+	step     int
+	summary  string
+}
+
+// commandSpecs is a map of command names to their description. Every command the server
+// executes should have an entry, so client libraries can find its keys.
+var commandSpecs = map[string]commandSpec{
+	"PING":    {-1, 0, 0, 0, "Returns the server's liveliness response."},
+	"LOLWUT":  {-1, 0, 0, 0, "Displays the server name and version."},
+	"INFO":    {-1, 0, 0, 0, "Returns information and statistics about the server."},
+	"CONFIG":  {-2, 0, 0, 0, "A container for server configuration commands."},
+	"SAVE":    {1, 0, 0, 0, "Synchronously saves the database to disk."},
+	"FSYNC":   {1, 0, 0, 0, "Synchronously flushes the append-only file to disk."},
+	"OBJECT":  {-2, 2, 2, 1, "A container for object introspection commands."},
+	"MEMORY":  {-2, 2, 2, 1, "A container for memory diagnostics commands."},
+	"DEBUG":   {-2, 0, 0, 0, "A container for debugging commands."},
+	"COMMAND": {-1, 0, 0, 0, "Returns detailed information about all commands."},
+
+	"SET":      {-3, 1, 1, 1, "Sets the string value of a key, ignoring its type."},
+	"GET":      {2, 1, 1, 1, "Returns the string value of a key."},
+	"GETDEL":   {2, 1, 1, 1, "Returns the string value of a key after deleting the key."},
+	"MSETNX":   {-3, 1, -1, 2, "Sets multiple string values only when none of the keys exist."},
+	"GETRANGE": {4, 1, 1, 1, "Returns a substring of the string stored at a key."},
+	"SUBSTR":   {4, 1, 1, 1, "Returns a substring from a string value."},
+	"SETRANGE": {4, 1, 1, 1, "Overwrites a part of a string value with another by an offset."},
+	"APPEND":   {3, 1, 1, 1, "Appends a string to the value of a key. Creates the key if it doesn't exist."},
+	"LCS":      {-3, 1, 2, 1, "Finds the longest common substring."},
+	"SETBIT":   {4, 1, 1, 1, "Sets or clears the bit at offset of the string value."},
+	"GETBIT":   {3, 1, 1, 1, "Returns a bit value by offset."},
+	"BITCOUNT": {-2, 1, 1, 1, "Counts the number of set bits (population counting) in a string."},
+	"BITOP":    {-4, 2, -1, 1, "Performs bitwise operations on multiple strings, and stores the result."},
+
+	"HSET":       {4, 1, 1, 1, "Creates or modifies the value of a field in a hash."},
+	"HGET":       {3, 1, 1, 1, "Returns the value of a field in a hash."},
+	"HGETALL":    {2, 1, 1, 1, "Returns all fields and values in a hash."},
+	"HKEYS":      {2, 1, 1, 1, "Returns all fields in a hash."},
+	"HVALS":      {2, 1, 1, 1, "Returns all values in a hash."},
+	"HSCAN":      {-3, 1, 1, 1, "Iterates over fields and values of a hash."},
+	"HRANDFIELD": {-2, 1, 1, 1, "Returns one or more random fields from a hash."},
+	"HGETDEL":    {-5, 1, 1, 1, "Returns the value of one or more fields and deletes them."},
+	"HGETEX":     {-5, 1, 1, 1, "Returns the value of one or more fields and sets or removes their expiry."},
+	"HEXPIRE":    {-6, 1, 1, 1, "Sets the expiration time of one or more fields of a hash in seconds."},
+	"HPEXPIREAT": {-6, 1, 1, 1, "Sets the expiration time of one or more fields of a hash to a Unix milliseconds timestamp."},
+	"HTTL":       {-5, 1, 1, 1, "Returns the expiration time in seconds of one or more fields of a hash."},
+
+	"LPUSH":  {-3, 1, 1, 1, "Prepends one or more elements to a list."},
+	"RPUSH":  {-3, 1, 1, 1, "Appends one or more elements to a list."},
+	"LPOP":   {-2, 1, 1, 1, "Returns the first element of a list after removing it."},
+	"RPOP":   {-2, 1, 1, 1, "Returns and removes the last element of a list."},
+	"LLEN":   {2, 1, 1, 1, "Returns the length of a list."},
+	"LRANGE": {4, 1, 1, 1, "Returns a range of elements from a list."},
+	"LTRIM":  {4, 1, 1, 1, "Removes elements from both ends of a list."},
+	"LINDEX": {3, 1, 1, 1, "Returns an element from a list by its index."},
+	"BLPOP":  {-3, 1, -2, 1, "Removes and returns the first element in a list. Blocks until an element is available otherwise."},
+	"BRPOP":  {-3, 1, -2, 1, "Removes and returns the last element in a list. Blocks until an element is available otherwise."},
+
+	"SADD":       {-3, 1, 1, 1, "Adds one or more members to a set."},
+	"SREM":       {-3, 1, 1, 1, "Removes one or more members from a set."},
+	"SMEMBERS":   {2, 1, 1, 1, "Returns all members of a set."},
+	"SISMEMBER":  {3, 1, 1, 1, "Determines whether a member belongs to a set."},
+	"SCARD":      {2, 1, 1, 1, "Returns the number of members in a set."},
+	"SINTER":     {-2, 1, -1, 1, "Returns the intersect of multiple sets."},
+	"SINTERCARD": {-3, 0, 0, 0, "Returns the number of members of the intersect of multiple sets."},
+
+	"SINTERSTORE": {-3, 1, -1, 1, "Stores the intersect of multiple sets in a key."},
+	"SUNIONSTORE": {-3, 1, -1, 1, "Stores the union of multiple sets in a key."},
+	"SDIFFSTORE":  {-3, 1, -1, 1, "Stores the difference of multiple sets in a key."},
+
+	"ZADD":            {-4, 1, 1, 1, "Adds one or more members to a sorted set, or updates their scores."},
+	"ZINCRBY":         {4, 1, 1, 1, "Increments the score of a member in a sorted set."},
+	"ZRANGEBYSCORE":   {-4, 1, 1, 1, "Returns members in a sorted set within a range of scores."},
+	"ZRANGEBYLEX":     {-4, 1, 1, 1, "Returns members in a sorted set within a lexicographical range."},
+	"ZREM":            {-3, 1, 1, 1, "Removes one or more members from a sorted set."},
+	"ZREMRANGEBYRANK": {4, 1, 1, 1, "Removes members in a sorted set within a range of indexes."},
+
+	"DEL":      {-2, 1, -1, 1, "Deletes one or more keys."},
+	"UNLINK":   {-2, 1, -1, 1, "Asynchronously deletes one or more keys."},
+	"KEYS":     {2, 0, 0, 0, "Returns all key names that match a pattern."},
+	"SCAN":     {-2, 0, 0, 0, "Iterates over the key names in the database."},
+	"SORT":     {-2, 1, 1, 1, "Sorts the elements in a list or a set."},
+	"EXPIRE":   {-3, 1, 1, 1, "Sets the expiration time of a key in seconds."},
+	"TTL":      {2, 1, 1, 1, "Returns the expiration time in seconds of a key."},
+	"PERSIST":  {2, 1, 1, 1, "Removes the expiration time of a key."},
+	"FLUSHDB":  {-1, 0, 0, 0, "Removes all keys from the current database."},
+	"FLUSHALL": {-1, 0, 0, 0, "Removes all keys from all databases."},
+
+	"PEXPIREAT": {-3, 1, 1, 1, "Sets the expiration time of a key to a Unix milliseconds timestamp."},
+
+	"PUBLISH":      {3, 0, 0, 0, "Posts a message to a channel."},
+	"SUBSCRIBE":    {-2, 0, 0, 0, "Listens for messages published to channels."},
+	"UNSUBSCRIBE":  {-1, 0, 0, 0, "Stops listening to messages posted to channels."},
+	"PSUBSCRIBE":   {-2, 0, 0, 0, "Listens for messages published to channels that match one or more patterns."},
+	"PUNSUBSCRIBE": {-1, 0, 0, 0, "Stops listening to messages published to channels that match one or more patterns."},
+
+	"CLIENT":  {-2, 0, 0, 0, "A container for client connection commands."},
+	"MONITOR": {1, 0, 0, 0, "Listens for all requests received by the server in real-time."},
+	"MULTI":   {1, 0, 0, 0, "Starts a transaction."},
+	"EXEC":    {1, 0, 0, 0, "Executes all commands in a transaction."},
+	"DISCARD": {1, 0, 0, 0, "Discards a transaction."},
+	"RESET":   {1, 0, 0, 0, "Resets the connection."},
+	"QUIT":    {-1, 0, 0, 0, "Closes the connection."},
+
+	"SYNC":      {1, 0, 0, 0, "An internal command used in replication."},
+	"REPLICAOF": {3, 0, 0, 0, "Configures a server as replica of another, or promotes it to a master."},
+	"SLAVEOF":   {3, 0, 0, 0, "Sets a Redis server as a replica of another, or promotes it to being a master."},
+}
+
+// commandFlags is a map of command names to their flags. The "write" flag is added for
+// every command in WriteCommands, so it is only listed here for the blocking commands,
+// which write their own changes to the AOF. The flags use the Redis names: "readonly"
+// commands only read the data, "fast" commands run in constant or logarithmic time,
+// "admin" commands manage the server, "pubsub" commands are part of pub/sub,
+// "blocking" commands may block the connection, and "no_multi" commands cannot be
+// queued by MULTI, since they either wait for the locks EXEC holds, or write their
+// replies to the connection themselves, which would leave the reply of EXEC short.
+var commandFlags = map[string][]string{
+	"PING":    {"fast"},
+	"LOLWUT":  {"readonly", "fast"},
+	"INFO":    {},
+	"CONFIG":  {"admin"},
+	"SAVE":    {"admin", "no_multi"},
+	"FSYNC":   {"admin"},
+	"OBJECT":  {"readonly"},
+	"MEMORY":  {"readonly"},
+	"DEBUG":   {"admin", "no_multi"},
+	"COMMAND": {},
+
+	"SET":      {},
+	"GET":      {"readonly", "fast"},
+	"GETDEL":   {"fast"},
+	"MSETNX":   {},
+	"GETRANGE": {"readonly"},
+	"SUBSTR":   {"readonly"},
+	"SETRANGE": {},
+	"APPEND":   {"fast"},
+	"LCS":      {"readonly"},
+	"SETBIT":   {},
+	"GETBIT":   {"readonly", "fast"},
+	"BITCOUNT": {"readonly"},
+	"BITOP":    {},
+
+	"HSET":       {"fast"},
+	"HGET":       {"readonly", "fast"},
+	"HGETALL":    {"readonly"},
+	"HKEYS":      {"readonly"},
+	"HVALS":      {"readonly"},
+	"HSCAN":      {"readonly"},
+	"HRANDFIELD": {"readonly"},
+	"HGETDEL":    {"fast"},
+	"HGETEX":     {"fast"},
+	"HEXPIRE":    {"fast"},
+	"HPEXPIREAT": {"fast"},
+	"HTTL":       {"readonly", "fast"},
+
+	"LPUSH":  {"fast"},
+	"RPUSH":  {"fast"},
+	"LPOP":   {"fast"},
+	"RPOP":   {"fast"},
+	"LLEN":   {"readonly", "fast"},
+	"LRANGE": {"readonly"},
+	"LTRIM":  {},
+	"LINDEX": {"readonly"},
+	"BLPOP":  {"write", "blocking"},
+	"BRPOP":  {"write", "blocking"},
+
+	"SADD":       {"fast"},
+	"SREM":       {"fast"},
+	"SMEMBERS":   {"readonly"},
+	"SISMEMBER":  {"readonly", "fast"},
+	"SCARD":      {"readonly", "fast"},
+	"SINTER":     {"readonly"},
+	"SINTERCARD": {"readonly"},
+
+	"SINTERSTORE": {},
+	"SUNIONSTORE": {},
+	"SDIFFSTORE":  {},
+
+	"ZADD":            {"fast"},
+	"ZINCRBY":         {"fast"},
+	"ZRANGEBYSCORE":   {"readonly"},
+	"ZRANGEBYLEX":     {"readonly"},
+	"ZREM":            {"fast"},
+	"ZREMRANGEBYRANK": {},
+
+	"DEL":      {},
+	"UNLINK":   {"fast"},
+	"KEYS":     {"readonly"},
+	"SCAN":     {"readonly"},
+	"SORT":     {"readonly"},
+	"EXPIRE":   {"fast"},
+	"TTL":      {"readonly", "fast"},
+	"PERSIST":  {"fast"},
+	"FLUSHDB":  {},
+	"FLUSHALL": {},
+
+	"PEXPIREAT": {"fast"},
+
+	"PUBLISH":      {"pubsub", "fast"},
+	"SUBSCRIBE":    {"pubsub", "no_multi"},
+	"UNSUBSCRIBE":  {"pubsub", "no_multi"},
+	"PSUBSCRIBE":   {"pubsub", "no_multi"},
+	"PUNSUBSCRIBE": {"pubsub", "no_multi"},
+
+	"CLIENT":  {},
+	"MONITOR": {"admin"},
+	"MULTI":   {"fast"},
+	"EXEC":    {},
+	"DISCARD": {"fast"},
+	"RESET":   {"fast"},
+	"QUIT":    {"fast"},
+
+	"SYNC":      {"admin", "no_multi"},
+	"REPLICAOF": {"admin"},
+	"SLAVEOF":   {"admin"},
+}
+
+// flagsOf returns the flags of the command: "write" for commands in WriteCommands,
+// followed by the flags in commandFlags.
+func flagsOf(name string) []string {
+	flags := []string{}
+	if WriteCommands[name] {
+		flags = append(flags, "write")
+	}
+
+	return append(flags, commandFlags[name]...)
+}
+
+// commandInfo returns the COMMAND INFO reply for a single command: an array of its name,
+// arity, flags, and first key, last key and step. It returns a null value if the command
+// is unknown.
+func commandInfo(name string) Value {
+	spec, ok := commandSpecs[name]
+	if !ok {
+		return Value{typ: "null"}
+	}
+
+	flags := []Value{}
+	for _, flag := range flagsOf(name) {
+		flags = append(flags, Value{typ: "string", str: flag})
+	}
+
+	return Value{typ: "array", array: []Value{
+		{typ: "bulk", bulk: strings.ToLower(name)},
+		{typ: "integer", num: spec.arity},
+		{typ: "array", array: flags},
+		{typ: "integer", num: spec.firstKey},
+		{typ: "integer", num: spec.lastKey},
+		{typ: "integer", num: spec.step},
+	}}
+}
+
+// commandDocs returns the COMMAND DOCS reply for a single command: a map, encoded as an
+// array of alternating names and values, of its summary, arity and flags.
+func commandDocs(name string) Value {
+	spec := commandSpecs[name]
+
+	flags := []Value{}
+	for _, flag := range flagsOf(name) {
+		flags = append(flags, Value{typ: "string", str: flag})
+	}
+
+	return Value{typ: "array", array: []Value{
+		{typ: "bulk", bulk: "summary"},
+		{typ: "bulk", bulk: spec.summary},
+		{typ: "bulk", bulk: "arity"},
+		{typ: "integer", num: spec.arity},
+		{typ: "bulk", bulk: "flags"},
+		{typ: "array", array: flags},
+	}}
+}
+
+// commandKeys returns the COMMAND GETKEYS reply for a full command, name included: an
+// array of the arguments that are keys according to the key positions of the command.
+// If the command is unknown, its number of arguments does not match its arity, or it
+// takes no keys, it returns an error.
+func commandKeys(argv []Value) Value {
+	spec, ok := commandSpecs[strings.ToUpper(argv[0].bulk)]
+	if !ok {
+		return Value{typ: "error", str: "ERR Invalid command specified"}
+	}
+
+	if (spec.arity > 0 && len(argv) != spec.arity) || (spec.arity < 0 && len(argv) < -spec.arity) {
+		return Value{typ: "error", str: "ERR Invalid number of arguments specified for command"}
+	}
+
+	if spec.firstKey == 0 {
+		return Value{typ: "error", str: "ERR The command has no key arguments"}
+	}
+
+	last := spec.lastKey
+	if last < 0 {
+		last += len(argv)
+	}
+
+	keys := []Value{}
+	for i := spec.firstKey; i <= last && i < len(argv); i += spec.step {
+		keys = append(keys, Value{typ: "bulk", bulk: argv[i].bulk})
+	}
+
+	return Value{typ: "array", array: keys}
+}
+
+// COMMAND is registered here rather than in the Handlers literal, because COMMAND COUNT
+// counts the Handlers map, which would then depend on itself.
+func init() {
+	Handlers["COMMAND"] = command
+}
+
+// commandCount returns the number of commands the server runs: the handlers in Handlers,
+// SessionHandlers and BlockingHandlers, and EXEC, which execute runs itself. The maps are
+// counted every time, so commands registered at startup, such as DEBUG, are included.
+func commandCount() int {
+	names := map[string]bool{"EXEC": true}
+	for name := range Handlers {
+		names[name] = true
+	}
+	for name := range SessionHandlers {
+		names[name] = true
+	}
+	for name := range BlockingHandlers {
+		names[name] = true
+	}
+
+	return len(names)
+}
+
+// sortedCommandNames returns the names of every command in commandSpecs, sorted.
+func sortedCommandNames() []string {
+	names := make([]string, 0, len(commandSpecs))
+	for name := range commandSpecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// command is a command handler for the COMMAND command, which describes the commands the
+// server supports. Without arguments, it returns the COMMAND INFO reply of every command.
+// Otherwise it takes a subcommand:
+// - INFO [command ...]: returns an array with the name, arity, flags, and key positions of
+// every given command, or of every command if none is given. Unknown commands are
+// reported as null values.
+// - DOCS [command ...]: returns a map, encoded as an array of alternating names and
+// values, of every given command, or of every command if none is given, to a map of its
+// summary, arity and flags. Unknown commands are left out.
+// - COUNT: returns the number of commands the server runs, see commandCount.
+// - GETKEYS command [arg ...]: returns an array of the arguments of the given command that
+// are keys, found with its key positions, so cluster clients can route commands they do
+// not know. See commandKeys.
+// - HELP: returns an array of lines describing the subcommands.
+// If the subcommand is unknown, it returns an error.
+func command(args []Value) Value {
+	if len(args) == 0 {
+		args = []Value{{typ: "bulk", bulk: "INFO"}}
+	}
+
+	subcommand := strings.ToUpper(args[0].bulk)
+
+	names := []string{}
+	for _, arg := range args[1:] {
+		names = append(names, strings.ToUpper(arg.bulk))
+	}
+
+	switch subcommand {
+	case "HELP":
+		return helpReply("COMMAND",
+			"(no subcommand)",
+			"    Return details about all commands.",
+			"COUNT",
+			"    Return the total number of commands in this Redis server.",
+			"DOCS [<command-name> ...]",
+			"    Return documentation details about multiple commands.",
+			"    If no command names are given, documentation details for all",
+			"    commands are returned.",
+			"GETKEYS <full-command>",
+			"    Return the keys from a full Redis command.",
+			"INFO [<command-name> ...]",
+			"    Return details about multiple commands.",
+			"    If no command names are given, details for all commands are returned.",
+		)
+	case "INFO":
+		if len(names) == 0 {
+			names = sortedCommandNames()
+		}
+
+		values := make([]Value, 0, len(names))
+		for _, name := range names {
+			values = append(values, commandInfo(name))
+		}
+
+		return Value{typ: "array", array: values}
+	case "DOCS":
+		if len(names) == 0 {
+			names = sortedCommandNames()
+		}
+
+		values := []Value{}
+		for _, name := range names {
+			if _, ok := commandSpecs[name]; !ok {
+				continue
+			}
+			values = append(values, Value{typ: "bulk", bulk: strings.ToLower(name)}, commandDocs(name))
+		}
+
+		return Value{typ: "array", array: values}
+	case "COUNT":
+		if len(args) != 1 {
+			return Value{typ: "error", str: "ERR wrong number of arguments for 'command|count' command"}
+		}
+
+		return Value{typ: "integer", num: commandCount()}
+	case "GETKEYS":
+		if len(args) < 2 {
+			return Value{typ: "error", str: "ERR wrong number of arguments for 'command|getkeys' command"}
+		}
+
+		return commandKeys(args[1:])
+	default:
+		return Value{typ: "error", str: "ERR unknown subcommand '" + subcommand + "'"}
+	}
+}
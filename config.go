@@ -0,0 +1,437 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ConfigMu is a read-write mutex that protects access to the configuration variables
+// that can be changed at runtime with CONFIG SET.
+var ConfigMu = sync.RWMutex{}
+
+// configParam describes a configuration parameter. Each parameter can be read with
+// CONFIG GET, changed with CONFIG SET, and set on startup with a command-line flag
+// of the same name. Immutable parameters can only be set on startup.
+type configParam struct {
+	usage     string
+	immutable bool
+	get       func() string
+	set       func(value string) error
+}
+
+// ConfigParams is a map of configuration parameter names to their descriptions.
+// The getters and setters acquire the ConfigMu mutex themselves.
+var ConfigParams = map[string]configParam{
+	"save": {
+		usage: `snapshot save points as "<seconds> <changes>" pairs, or "" to disable`,
+		get:   getSavePoints,
+		set:   setSavePoints,
+	},
+	"maxmemory": {
+		usage: "approximate memory limit for stored data, e.g. 100mb, or 0 for no limit",
+		get: func() string {
+			ConfigMu.RLock()
+			defer ConfigMu.RUnlock()
+
+			return strconv.FormatInt(maxMemory, 10)
+		},
+		set: func(value string) error {
+			n, err := parseMemory(value)
+			if err != nil {
+				return err
+			}
+
+			ConfigMu.Lock()
+			maxMemory = n
+			ConfigMu.Unlock()
+
+			return nil
+		},
+	},
+	"maxmemory-policy": {
+		usage: "eviction policy once maxmemory is reached: noeviction, allkeys-lru, allkeys-lfu or allkeys-random",
+		get: func() string {
+			ConfigMu.RLock()
+			defer ConfigMu.RUnlock()
+
+			return maxMemoryPolicy
+		},
+		set: func(value string) error {
+			value = strings.ToLower(value)
+			if !maxMemoryPolicies[value] {
+				return errors.New("argument(s) must be one of the following: noeviction, allkeys-lru, allkeys-lfu, allkeys-random")
+			}
+
+			ConfigMu.Lock()
+			maxMemoryPolicy = value
+			ConfigMu.Unlock()
+
+			return nil
+		},
+	},
+	"enable-debug-command": {
+		usage:     "allow the DEBUG command: yes or no",
+		immutable: true,
+		get: func() string {
+			ConfigMu.RLock()
+			defer ConfigMu.RUnlock()
+
+			return yesNo(debugEnabled)
+		},
+		set: func(value string) error {
+			enabled, err := parseYesNo(value)
+			if err != nil {
+				return err
+			}
+
+			ConfigMu.Lock()
+			debugEnabled = enabled
+			ConfigMu.Unlock()
+
+			return nil
+		},
+	},
+	"notify-keyspace-events": {
+		usage: `classes of keyspace events published to pub/sub, e.g. "KEA" or "Ex", or "" to disable`,
+		get: func() string {
+			ConfigMu.RLock()
+			defer ConfigMu.RUnlock()
+
+			return formatNotifyFlags(notifyKeyspaceEvents)
+		},
+		set: func(value string) error {
+			flags, err := parseNotifyFlags(value)
+			if err != nil {
+				return err
+			}
+
+			ConfigMu.Lock()
+			notifyKeyspaceEvents = flags
+			ConfigMu.Unlock()
+
+			return nil
+		},
+	},
+	"debug-noop-subcommands": {
+		usage: `DEBUG subcommands that are accepted and only reply OK, e.g. "LISTPACK STRINGMATCH-LEN"`,
+		get:   getDebugNoops,
+		set:   setDebugNoops,
+	},
+	"auto-aof-rewrite-percentage": intParam("growth of the AOF since the last rewrite, in percent, that triggers a rewrite, or 0 to disable", &autoAofRewritePercentage),
+	"auto-aof-rewrite-min-size": {
+		usage: "minimum size of the AOF before it is rewritten automatically, e.g. 64mb",
+		get: func() string {
+			ConfigMu.RLock()
+			defer ConfigMu.RUnlock()
+
+			return strconv.FormatInt(autoAofRewriteMinSize, 10)
+		},
+		set: func(value string) error {
+			n, err := parseMemory(value)
+			if err != nil {
+				return err
+			}
+
+			ConfigMu.Lock()
+			autoAofRewriteMinSize = n
+			ConfigMu.Unlock()
+
+			return nil
+		},
+	},
+	"client-query-buffer-limit": {
+		usage: "maximum total length of the arguments of a single request sent by a client, e.g. 1gb, at least 1mb",
+		get: func() string {
+			ConfigMu.RLock()
+			defer ConfigMu.RUnlock()
+
+			return strconv.FormatInt(clientQueryBufferLimit, 10)
+		},
+		set: func(value string) error {
+			n, err := parseMemory(value)
+			if err != nil {
+				return err
+			}
+			if n < 1<<20 {
+				return errors.New("argument must be at least 1mb")
+			}
+
+			ConfigMu.Lock()
+			clientQueryBufferLimit = n
+			ConfigMu.Unlock()
+
+			return nil
+		},
+	},
+	"proto-max-bulk-len": {
+		usage: "maximum length of a bulk string sent by a client, and of a string value, e.g. 512mb, at least 1mb",
+		get: func() string {
+			ConfigMu.RLock()
+			defer ConfigMu.RUnlock()
+
+			return strconv.FormatInt(protoMaxBulkLen, 10)
+		},
+		set: func(value string) error {
+			n, err := parseMemory(value)
+			if err != nil {
+				return err
+			}
+			if n < 1<<20 {
+				return errors.New("argument must be at least 1mb")
+			}
+
+			ConfigMu.Lock()
+			protoMaxBulkLen = n
+			ConfigMu.Unlock()
+
+			return nil
+		},
+	},
+	"port":                      immutable(intParam("TCP port the server listens on", &port)),
+	"tcp-backlog":               immutable(intParam("length of the queue of connections not accepted yet, or 0 for the system default", &tcpBacklog)),
+	"connection-workers":        immutable(intParam("maximum number of connections served at once, the others wait to be accepted, or 0 for no limit", &connectionWorkers)),
+	"read-buffer-size":          intParam("size in bytes of the buffer client requests are read through, e.g. larger for bulk loading", &readBufferSize),
+	"tcp-keepalive":             intParam("TCP keepalive period of client connections in seconds, or 0 to disable keepalive", &tcpKeepAlive),
+	"hash-max-listpack-entries": intParam("maximum number of fields of a hash reported with the listpack encoding", &hashMaxListpackEntries),
+	"hash-max-listpack-value":   intParam("maximum length of the fields and values of a hash reported with the listpack encoding", &hashMaxListpackValue),
+	"list-max-listpack-size":    intParam("maximum number of elements of a list reported with the listpack encoding", &listMaxListpackSize),
+	"set-max-intset-entries":    intParam("maximum number of members of a set of integers reported with the intset encoding", &setMaxIntsetEntries),
+	"set-max-listpack-entries":  intParam("maximum number of members of a set reported with the listpack encoding", &setMaxListpackEntries),
+	"set-max-listpack-value":    intParam("maximum length of the members of a set reported with the listpack encoding", &setMaxListpackValue),
+	"zset-max-listpack-entries": intParam("maximum number of members of a sorted set reported with the listpack encoding", &zsetMaxListpackEntries),
+	"zset-max-listpack-value":   intParam("maximum length of the members of a sorted set reported with the listpack encoding", &zsetMaxListpackValue),
+	"lfu-log-factor":            intParam("how many accesses it takes to increment the LFU frequency counter of a key, logarithmically", &lfuLogFactor),
+	"lfu-decay-time":            intParam("minutes without access after which the LFU frequency counter of a key is decremented, or 0 to never decay", &lfuDecayTime),
+	"replica-buffer-size":       intParam("maximum number of writes queued for a replica before it is disconnected", &replicaBufferSize),
+	"pubsub-buffer-size":        intParam("maximum number of pub/sub messages queued for a subscriber before it is disconnected", &pubsubBufferSize),
+	"active-expire-samples":     positiveIntParam("number of keys with an expiry sampled by every round of the background expiry sweep, at least 1", &activeExpireSamples),
+	"read-only": {
+		usage: "refuse every write command: yes or no",
+		get: func() string {
+			ConfigMu.RLock()
+			defer ConfigMu.RUnlock()
+
+			return yesNo(readOnly)
+		},
+		set: func(value string) error {
+			enabled, err := parseYesNo(value)
+			if err != nil {
+				return err
+			}
+
+			ConfigMu.Lock()
+			readOnly = enabled
+			ConfigMu.Unlock()
+
+			return nil
+		},
+	},
+	"aof-write-queue": {
+		usage:     "queue AOF writes for a background writer, so commands never wait for the disk: yes or no",
+		immutable: true,
+		get: func() string {
+			ConfigMu.RLock()
+			defer ConfigMu.RUnlock()
+
+			return yesNo(aofWriteQueue)
+		},
+		set: func(value string) error {
+			enabled, err := parseYesNo(value)
+			if err != nil {
+				return err
+			}
+
+			ConfigMu.Lock()
+			aofWriteQueue = enabled
+			ConfigMu.Unlock()
+
+			return nil
+		},
+	},
+	"pidfile": immutable(configParam{
+		usage: "path of the file the process ID is written to while the server runs, or empty for none",
+		get: func() string {
+			ConfigMu.RLock()
+			defer ConfigMu.RUnlock()
+
+			return pidFile
+		},
+		set: func(value string) error {
+			ConfigMu.Lock()
+			pidFile = value
+			ConfigMu.Unlock()
+
+			return nil
+		},
+	}),
+	"dbfilename": {
+		usage: "path of the snapshot file written by SAVE",
+		get: func() string {
+			ConfigMu.RLock()
+			defer ConfigMu.RUnlock()
+
+			return dbFilename
+		},
+		set: func(value string) error {
+			ConfigMu.Lock()
+			dbFilename = value
+			ConfigMu.Unlock()
+
+			return nil
+		},
+	},
+}
+
+// intParam returns a configParam for a non-negative integer variable, which the getter
+// and setter access under the ConfigMu mutex.
+func intParam(usage string, v *int) configParam {
+	return configParam{
+		usage: usage,
+		get: func() string {
+			ConfigMu.RLock()
+			defer ConfigMu.RUnlock()
+
+			return strconv.Itoa(*v)
+		},
+		set: func(value string) error {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return errors.New("argument must be a non-negative integer")
+			}
+
+			ConfigMu.Lock()
+			*v = n
+			ConfigMu.Unlock()
+
+			return nil
+		},
+	}
+}
+
+// positiveIntParam returns a configParam like intParam, for a variable that must be at
+// least 1, such as one that 0 would silently disable.
+func positiveIntParam(usage string, v *int) configParam {
+	param := intParam(usage, v)
+	set := param.set
+	param.set = func(value string) error {
+		if n, err := strconv.Atoi(value); err == nil && n < 1 {
+			return errors.New("argument must be at least 1")
+		}
+
+		return set(value)
+	}
+
+	return param
+}
+
+// immutable returns the parameter marked as immutable, so it can only be set on startup.
+func immutable(param configParam) configParam {
+	param.immutable = true
+
+	return param
+}
+
+// yesNo returns the "yes" or "no" representation of a boolean configuration value.
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+
+	return "no"
+}
+
+// parseYesNo parses a boolean configuration value, which must be "yes" or "no".
+func parseYesNo(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "yes":
+		return true, nil
+	case "no":
+		return false, nil
+	default:
+		return false, errors.New("argument must be 'yes' or 'no'")
+	}
+}
+
+// registerConfigFlags registers a command-line flag for every parameter in
+// ConfigParams, so that the configuration can be set on startup, e.g.
+// -save "900 1 300 10". It must be called before flag.Parse.
+func registerConfigFlags() {
+	for name, param := range ConfigParams {
+		flag.Func(name, param.usage, param.set)
+	}
+}
+
+// config is a command handler for the CONFIG command. It takes a subcommand as its
+// first argument:
+// - GET <pattern>: returns an array with the name and value of every parameter matching
+// the glob pattern, or an empty array if none match.
+// - SET <parameter> <value>: changes the parameter and returns "OK".
+// - HELP: returns an array of lines describing the subcommands.
+// If the subcommand is unknown, the parameter is unknown or immutable, or the value is
+// invalid, it returns an error.
+func config(args []Value) Value {
+	if len(args) == 0 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'config' command"}
+	}
+
+	subcommand := strings.ToUpper(args[0].bulk)
+	args = args[1:]
+
+	switch subcommand {
+	case "HELP":
+		return helpReply("CONFIG",
+			"GET <pattern>",
+			"    Return parameters matching the glob-like <pattern> and their values.",
+			"SET <parameter> <value>",
+			"    Set the configuration <parameter> to <value>. Immutable parameters can only",
+			"    be set on startup, with the command-line flag of the same name.",
+		)
+	case "GET":
+		if len(args) != 1 {
+			return Value{typ: "error", str: "ERR wrong number of arguments for 'config|get' command"}
+		}
+
+		pattern := strings.ToLower(args[0].bulk)
+
+		names := make([]string, 0, len(ConfigParams))
+		for name := range ConfigParams {
+			if glob(pattern, name) {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+
+		values := []Value{}
+		for _, name := range names {
+			values = append(values, Value{typ: "bulk", bulk: name}, Value{typ: "bulk", bulk: ConfigParams[name].get()})
+		}
+
+		return Value{typ: "array", array: values}
+	case "SET":
+		if len(args) != 2 {
+			return Value{typ: "error", str: "ERR wrong number of arguments for 'config|set' command"}
+		}
+
+		name := strings.ToLower(args[0].bulk)
+		param, ok := ConfigParams[name]
+		if !ok {
+			return Value{typ: "error", str: "ERR Unknown option or number of arguments for CONFIG SET - '" + name + "'"}
+		}
+
+		if param.immutable {
+			return Value{typ: "error", str: "ERR CONFIG SET failed (possibly related to argument '" + name + "') - can't set immutable config"}
+		}
+
+		if err := param.set(args[1].bulk); err != nil {
+			return Value{typ: "error", str: "ERR CONFIG SET failed (possibly related to argument '" + name + "') - " + err.Error()}
+		}
+
+		return Value{typ: "string", str: "OK"}
+	default:
+		return Value{typ: "error", str: "ERR unknown subcommand '" + subcommand + "'"}
+	}
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// debugEnabled controls whether the DEBUG command can be used. It can only be set on
+// startup, since DEBUG exposes internals that should not be reachable by every client.
+// It is protected by the ConfigMu mutex.
+var debugEnabled = false
+
+// activeExpire controls whether keys with an expiry are deleted in the background once
+// they expire. When it is false, expired keys are only deleted lazily, when they are
+// accessed. It is changed with DEBUG SET-ACTIVE-EXPIRE, and is protected by the
+// ConfigMu mutex.
+var activeExpire = true
+
+// debugNoopSubcommands is the set of DEBUG subcommands that are accepted and do
+// nothing, returning "OK". Client test suites tune internals of Redis with them that
+// this server does not have, so they only need to succeed. It is protected by the
+// ConfigMu mutex.
+var debugNoopSubcommands = map[string]bool{
+	"QUICKLIST-PACKED-THRESHOLD": true,
+	"STRINGMATCH-LEN":            true,
+	"LISTPACK":                   true,
+}
+
+// getDebugNoops returns the no-op DEBUG subcommands in the format used by the
+// "debug-noop-subcommands" configuration parameter, e.g. "LISTPACK STRINGMATCH-LEN".
+func getDebugNoops() string {
+	ConfigMu.RLock()
+	defer ConfigMu.RUnlock()
+
+	names := make([]string, 0, len(debugNoopSubcommands))
+	for name := range debugNoopSubcommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return strings.Join(names, " ")
+}
+
+// setDebugNoops replaces the no-op DEBUG subcommands with the space-separated names in
+// value. The names are case-insensitive, and an empty value leaves none.
+func setDebugNoops(value string) error {
+	noops := map[string]bool{}
+	for _, name := range strings.Fields(value) {
+		noops[strings.ToUpper(name)] = true
+	}
+
+	ConfigMu.Lock()
+	debugNoopSubcommands = noops
+	ConfigMu.Unlock()
+
+	return nil
+}
+
+// stallMu is held for writing by DEBUG SLEEP GLOBAL, and every connection waits for it
+// with waitForStall before running a command. This emulates a Redis server blocked by a
+// slow command, since otherwise a connection only ever blocks itself.
+var stallMu = sync.RWMutex{}
+
+// waitForStall blocks until no DEBUG SLEEP GLOBAL is in progress. Commands that are
+// already running when the sleep starts are not waited for.
+func waitForStall() {
+	stallMu.RLock()
+	stallMu.RUnlock()
+}
+
+// DEBUG is registered here rather than in the Handlers literal, because DEBUG RELOAD
+// replays the snapshot through the Handlers map, which would then depend on itself.
+func init() {
+	Handlers["DEBUG"] = debug
+}
+
+// quicklistLayout returns the quicklist fields of DEBUG OBJECT for the list at key: the
+// number of elements, and the number of nodes and average elements per node Redis would
+// use with list-max-listpack-size elements per node. Lists are stored in a single slice,
+// so the layout is only an approximation to compare against Redis. It returns false if
+// the key does not hold a list. It acquires a read lock on the LISTsMu mutex.
+func quicklistLayout(key string) (string, bool) {
+	ConfigMu.RLock()
+	nodeSize := listMaxListpackSize
+	ConfigMu.RUnlock()
+
+	LISTsMu.RLock()
+	list, ok := LISTs[key]
+	elements := len(list)
+	LISTsMu.RUnlock()
+
+	if !ok {
+		return "", false
+	}
+
+	nodes := 1
+	if nodeSize > 0 && elements > nodeSize {
+		nodes = (elements + nodeSize - 1) / nodeSize
+	}
+
+	return fmt.Sprintf("ql_nodes:%d ql_avg_node:%.2f ql_listpack_max:%d ql_compressed:0 ql_elements:%d",
+		nodes, float64(elements)/float64(nodes), nodeSize, elements), true
+}
+
+// debug is a command handler for the DEBUG command, which exposes internals of the
+// server for testing and debugging. It is only available when the
+// enable-debug-command option was set on startup. It takes a subcommand as its
+// first argument:
+// - OBJECT <key>: returns a status line with the refcount, encoding, serialized length
+// and idle time of the value at key. The serialized length is the size of the value in
+// a snapshot, see serializedLength. For a list, it also reports the number of elements
+// and the layout of the quicklist nodes Redis would split it into, see quicklistLayout.
+// - RAW <key>: returns the string stored at key exactly as it is held in memory.
+// - ADVANCE-CLOCK <milliseconds>: moves the clock used for expiry forward, so tests can
+// expire keys without sleeping, see clock. The expiry times written to the append-only
+// file are on the moved clock too, so keys set meanwhile expire later after a restart.
+// - JMAP: returns a bulk string with the number of goroutines, the number of keys of
+// every type and the size of the append-only file, see jmap.
+// - SET-ACTIVE-EXPIRE <0|1>: disables or enables the background deletion of expired
+// keys, so tests can check that keys also expire lazily on access.
+// - RELOAD: saves a snapshot, deletes every key from memory and loads the snapshot
+// back, so tests can check that the data survives a round trip through the snapshot.
+// - SLEEP <seconds> [GLOBAL]: sleeps for the given number of seconds, which may be
+// fractional, and returns "OK". By default only the calling connection is blocked, while
+// the others keep being served. With GLOBAL, every other connection is also blocked
+// before running its next command until the sleep ends, like a single-threaded Redis
+// server would be.
+// - HELP: returns an array of lines describing the subcommands.
+// The subcommands in debugNoopSubcommands are accepted with any arguments and only
+// return "OK". Other unknown subcommands return an error.
+// If the key given to OBJECT or RAW does not exist, it returns an error.
+func debug(args []Value) Value {
+	ConfigMu.RLock()
+	enabled := debugEnabled
+	ConfigMu.RUnlock()
+
+	if !enabled {
+		return Value{typ: "error", str: "ERR DEBUG command not allowed. Restart the server with -enable-debug-command yes to use it."}
+	}
+
+	if len(args) == 0 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'debug' command"}
+	}
+
+	subcommand := strings.ToUpper(args[0].bulk)
+	args = args[1:]
+
+	switch subcommand {
+	case "HELP":
+		return helpReply("DEBUG",
+			"OBJECT <key>",
+			"    Show low-level information about the <key> and associated value.",
+			"RAW <key>",
+			"    Return the string value of <key> exactly as it is stored in memory.",
+			"RELOAD",
+			"    Save the snapshot on disk, delete every key, and reload the snapshot.",
+			"ADVANCE-CLOCK <milliseconds>",
+			"    Move the clock used for key and field expiry forward by <milliseconds>, or",
+			"    back if negative, so keys expire without waiting.",
+			"JMAP",
+			"    Show the number of goroutines, the number of keys of every type, and the",
+			"    size of the append-only file, to diagnose leaks.",
+			"SET-ACTIVE-EXPIRE <0|1>",
+			"    Setting it to 0 disables the background deletion of expired keys, so keys",
+			"    only expire when they are accessed.",
+			"SLEEP <seconds> [GLOBAL]",
+			"    Stop the current connection for <seconds>. With GLOBAL, the other",
+			"    connections are stopped as well, like a single-threaded server.",
+		)
+	case "OBJECT":
+		if len(args) != 1 {
+			return Value{typ: "error", str: "ERR wrong number of arguments for 'debug|object' command"}
+		}
+
+		key := args[0].bulk
+		length, ok := serializedLength(key)
+		if !ok {
+			return Value{typ: "error", str: "ERR no such key"}
+		}
+
+		status := fmt.Sprintf("refcount:1 encoding:%s serializedlength:%d lru_seconds_idle:%d",
+			objectEncoding(key), length, int(idleTime(key).Seconds()))
+
+		if layout, ok := quicklistLayout(key); ok {
+			status += " " + layout
+		}
+
+		return Value{typ: "string", str: status}
+	case "RAW":
+		if len(args) != 1 {
+			return Value{typ: "error", str: "ERR wrong number of arguments for 'debug|raw' command"}
+		}
+
+		key := args[0].bulk
+
+		SETsMu.RLock()
+		value, ok := SETs[key]
+		raw := string(value)
+		SETsMu.RUnlock()
+
+		if !ok {
+			if keyType(key) != "none" {
+				return Value{typ: "error", str: "ERR RAW only supports string values"}
+			}
+			return Value{typ: "error", str: "ERR no such key"}
+		}
+
+		return Value{typ: "bulk", bulk: raw}
+	case "JMAP":
+		if len(args) != 0 {
+			return Value{typ: "error", str: "ERR wrong number of arguments for 'debug|jmap' command"}
+		}
+
+		return Value{typ: "bulk", bulk: jmap()}
+	case "ADVANCE-CLOCK":
+		if len(args) != 1 {
+			return Value{typ: "error", str: "ERR wrong number of arguments for 'debug|advance-clock' command"}
+		}
+
+		ms, err := strconv.ParseInt(args[0].bulk, 10, 64)
+		if err != nil {
+			return Value{typ: "error", str: "ERR value is not an integer or out of range"}
+		}
+
+		advanceClock(time.Duration(ms) * time.Millisecond)
+
+		return Value{typ: "string", str: "OK"}
+	case "SET-ACTIVE-EXPIRE":
+		if len(args) != 1 {
+			return Value{typ: "error", str: "ERR wrong number of arguments for 'debug|set-active-expire' command"}
+		}
+
+		var enabled bool
+		switch args[0].bulk {
+		case "0":
+			enabled = false
+		case "1":
+			enabled = true
+		default:
+			return Value{typ: "error", str: "ERR value is not an integer or out of range"}
+		}
+
+		ConfigMu.Lock()
+		activeExpire = enabled
+		ConfigMu.Unlock()
+
+		return Value{typ: "string", str: "OK"}
+	case "RELOAD":
+		if len(args) != 0 {
+			return Value{typ: "error", str: "ERR wrong number of arguments for 'debug|reload' command"}
+		}
+
+		if err := reload(); err != nil {
+			return Value{typ: "error", str: "ERR " + err.Error()}
+		}
+
+		return Value{typ: "string", str: "OK"}
+	case "SLEEP":
+		if len(args) != 1 && len(args) != 2 {
+			return Value{typ: "error", str: "ERR wrong number of arguments for 'debug|sleep' command"}
+		}
+
+		seconds, err := strconv.ParseFloat(args[0].bulk, 64)
+		if err != nil || seconds < 0 {
+			return Value{typ: "error", str: "ERR value is not a valid float"}
+		}
+
+		if len(args) == 2 {
+			if strings.ToUpper(args[1].bulk) != "GLOBAL" {
+				return Value{typ: "error", str: "ERR syntax error"}
+			}
+
+			stallMu.Lock()
+			defer stallMu.Unlock()
+		}
+
+		time.Sleep(time.Duration(seconds * float64(time.Second)))
+
+		return Value{typ: "string", str: "OK"}
+	default:
+		ConfigMu.RLock()
+		noop := debugNoopSubcommands[subcommand]
+		ConfigMu.RUnlock()
+
+		if noop {
+			return Value{typ: "string", str: "OK"}
+		}
+
+		return Value{typ: "error", str: "ERR unknown subcommand '" + subcommand + "'"}
+	}
+}
+
+// jmap returns the report of DEBUG JMAP, with one field:value line for the number of
+// goroutines, the number of keys in each of the data type maps, and the size of the
+// append-only file (AOF), named after the Java tool since it serves the same purpose.
+// A growing number of goroutines with a steady number of connections points to a leak.
+func jmap() string {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "goroutines:%d\r\n", runtime.NumGoroutine())
+
+	SETsMu.RLock()
+	fmt.Fprintf(b, "strings:%d\r\n", len(SETs))
+	SETsMu.RUnlock()
+
+	HSETsMu.RLock()
+	fmt.Fprintf(b, "hashes:%d\r\n", len(HSETs))
+	fmt.Fprintf(b, "hashes_with_field_expiry:%d\r\n", len(hashFieldExpires))
+	HSETsMu.RUnlock()
+
+	LISTsMu.RLock()
+	fmt.Fprintf(b, "lists:%d\r\n", len(LISTs))
+	LISTsMu.RUnlock()
+
+	SSETsMu.RLock()
+	fmt.Fprintf(b, "sets:%d\r\n", len(SSETs))
+	SSETsMu.RUnlock()
+
+	ZSETsMu.RLock()
+	fmt.Fprintf(b, "zsets:%d\r\n", len(ZSETs))
+	ZSETsMu.RUnlock()
+
+	expiresMu.RLock()
+	fmt.Fprintf(b, "expires:%d\r\n", len(expires))
+	expiresMu.RUnlock()
+
+	var size int64
+	if snapshotAof != nil {
+		size = snapshotAof.Size()
+	}
+	fmt.Fprintf(b, "aof_size:%d\r\n", size)
+
+	return b.String()
+}
+
+// reload saves a snapshot to the configured dbfilename, deletes every key, and loads the
+// snapshot back.
+//
+// NOTE: Write commands from other connections that run between the snapshot and the
+// reload are lost from memory, so it should only be used while no one else is writing.
+func reload() error {
+	ConfigMu.RLock()
+	path := dbFilename
+	ConfigMu.RUnlock()
+
+	if err := SaveSnapshot(path); err != nil {
+		return err
+	}
+
+	persistMu.Lock()
+	defer persistMu.Unlock()
+
+	flushAll()
+
+	_, err := LoadSnapshot(path, replay)
+
+	return err
+}
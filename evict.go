@@ -0,0 +1,296 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxMemory is the estimated number of bytes of keys and values the server may store
+// before it starts evicting keys, as computed by keySizes, or 0 for no limit. It is protected by the ConfigMu mutex.
+var maxMemory int64
+
+// maxMemoryPolicy is the policy used to pick the keys to evict once maxMemory is reached:
+// - noeviction: nothing is evicted, and write commands fail with an OOM error.
+// - allkeys-lru: the least recently accessed keys are evicted first.
+// - allkeys-lfu: the least frequently accessed keys are evicted first.
+// - allkeys-random: random keys are evicted.
+// It is protected by the ConfigMu mutex.
+var maxMemoryPolicy = "noeviction"
+
+// maxMemoryPolicies is the set of valid values for maxMemoryPolicy.
+var maxMemoryPolicies = map[string]bool{
+	"noeviction":     true,
+	"allkeys-lru":    true,
+	"allkeys-lfu":    true,
+	"allkeys-random": true,
+}
+
+// freeingCommands is the set of write commands that can only shrink the data set. They
+// are allowed even when maxmemory is reached and nothing can be evicted.
+var freeingCommands = map[string]bool{
+	"DEL":      true,
+	"UNLINK":   true,
+	"GETDEL":   true,
+	"FLUSHDB":  true,
+	"FLUSHALL": true,
+	"LPOP":     true,
+	"RPOP":     true,
+	"LTRIM":    true,
+	"SREM":     true,
+}
+
+// parseMemory parses a memory size such as "1024", "100kb" or "2gb" into a number of
+// bytes. Like Redis, the k, m and g units are powers of 1000, while kb, mb and gb are
+// powers of 1024.
+func parseMemory(value string) (int64, error) {
+	units := []struct {
+		suffix string
+		factor int64
+	}{
+		{"kb", 1 << 10}, {"mb", 1 << 20}, {"gb", 1 << 30},
+		{"k", 1000}, {"m", 1000 * 1000}, {"g", 1000 * 1000 * 1000},
+		{"b", 1},
+	}
+
+	value = strings.ToLower(value)
+	factor := int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(value, unit.suffix) {
+			value = strings.TrimSuffix(value, unit.suffix)
+			factor = unit.factor
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, errors.New("argument must be a memory value")
+	}
+
+	return n * factor, nil
+}
+
+// The estimated overhead, in bytes, of storing a key and each of the strings in its
+// value on top of their length: the map entries and string headers that hold them.
+// They are rough averages for 64-bit platforms, so the estimate scales with the number
+// of entries as well as with their length.
+const (
+	keyOverhead   = 64
+	entryOverhead = 32
+)
+
+// The size estimators below return the estimated number of bytes used by a key and its
+// value, counting the length of the key and of everything stored in the value, plus
+// keyOverhead for the key and entryOverhead for every string, field, element or member
+// stored in it. The caller must hold the read lock of the map the value comes from.
+
+func stringMemory(key string, value []byte) int64 {
+	return keyOverhead + int64(len(key)) + entryOverhead + int64(len(value))
+}
+
+func hashMemory(key string, fields map[string]string) int64 {
+	size := keyOverhead + int64(len(key))
+	for field, value := range fields {
+		size += 2*entryOverhead + int64(len(field)+len(value))
+	}
+
+	return size
+}
+
+func listMemory(key string, list []string) int64 {
+	size := keyOverhead + int64(len(key))
+	for _, element := range list {
+		size += entryOverhead + int64(len(element))
+	}
+
+	return size
+}
+
+func setMemory(key string, set map[string]struct{}) int64 {
+	size := keyOverhead + int64(len(key))
+	for member := range set {
+		size += entryOverhead + int64(len(member))
+	}
+
+	return size
+}
+
+// A score is stored as a float64, so it counts as 8 bytes on top of its member.
+func zsetMemory(key string, zset map[string]float64) int64 {
+	size := keyOverhead + int64(len(key))
+	for member := range zset {
+		size += entryOverhead + int64(len(member)) + 8
+	}
+
+	return size
+}
+
+// keySizes returns the estimated number of bytes used by every key. The maps are read
+// one at a time, each under its own read lock.
+func keySizes() map[string]int64 {
+	sizes := map[string]int64{}
+
+	SETsMu.RLock()
+	for key, value := range SETs {
+		sizes[key] += stringMemory(key, value)
+	}
+	SETsMu.RUnlock()
+
+	HSETsMu.RLock()
+	for key, fields := range HSETs {
+		sizes[key] += hashMemory(key, fields)
+	}
+	HSETsMu.RUnlock()
+
+	LISTsMu.RLock()
+	for key, list := range LISTs {
+		sizes[key] += listMemory(key, list)
+	}
+	LISTsMu.RUnlock()
+
+	SSETsMu.RLock()
+	for key, set := range SSETs {
+		sizes[key] += setMemory(key, set)
+	}
+	SSETsMu.RUnlock()
+
+	ZSETsMu.RLock()
+	for key, zset := range ZSETs {
+		sizes[key] += zsetMemory(key, zset)
+	}
+	ZSETsMu.RUnlock()
+
+	return sizes
+}
+
+// keySize returns the estimated number of bytes used by key, or false if the key does
+// not exist. It acquires the read lock of the map holding the key.
+func keySize(key string) (int64, bool) {
+	switch keyType(key) {
+	case "string":
+		SETsMu.RLock()
+		defer SETsMu.RUnlock()
+
+		value, ok := SETs[key]
+		return stringMemory(key, value), ok
+	case "hash":
+		HSETsMu.RLock()
+		defer HSETsMu.RUnlock()
+
+		fields, ok := HSETs[key]
+		return hashMemory(key, fields), ok
+	case "list":
+		LISTsMu.RLock()
+		defer LISTsMu.RUnlock()
+
+		list, ok := LISTs[key]
+		return listMemory(key, list), ok
+	case "set":
+		SSETsMu.RLock()
+		defer SSETsMu.RUnlock()
+
+		set, ok := SSETs[key]
+		return setMemory(key, set), ok
+	case "zset":
+		ZSETsMu.RLock()
+		defer ZSETsMu.RUnlock()
+
+		zset, ok := ZSETs[key]
+		return zsetMemory(key, zset), ok
+	default:
+		return 0, false
+	}
+}
+
+// usedMemory returns the estimated number of bytes used by the whole data set, which is
+// what maxmemory is compared against.
+func usedMemory() int64 {
+	var used int64
+	for _, size := range keySizes() {
+		used += size
+	}
+
+	return used
+}
+
+// freeMemoryIfNeeded evicts keys according to maxMemoryPolicy until the stored data
+// fits in maxMemory again. Every evicted key is written to the append-only file (AOF)
+// as a DEL under the applyMu mutex with propagate, so evicted keys do not come back when
+// the AOF is replayed. s is the session of the write command that needs the memory, for
+// which EXEC may already hold the mutex. It returns false if the data still does not fit,
+// in which case write commands must be refused.
+//
+// NOTE: The size of the data set is recomputed on every call, which costs O(N) in
+// the number of stored elements, so this is only done when maxMemory is set.
+func freeMemoryIfNeeded(s *Session, aof *Aof) bool {
+	ConfigMu.RLock()
+	limit := maxMemory
+	policy := maxMemoryPolicy
+	ConfigMu.RUnlock()
+
+	if limit == 0 {
+		return true
+	}
+
+	sizes := keySizes()
+	var used int64
+	for _, size := range sizes {
+		used += size
+	}
+
+	if used <= limit {
+		return true
+	}
+
+	if policy == "noeviction" {
+		return false
+	}
+
+	keys := make([]string, 0, len(sizes))
+	for key := range sizes {
+		keys = append(keys, key)
+	}
+	// the map order is random, so the keys are sorted for the evictions to only depend
+	// on the seed of rng
+	sort.Strings(keys)
+
+	switch policy {
+	case "allkeys-lru":
+		idle := make(map[string]time.Duration, len(keys))
+		for _, key := range keys {
+			idle[key] = idleTime(key)
+		}
+		sort.Slice(keys, func(i, j int) bool { return idle[keys[i]] > idle[keys[j]] })
+	case "allkeys-lfu":
+		freq := make(map[string]int, len(keys))
+		for _, key := range keys {
+			freq[key] = frequency(key)
+		}
+		sort.Slice(keys, func(i, j int) bool { return freq[keys[i]] < freq[keys[j]] })
+	case "allkeys-random":
+		randomShuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+	}
+
+	for _, key := range keys {
+		if used <= limit {
+			break
+		}
+
+		if !s.inTx() {
+			applyMu.Lock()
+		}
+		if deleteKey(key) {
+			s.propagate(aof, request("DEL", key))
+			notify(notifyEvicted, "evicted", key)
+			used -= sizes[key]
+		}
+		if !s.inTx() {
+			applyMu.Unlock()
+		}
+	}
+
+	return used <= limit
+}
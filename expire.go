@@ -0,0 +1,420 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// clock returns the current time for everything that has to do with expiry: setting,
+// checking and reporting the expiry of keys and of hash fields. It is the wall clock
+// moved forward by DEBUG ADVANCE-CLOCK, if at all, so tests can expire keys without
+// sleeping, and it can be replaced altogether to control time completely. The background
+// sweeper still runs on the wall clock, but checks keys against clock.
+var clock = func() time.Time {
+	return time.Now().Add(time.Duration(atomic.LoadInt64(&clockOffset)))
+}
+
+// clockOffset is how far DEBUG ADVANCE-CLOCK moved clock ahead of the wall clock, in
+// nanoseconds. It is only ever accessed atomically.
+var clockOffset int64
+
+// advanceClock moves clock forward by d, or back if d is negative, for every expiry
+// from then on.
+func advanceClock(d time.Duration) {
+	atomic.AddInt64(&clockOffset, int64(d))
+}
+
+// expireMilliseconds returns the Unix time in milliseconds that an expiry of n times unit
+// ends at: n after the current time of clock, or after the Unix epoch if absolute is
+// true. It returns false if that time does not fit in 64 bits, which Redis refuses as an
+// invalid expire time, instead of letting it wrap around to a time in the past.
+func expireMilliseconds(n int64, unit time.Duration, absolute bool) (int64, bool) {
+	factor := int64(unit / time.Millisecond)
+	if n > math.MaxInt64/factor || n < math.MinInt64/factor {
+		return 0, false
+	}
+	ms := n * factor
+
+	if absolute {
+		return ms, true
+	}
+
+	base := unixMilli(clock())
+	if (ms > 0 && base > math.MaxInt64-ms) || (ms < 0 && base < math.MinInt64-ms) {
+		return 0, false
+	}
+
+	return base + ms, true
+}
+
+// unixMilli returns t as a Unix time in milliseconds, rounded down. Unlike UnixNano, it
+// does not overflow for the times centuries ahead that a long expiry can reach.
+func unixMilli(t time.Time) int64 {
+	return t.Unix()*1000 + int64(t.Nanosecond())/int64(time.Millisecond)
+}
+
+// unixMilliUp returns t as a Unix time in milliseconds, rounded up.
+func unixMilliUp(t time.Time) int64 {
+	ms := unixMilli(t)
+	if t.Nanosecond()%int(time.Millisecond) != 0 {
+		ms++
+	}
+
+	return ms
+}
+
+// fromUnixMilli returns the time of the Unix time ms in milliseconds.
+func fromUnixMilli(ms int64) time.Time {
+	return time.Unix(ms/1000, ms%1000*int64(time.Millisecond))
+}
+
+// remainingSeconds returns the time left until at in seconds, rounded to the nearest
+// second like Redis does, or 0 if at has passed. It is computed in milliseconds, so it
+// does not saturate for expiries further away than a time.Duration can hold.
+func remainingSeconds(at time.Time) int {
+	remaining := unixMilli(at) - unixMilli(clock())
+	if remaining < 0 {
+		return 0
+	}
+
+	return int((remaining + 500) / 1000)
+}
+
+// expires is a map of keys to the time they expire at. Keys without an entry never
+// expire. An expired key is deleted lazily when a command names it, or in the background
+// by the expiry sweeper.
+var expires = map[string]time.Time{}
+
+// expiresMu is a read-write mutex that protects access to the expires map. It may be
+// acquired while holding one of the map locks, but not the other way around.
+var expiresMu = sync.RWMutex{}
+
+// expiresAt returns the time key expires at, and false if it has no expiry.
+func expiresAt(key string) (time.Time, bool) {
+	expiresMu.RLock()
+	at, ok := expires[key]
+	expiresMu.RUnlock()
+
+	return at, ok
+}
+
+// isExpired reports whether key has an expiry that has passed. Such a key is logically
+// gone, even if it has not been deleted yet.
+func isExpired(key string) bool {
+	at, ok := expiresAt(key)
+
+	return ok && !clock().Before(at)
+}
+
+// removeExpiry removes the expiry of key, if any. It returns true if the key had one.
+func removeExpiry(key string) bool {
+	expiresMu.Lock()
+	defer expiresMu.Unlock()
+
+	_, ok := expires[key]
+	delete(expires, key)
+
+	return ok
+}
+
+// expireKey deletes key if it has expired, and writes a DEL to the append-only file
+// (AOF) with propagate so the key does not come back when the AOF is replayed. It returns
+// true if the key was deleted. s is the session of the command the key is accessed by, or
+// nil. The caller must not hold any of the map locks, nor the persistMu or applyMu
+// mutexes, unless EXEC holds them for s.
+func expireKey(s *Session, aof *Aof, key string) bool {
+	if !isExpired(key) {
+		return false
+	}
+
+	if !s.inTx() {
+		persistMu.RLock()
+		defer persistMu.RUnlock()
+
+		applyMu.Lock()
+		defer applyMu.Unlock()
+	}
+
+	// the expiry may have been removed or changed in the meantime
+	if !isExpired(key) {
+		return false
+	}
+
+	deleteKey(key)
+	s.propagate(aof, request("DEL", key))
+	notify(notifyExpired, "expired", key)
+
+	return true
+}
+
+// expireArgs lazily deletes the expired keys among the arguments of a command, before
+// the command runs. Arguments are not all keys, but an expired key is logically gone
+// already, so deleting one that is named as a value is harmless.
+func expireArgs(s *Session, aof *Aof, args []Value) {
+	expiresMu.RLock()
+	empty := len(expires) == 0
+	expiresMu.RUnlock()
+
+	if empty {
+		return
+	}
+
+	for _, arg := range args {
+		expireKey(s, aof, arg.bulk)
+	}
+}
+
+// activeExpireSamples is the number of keys with an expiry that the background sweeper
+// samples in every round of a cycle. It is protected by the ConfigMu mutex.
+var activeExpireSamples = 20
+
+// A sweep cycle keeps sampling while more than activeExpireStale percent of the sampled
+// keys were expired, since there are probably many more, but stops after
+// activeExpireTimeLimit so it never holds up the keyspace for long.
+const (
+	activeExpireStale     = 25
+	activeExpireTimeLimit = 25 * time.Millisecond
+)
+
+// startExpireSweeper starts a goroutine that runs an expireCycle in the background every
+// 100 milliseconds, followed by an expireFieldsCycle for the fields of hashes, unless
+// active expiry was disabled with DEBUG SET-ACTIVE-EXPIRE.
+func startExpireSweeper(aof *Aof) {
+	go func() {
+		for {
+			time.Sleep(100 * time.Millisecond)
+
+			ConfigMu.RLock()
+			enabled := activeExpire
+			samples := activeExpireSamples
+			ConfigMu.RUnlock()
+
+			if enabled {
+				expireCycle(aof, samples)
+				expireFieldsCycle(aof, samples)
+			}
+		}
+	}()
+}
+
+// expireCycle deletes expired keys the way Redis does, without scanning every key with an
+// expiry: each round samples up to samples of them and deletes the expired ones, and
+// another round follows only if more than activeExpireStale percent of the sample was
+// expired. The keys left over are deleted by later cycles, or lazily when accessed.
+// The sample is taken by ranging over the expires map, which starts at a random position
+// in Go, so every key eventually gets sampled.
+func expireCycle(aof *Aof, samples int) {
+	start := time.Now()
+
+	for {
+		now := clock()
+		sampled := 0
+		expired := []string{}
+
+		expiresMu.RLock()
+		for key, at := range expires {
+			if sampled == samples {
+				break
+			}
+			sampled++
+
+			if !now.Before(at) {
+				expired = append(expired, key)
+			}
+		}
+		expiresMu.RUnlock()
+
+		for _, key := range expired {
+			expireKey(nil, aof, key)
+		}
+
+		if sampled == 0 || len(expired)*100 <= sampled*activeExpireStale || time.Since(start) > activeExpireTimeLimit {
+			return
+		}
+	}
+}
+
+// expire is a command handler that sets a timeout on a key, after which it is deleted.
+// It takes the key, the timeout in seconds, and an optional condition:
+// EXPIRE key seconds [NX | XX | GT | LT].
+// - NX: the timeout is only set if the key has no expiry.
+// - XX: the timeout is only set if the key already has an expiry.
+// - GT: the timeout is only set if it is later than the current one.
+// - LT: the timeout is only set if it is earlier than the current one.
+// A key without an expiry counts as having an infinite timeout for GT and LT.
+// If the timeout is not an integer, is so large that the time it ends at does not fit in
+// 64 bits of milliseconds, or incompatible conditions are given, it returns an error. A
+// timeout that is not positive deletes the key right away.
+// It returns 1 if the timeout was set, or 0 if the key does not exist or the condition
+// was not met.
+func expire(args []Value) Value {
+	if len(args) < 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'expire' command"}
+	}
+
+	seconds, err := strconv.ParseInt(args[1].bulk, 10, 64)
+	if err != nil {
+		return Value{typ: "error", str: "ERR value is not an integer or out of range"}
+	}
+
+	ms, ok := expireMilliseconds(seconds, time.Second, false)
+	if !ok {
+		return Value{typ: "error", str: "ERR invalid expire time in 'expire' command"}
+	}
+
+	return expireAt(args[0].bulk, fromUnixMilli(ms), args[2:])
+}
+
+// pexpireat is a command handler that sets the time a key is deleted at, as a Unix time
+// in milliseconds: PEXPIREAT key unix-time-milliseconds [NX | XX | GT | LT].
+// EXPIRE is written to the append-only file (AOF) as PEXPIREAT, so the expiry does not
+// move when the file is replayed. The conditions are the same as for EXPIRE.
+// If the time is not an integer, or incompatible conditions are given, it returns an
+// error. A time that has already passed deletes the key right away.
+// It returns 1 if the time was set, or 0 if the key does not exist or the condition
+// was not met.
+func pexpireat(args []Value) Value {
+	if len(args) < 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'pexpireat' command"}
+	}
+
+	ms, err := strconv.ParseInt(args[1].bulk, 10, 64)
+	if err != nil {
+		return Value{typ: "error", str: "ERR value is not an integer or out of range"}
+	}
+
+	return expireAt(args[0].bulk, fromUnixMilli(ms), args[2:])
+}
+
+// expireAt implements EXPIRE and PEXPIREAT, setting the expiry of key to at unless one
+// of the NX, XX, GT or LT conditions in options is not met.
+func expireAt(key string, at time.Time, options []Value) Value {
+	var nx, xx, gt, lt bool
+	for _, arg := range options {
+		switch strings.ToUpper(arg.bulk) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "GT":
+			gt = true
+		case "LT":
+			lt = true
+		default:
+			return Value{typ: "error", str: "ERR Unsupported option " + arg.bulk}
+		}
+	}
+
+	if nx && (xx || gt || lt) {
+		return Value{typ: "error", str: "ERR NX and XX, GT or LT options at the same time are not compatible"}
+	}
+	if gt && lt {
+		return Value{typ: "error", str: "ERR GT and LT options at the same time are not compatible"}
+	}
+
+	if keyType(key) == "none" {
+		return Value{typ: "integer", num: 0}
+	}
+
+	expiresMu.Lock()
+	current, ok := expires[key]
+	switch {
+	case nx && ok, xx && !ok, gt && (!ok || !at.After(current)), lt && ok && !at.Before(current):
+		expiresMu.Unlock()
+		return Value{typ: "integer", num: 0}
+	}
+	expires[key] = at
+	expiresMu.Unlock()
+
+	if !at.After(clock()) {
+		deleteKey(key)
+	}
+
+	return Value{typ: "integer", num: 1}
+}
+
+// ttl is a command handler that returns the remaining time to live of a key in seconds.
+// It takes one argument: the key.
+// If the number of arguments is not exactly 1, it returns an error.
+// It returns -2 if the key does not exist, and -1 if it exists but has no expiry.
+func ttl(args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'ttl' command"}
+	}
+
+	key := args[0].bulk
+
+	if keyType(key) == "none" {
+		return Value{typ: "integer", num: -2}
+	}
+
+	at, ok := expiresAt(key)
+	if !ok {
+		return Value{typ: "integer", num: -1}
+	}
+
+	return Value{typ: "integer", num: remainingSeconds(at)}
+}
+
+// persist is a command handler that removes the expiry of a key, so it never expires.
+// It takes one argument: the key.
+// If the number of arguments is not exactly 1, it returns an error.
+// It returns 1 if the expiry was removed, or 0 if the key does not exist or has no
+// expiry.
+func persist(args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'persist' command"}
+	}
+
+	key := args[0].bulk
+
+	if keyType(key) == "none" || !removeExpiry(key) {
+		return Value{typ: "integer", num: 0}
+	}
+
+	return Value{typ: "integer", num: 1}
+}
+
+// absoluteCommands maps the commands that take a timeout in seconds to the commands that
+// take the Unix time in milliseconds it ends at instead, with the same other arguments.
+var absoluteCommands = map[string]string{
+	"EXPIRE":  "PEXPIREAT",
+	"HEXPIRE": "HPEXPIREAT",
+}
+
+// absoluteExpiry returns the request to write to the append-only file (AOF) for value.
+// Like Redis does, EXPIRE is rewritten as PEXPIREAT with the time the key expires at, so
+// the expiry does not move to later when the file is replayed after a restart, and
+// HEXPIRE as HPEXPIREAT for fields of hashes. Other requests, and EXPIRE or HEXPIRE with
+// an invalid timeout, are returned as is. PERSIST needs no
+// rewriting, since it does not depend on the time it runs at. The field expiries of HGETEX
+// are rewritten by hgetexAbsolute.
+func absoluteExpiry(value Value) Value {
+	if strings.ToUpper(value.array[0].bulk) == "HGETEX" {
+		return hgetexAbsolute(value)
+	}
+
+	absolute, ok := absoluteCommands[strings.ToUpper(value.array[0].bulk)]
+	if !ok || len(value.array) < 3 {
+		return value
+	}
+
+	seconds, err := strconv.ParseInt(value.array[2].bulk, 10, 64)
+	if err != nil {
+		return value
+	}
+
+	ms, ok := expireMilliseconds(seconds, time.Second, false)
+	if !ok {
+		return value
+	}
+
+	array := []Value{{typ: "bulk", bulk: absolute}, value.array[1], {typ: "bulk", bulk: strconv.FormatInt(ms, 10)}}
+	array = append(array, value.array[3:]...)
+
+	return Value{typ: "array", array: array}
+}
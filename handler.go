@@ -1,65 +1,256 @@
 package main
 
 import (
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 )
 
+// ServerName and ServerVersion identify the server in replies such as LOLWUT.
+const (
+	ServerName    = "gredis"
+	ServerVersion = "0.1.0"
+)
+
 // Handlers is a map of command names to their corresponding handler functions.
 // The handlers are used to process different types of commands that can be
 // executed by the application.
 var Handlers = map[string]func([]Value) Value{
-	"PING":    ping,
 	"SET":     set,
 	"GET":     get,
+	"GETDEL":  getdel,
+	"MSETNX":  msetnx,
 	"HSET":    hset,
 	"HGET":    hget,
 	"HGETALL": hgetall,
+	"HKEYS":   hkeys,
+	"HVALS":   hvals,
+	"HSCAN":   hscan,
+
+	"HRANDFIELD": hrandfield,
+	"HGETDEL":    hgetdel,
+	"HGETEX":     hgetex,
+	"HEXPIRE":    hexpire,
+	"HPEXPIREAT": hpexpireat,
+	"HTTL":       httl,
+
+	"LPUSH":   lpush,
+	"RPUSH":   rpush,
+	"LPOP":    lpop,
+	"RPOP":    rpop,
+	"LLEN":    llen,
+	"LRANGE":  lrange,
+	"LTRIM":   ltrim,
+	"LINDEX":  lindex,
+	"LOLWUT":  lolwut,
+	"INFO":    info,
+	"CONFIG":  config,
+	"SAVE":    save,
+	"FSYNC":   fsync,
+	"OBJECT":  object,
+	"MEMORY":  memory,
+	"DEL":     del,
+	"UNLINK":  unlink,
+	"SORT":    sortCmd,
+	"PUBLISH": publish,
+	"KEYS":    keys,
+	"SCAN":    scan,
+
+	"SETBIT": setbit,
+	"GETBIT": getbit,
+
+	"BITCOUNT": bitcount,
+	"BITOP":    bitop,
+
+	"GETRANGE": getrange,
+	"SUBSTR":   getrange,
+	"SETRANGE": setrange,
+	"APPEND":   appendValue,
+	"LCS":      lcs,
+
+	"EXPIRE":    expire,
+	"PEXPIREAT": pexpireat,
+	"TTL":       ttl,
+	"PERSIST":   persist,
+
+	"FLUSHDB":  flushdb,
+	"FLUSHALL": flushdb,
+
+	"SADD":       sadd,
+	"SREM":       srem,
+	"SMEMBERS":   smembers,
+	"SISMEMBER":  sismember,
+	"SCARD":      scard,
+	"SINTER":     sinter,
+	"SINTERCARD": sintercard,
+
+	"SINTERSTORE": sinterstore,
+	"SUNIONSTORE": sunionstore,
+	"SDIFFSTORE":  sdiffstore,
+
+	"ZADD":          zadd,
+	"ZINCRBY":       zincrby,
+	"ZRANGEBYSCORE": zrangebyscore,
+	"ZRANGEBYLEX":   zrangebylex,
+
+	"ZREM":            zrem,
+	"ZREMRANGEBYRANK": zremrangebyrank,
+}
+
+// WriteCommands is the set of command names that modify the stored data. Requests for
+// these commands are appended to the append-only file (AOF) so they can be replayed
+// on startup. Commands that return a value as well as changing it, such as GETDEL or
+// HGETEX, belong here too, while commands that only read, such as GET, must not be
+// listed, or every call would grow the AOF for nothing.
+var WriteCommands = map[string]bool{
+	"DEL":      true,
+	"UNLINK":   true,
+	"EXPIRE":   true,
+	"PERSIST":  true,
+	"FLUSHDB":  true,
+	"FLUSHALL": true,
+	"SET":      true,
+	"SETBIT":   true,
+	"SETRANGE": true,
+	"APPEND":   true,
+	"BITOP":    true,
+	"GETDEL":   true,
+	"HSET":     true,
+	"LPUSH":    true,
+	"RPUSH":    true,
+	"LPOP":     true,
+	"RPOP":     true,
+	"LTRIM":    true,
+	"SADD":     true,
+	"SREM":     true,
+	"ZADD":     true,
+	"ZINCRBY":  true,
+
+	"ZREM":            true,
+	"ZREMRANGEBYRANK": true,
+
+	"SINTERSTORE": true,
+	"SUNIONSTORE": true,
+	"SDIFFSTORE":  true,
+
+	"PEXPIREAT": true,
+
+	"HGETDEL":    true,
+	"HGETEX":     true,
+	"HEXPIRE":    true,
+	"HPEXPIREAT": true,
+
+	"MSETNX": true,
 }
 
 // ping is a command handler that responds with "PONG" if no arguments are provided,
 // or echoes the first argument back as a string.
-func ping(args []Value) Value {
+// While the session is in subscribe mode, it responds with a ["pong", message] array
+// instead, where message is the first argument or an empty string, like Redis does,
+// since clients read every reply in that mode as a pub/sub message.
+func ping(s *Session, args []Value) Value {
+	message := ""
+	if len(args) > 0 {
+		message = args[0].bulk
+	}
+
+	if s.inSubscribeMode() {
+		return Value{typ: "array", array: []Value{
+			{typ: "bulk", bulk: "pong"},
+			{typ: "bulk", bulk: message},
+		}}
+	}
+
 	if len(args) == 0 {
 		return Value{typ: "string", str: "PONG"}
 	}
 
-	return Value{typ: "string", str: args[0].bulk}
+	return Value{typ: "string", str: message}
+}
+
+// lolwut is a command handler that returns a banner with the server name, the server
+// version, and the Go runtime version as a bulk string. Any arguments are ignored,
+// since clients sometimes send LOLWUT VERSION <n> to probe the server.
+func lolwut(args []Value) Value {
+	banner := ServerName + " ver. " + ServerVersion + " (" + runtime.Version() + ")\n"
+
+	return Value{typ: "bulk", bulk: banner}
 }
 
 // SETs is a map that stores key-value pairs for the "SET" command.
-var SETs = map[string]string{}
+// The values are kept as byte slices, so APPEND, SETRANGE and SETBIT can change them in
+// place instead of copying the whole string. They are converted to strings only when
+// they are replied to a client or written out.
+//
+// NOTE: Because a value can change in place, it must not be used after the SETsMu lock
+// is released. Handlers copy what they reply while they still hold the lock.
+var SETs = map[string][]byte{}
 
 // SETsMu is a read-write mutex that protects access to the SETs map.
 var SETsMu = sync.RWMutex{}
 
 // set is a command handler that sets a key-value pair in the SETs map.
-// It takes two arguments: the key and the value to be set.
-// If the number of arguments is not exactly 2, it returns an error.
+// It takes two arguments, the key and the value to be set, and optional flags:
+// SET key value [KEEPTTL].
+// Like in Redis, setting a key removes any expiry it had, unless KEEPTTL is given, and a
+// value of another type stored at the key is replaced, so no key ever holds two types.
+// If fewer than 2 arguments are given, or a flag is unknown, it returns an error.
 // The function acquires a write lock on the SETsMu mutex before modifying the SETs map,
 // and releases the lock after the operation is complete.
+// The access is recorded for OBJECT IDLETIME.
 // It returns a Value with a "string" type and the value "OK" upon successful completion.
 func set(args []Value) Value {
-	if len(args) != 2 {
+	if len(args) < 2 {
 		return Value{typ: "error", str: "ERR wrong number of arguments for 'set' command"}
 	}
 
 	key := args[0].bulk
 	value := args[1].bulk
 
+	keepTTL := false
+	for _, arg := range args[2:] {
+		switch strings.ToUpper(arg.bulk) {
+		case "KEEPTTL":
+			keepTTL = true
+		default:
+			return Value{typ: "error", str: "ERR syntax error"}
+		}
+	}
+
+	if t := keyType(key); t != "string" && t != "none" {
+		at, hasExpiry := expiresAt(key)
+		deleteKey(key)
+		if keepTTL && hasExpiry {
+			expiresMu.Lock()
+			expires[key] = at
+			expiresMu.Unlock()
+		}
+	}
+
 	SETsMu.Lock()
-	SETs[key] = value
+	SETs[key] = []byte(value)
 	SETsMu.Unlock()
 
+	if !keepTTL {
+		removeExpiry(key)
+	}
+
+	touch(key)
+
 	return Value{typ: "string", str: "OK"}
 }
 
 // get is a command handler that retrieves the value associated with a given key
 // from the SETs map. It takes one argument: the key to retrieve.
-// If the number of arguments is not exactly 1, it returns an error.
+// If the number of arguments is not exactly 1, or the key holds a value of another type,
+// it returns an error.
 // The function acquires a read lock on the SETsMu mutex before accessing the SETs map,
 // and releases the lock after the operation is complete.
 // If the key is not found in the SETs map, it returns a Value with a "null" type.
-// Otherwise, it returns a Value with a "bulk" type containing the value associated with the key.
+// Otherwise, it returns a Value with a "bulk" type containing the value associated with the key,
+// and the access is recorded for OBJECT IDLETIME.
 func get(args []Value) Value {
 	if len(args) != 1 {
 		return Value{typ: "error", str: "ERR wrong number of arguments for 'get' command"}
@@ -67,30 +258,294 @@ func get(args []Value) Value {
 
 	key := args[0].bulk
 
+	if t := keyType(key); t != "string" && t != "none" {
+		return Value{typ: "error", str: "WRONGTYPE Operation against a key holding the wrong kind of value"}
+	}
+
 	SETsMu.RLock()
 	value, ok := SETs[key]
+	reply := string(value)
 	SETsMu.RUnlock()
 
 	if !ok {
 		return Value{typ: "null"}
 	}
 
-	return Value{typ: "bulk", bulk: value}
+	touch(key)
+
+	return Value{typ: "bulk", bulk: reply}
+}
+
+// getdel is a command handler that retrieves the value associated with a given key
+// from the SETs map and deletes the key. It takes one argument: the key.
+// If the number of arguments is not exactly 1, or the key holds a value of another type,
+// it returns an error.
+// The function holds a write lock on the SETsMu mutex for both the read and the delete,
+// so no other command can observe or change the value in between.
+// If the key is not found in the SETs map, it returns a Value with a "null" type.
+// Otherwise, it returns a Value with a "bulk" type containing the deleted value.
+func getdel(args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'getdel' command"}
+	}
+
+	key := args[0].bulk
+
+	if t := keyType(key); t != "string" && t != "none" {
+		return Value{typ: "error", str: "WRONGTYPE Operation against a key holding the wrong kind of value"}
+	}
+
+	SETsMu.Lock()
+	value, ok := SETs[key]
+	delete(SETs, key)
+	SETsMu.Unlock()
+
+	if !ok {
+		return Value{typ: "null"}
+	}
+
+	forget(key)
+
+	return Value{typ: "bulk", bulk: string(value)}
+}
+
+// msetnx is a command handler that sets several keys to string values, only if none of
+// the keys exist: MSETNX key value [key value ...].
+// Keys holding a value of any type count as existing. If any of them exists, nothing is
+// set and it returns 0, otherwise every key is set and it returns 1.
+// The keys of other types are looked up first, which is safe since write commands are
+// applied one at a time under the applyMu mutex, and the string keys are then checked
+// and set under a single write lock on the SETsMu mutex, so no other command sees only
+// some of them set.
+// A "set" keyspace event is published for every key that was set.
+// If the number of arguments is not a positive even number, it returns an error.
+func msetnx(args []Value) Value {
+	if len(args) == 0 || len(args)%2 != 0 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'msetnx' command"}
+	}
+
+	for i := 0; i < len(args); i += 2 {
+		if keyType(args[i].bulk) != "none" {
+			return Value{typ: "integer", num: 0}
+		}
+	}
+
+	SETsMu.Lock()
+	for i := 0; i < len(args); i += 2 {
+		if _, ok := SETs[args[i].bulk]; ok {
+			SETsMu.Unlock()
+			return Value{typ: "integer", num: 0}
+		}
+	}
+	for i := 0; i < len(args); i += 2 {
+		SETs[args[i].bulk] = []byte(args[i+1].bulk)
+	}
+	SETsMu.Unlock()
+
+	for i := 0; i < len(args); i += 2 {
+		touch(args[i].bulk)
+		notify(notifyString, "set", args[i].bulk)
+	}
+
+	return Value{typ: "integer", num: 1}
+}
+
+// getrange is a command handler that returns a substring of the string stored at a key.
+// It takes three arguments: the key, and the inclusive start and end byte offsets.
+// Negative offsets count back from the end of the string, so -1 is the last byte, and
+// offsets past either end are clamped, like in Redis.
+// If the number of arguments is not exactly 3, an offset is not an integer, or the key
+// holds a value of another type, it returns an error.
+// The function acquires a read lock on the SETsMu mutex before accessing the SETs map,
+// and releases the lock after the operation is complete.
+// A missing key, or an empty range, returns an empty string.
+// It is also registered as SUBSTR, its name in old versions of Redis.
+func getrange(args []Value) Value {
+	if len(args) != 3 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'getrange' command"}
+	}
+
+	key := args[0].bulk
+
+	start, err := strconv.Atoi(args[1].bulk)
+	if err != nil {
+		return Value{typ: "error", str: "ERR value is not an integer or out of range"}
+	}
+	end, err := strconv.Atoi(args[2].bulk)
+	if err != nil {
+		return Value{typ: "error", str: "ERR value is not an integer or out of range"}
+	}
+
+	if t := keyType(key); t != "string" && t != "none" {
+		return Value{typ: "error", str: "WRONGTYPE Operation against a key holding the wrong kind of value"}
+	}
+
+	SETsMu.RLock()
+	defer SETsMu.RUnlock()
+
+	value, ok := SETs[key]
+	if ok {
+		touch(key)
+	}
+
+	length := len(value)
+	if start < 0 && end < 0 && start > end {
+		return Value{typ: "bulk", bulk: ""}
+	}
+	if start < 0 {
+		start += length
+	}
+	if end < 0 {
+		end += length
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end < 0 {
+		end = 0
+	}
+	if end >= length {
+		end = length - 1
+	}
+	if start > end || length == 0 {
+		return Value{typ: "bulk", bulk: ""}
+	}
+
+	return Value{typ: "bulk", bulk: string(value[start : end+1])}
+}
+
+// appendValue is a command handler that appends a value to the string stored at a key.
+// It takes two arguments: the key and the value to append.
+// If the key does not exist, it is created with the value. Unlike SET, an existing
+// expiry is kept.
+// If the number of arguments is not exactly 2, the key holds a value of another type,
+// or the string would grow past proto-max-bulk-len, it returns an error.
+// The function acquires a write lock on the SETsMu mutex before modifying the SETs map,
+// and releases the lock after the operation is complete. The string is grown in place,
+// so appending to it repeatedly does not copy it every time.
+// It returns the length of the string after the append as an integer.
+func appendValue(args []Value) Value {
+	if len(args) != 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'append' command"}
+	}
+
+	key := args[0].bulk
+	suffix := args[1].bulk
+
+	if t := keyType(key); t != "string" && t != "none" {
+		return Value{typ: "error", str: "WRONGTYPE Operation against a key holding the wrong kind of value"}
+	}
+
+	limit := maxBulkLen()
+
+	SETsMu.Lock()
+	defer SETsMu.Unlock()
+
+	value := SETs[key]
+	if int64(len(value)+len(suffix)) > limit {
+		return Value{typ: "error", str: "ERR string exceeds maximum allowed size (proto-max-bulk-len)"}
+	}
+
+	value = append(value, suffix...)
+	SETs[key] = value
+
+	touch(key)
+
+	return Value{typ: "integer", num: len(value)}
+}
+
+// setrange is a command handler that overwrites part of the string stored at a key,
+// starting at a byte offset: SETRANGE key offset value.
+// If the offset is past the end of the string, the string is padded with zero bytes up
+// to the offset first. A missing key is treated as an empty string, and is only created
+// if the value is not empty. An existing expiry is kept.
+// If the number of arguments is not exactly 3, the offset is not an integer between 0
+// and proto-max-bulk-len, the key holds a value of another type, or the string would
+// grow past proto-max-bulk-len, it returns an error.
+// The function acquires a write lock on the SETsMu mutex before modifying the SETs map,
+// and releases the lock after the operation is complete. The string is changed in place,
+// so overwriting part of it does not copy the rest.
+// It returns the length of the string after the change as an integer.
+func setrange(args []Value) Value {
+	if len(args) != 3 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'setrange' command"}
+	}
+
+	key := args[0].bulk
+	patch := args[2].bulk
+
+	offset, err := strconv.Atoi(args[1].bulk)
+	if err != nil {
+		return Value{typ: "error", str: "ERR value is not an integer or out of range"}
+	}
+	limit := maxBulkLen()
+	if offset < 0 || int64(offset) > limit {
+		return Value{typ: "error", str: "ERR offset is out of range"}
+	}
+
+	if t := keyType(key); t != "string" && t != "none" {
+		return Value{typ: "error", str: "WRONGTYPE Operation against a key holding the wrong kind of value"}
+	}
+
+	SETsMu.Lock()
+	defer SETsMu.Unlock()
+
+	value := SETs[key]
+	if patch == "" {
+		// nothing is written, so a missing key is not created
+		return Value{typ: "integer", num: len(value)}
+	}
+	if int64(offset+len(patch)) > limit {
+		return Value{typ: "error", str: "ERR string exceeds maximum allowed size (proto-max-bulk-len)"}
+	}
+
+	if end := offset + len(patch); end > len(value) {
+		value = append(value, make([]byte, end-len(value))...)
+	}
+	copy(value[offset:], patch)
+	SETs[key] = value
+
+	touch(key)
+
+	return Value{typ: "integer", num: len(value)}
 }
 
 // HSETs is a map that stores hash sets. The outer map maps hash names to inner maps,
 // and the inner maps map keys to values within each hash set.
 var HSETs = map[string]map[string]string{}
 
-// HSETsMu is a read-write mutex that protects access to the HSETs map.
+// HSETsOrder is a map of hash set names to their fields in the order they were first
+// set, so HGETALL, HKEYS and HVALS return them in a stable order like Redis does. It is
+// kept in step with HSETs, and protected by the HSETsMu mutex as well.
+//
+// NOTE: The slices share the field strings with the maps, so the order only costs a
+// string header (16 bytes on 64-bit platforms) per field, on top of the map entry.
+var HSETsOrder = map[string][]string{}
+
+// HSETsMu is a read-write mutex that protects access to the HSETs and HSETsOrder maps.
 var HSETsMu = sync.RWMutex{}
 
+// orderedFields returns the fields of the hash set in insertion order, with their values.
+// The fields are a copy of the order, so the caller can use them after releasing the lock.
+// The caller must hold a lock on the HSETsMu mutex.
+func orderedFields(hash string) (fields []string, values []string) {
+	fields = append([]string(nil), HSETsOrder[hash]...)
+	values = make([]string, 0, len(fields))
+	for _, field := range fields {
+		values = append(values, HSETs[hash][field])
+	}
+
+	return fields, values
+}
+
 // hset is a command handler that adds or updates a key-value pair in a hash set.
 // It takes three arguments: the name of the hash set, the key, and the value.
-// If the number of arguments is not exactly 3, it returns an error.
+// If the number of arguments is not exactly 3, or the key holds a value of another type,
+// it returns an error.
 // The function acquires a write lock on the HSETsMu mutex before modifying the HSETs map,
 // and releases the lock after the operation is complete.
 // If the hash set does not exist, it creates a new one before adding the key-value pair.
+// A new key is appended to the insertion order of the hash set in HSETsOrder.
 // It returns a Value with a "string" type and the value "OK" upon successful completion.
 func hset(args []Value) Value {
 	if len(args) != 3 {
@@ -101,19 +556,30 @@ func hset(args []Value) Value {
 	key := args[1].bulk
 	value := args[2].bulk
 
+	if t := keyType(hash); t != "hash" && t != "none" {
+		return Value{typ: "error", str: "WRONGTYPE Operation against a key holding the wrong kind of value"}
+	}
+
 	HSETsMu.Lock()
 	if _, ok := HSETs[hash]; !ok {
 		HSETs[hash] = map[string]string{}
 	}
+	if _, ok := HSETs[hash][key]; !ok {
+		HSETsOrder[hash] = append(HSETsOrder[hash], key)
+	}
 	HSETs[hash][key] = value
+	removeFieldExpiry(hash, key)
 	HSETsMu.Unlock()
 
+	touch(hash)
+
 	return Value{typ: "string", str: "OK"}
 }
 
 // hget is a command handler that retrieves the value associated with a key in a hash set.
 // It takes two arguments: the name of the hash set and the key.
-// If the number of arguments is not exactly 2, it returns an error.
+// If the number of arguments is not exactly 2, or the key holds a value of another type,
+// it returns an error.
 // The function acquires a read lock on the HSETsMu mutex before accessing the HSETs map,
 // and releases the lock after the operation is complete.
 // If the key does not exist in the hash set, it returns a null value.
@@ -126,6 +592,10 @@ func hget(args []Value) Value {
 	hash := args[0].bulk
 	key := args[1].bulk
 
+	if t := keyType(hash); t != "hash" && t != "none" {
+		return Value{typ: "error", str: "WRONGTYPE Operation against a key holding the wrong kind of value"}
+	}
+
 	HSETsMu.RLock()
 	value, ok := HSETs[hash][key]
 	HSETsMu.RUnlock()
@@ -134,16 +604,20 @@ func hget(args []Value) Value {
 		return Value{typ: "null"}
 	}
 
+	touch(hash)
+
 	return Value{typ: "bulk", bulk: value}
 }
 
 // hgetall is a command handler that retrieves all key-value pairs in a hash set.
 // It takes one argument: the name of the hash set.
-// If the number of arguments is not exactly 1, it returns an error.
+// If the number of arguments is not exactly 1, or the key holds a value of another type,
+// it returns an error.
 // The function acquires a read lock on the HSETsMu mutex before accessing the HSETs map,
 // and releases the lock after the operation is complete.
 // If the hash set does not exist, it returns a null value.
-// Otherwise, it returns an array of all the key-value pairs in the hash set.
+// Otherwise, it returns an array of all the key-value pairs in the hash set, in the order
+// the keys were first set.
 func hgetall(args []Value) Value {
 	if len(args) != 1 {
 		return Value{typ: "error", str: "ERR wrong number of arguments for 'hgetall' command"}
@@ -151,19 +625,262 @@ func hgetall(args []Value) Value {
 
 	hash := args[0].bulk
 
+	if t := keyType(hash); t != "hash" && t != "none" {
+		return Value{typ: "error", str: "WRONGTYPE Operation against a key holding the wrong kind of value"}
+	}
+
 	HSETsMu.RLock()
-	value, ok := HSETs[hash]
+	_, ok := HSETs[hash]
+	fields, fieldValues := orderedFields(hash)
 	HSETsMu.RUnlock()
 
 	if !ok {
 		return Value{typ: "null"}
 	}
 
+	touch(hash)
+
+	values := []Value{}
+	for i, field := range fields {
+		values = append(values, Value{typ: "bulk", bulk: field})
+		values = append(values, Value{typ: "bulk", bulk: fieldValues[i]})
+	}
+
+	return Value{typ: "array", array: values}
+}
+
+// hkeys is a command handler that returns the keys of a hash set, in the order they were
+// first set. It takes one argument: the name of the hash set.
+// If the number of arguments is not exactly 1, or the key holds a value of another type,
+// it returns an error.
+// The function acquires a read lock on the HSETsMu mutex before accessing the HSETs map,
+// and releases the lock after the operation is complete.
+// If the hash set does not exist, it returns an empty array.
+func hkeys(args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'hkeys' command"}
+	}
+
+	hash := args[0].bulk
+
+	if t := keyType(hash); t != "hash" && t != "none" {
+		return Value{typ: "error", str: "WRONGTYPE Operation against a key holding the wrong kind of value"}
+	}
+
+	HSETsMu.RLock()
+	fields, _ := orderedFields(hash)
+	HSETsMu.RUnlock()
+
+	if len(fields) > 0 {
+		touch(hash)
+	}
+
+	values := make([]Value, 0, len(fields))
+	for _, field := range fields {
+		values = append(values, Value{typ: "bulk", bulk: field})
+	}
+
+	return Value{typ: "array", array: values}
+}
+
+// hvals is a command handler that returns the values of a hash set, in the order their
+// keys were first set. It takes one argument: the name of the hash set.
+// If the number of arguments is not exactly 1, or the key holds a value of another type,
+// it returns an error.
+// The function acquires a read lock on the HSETsMu mutex before accessing the HSETs map,
+// and releases the lock after the operation is complete.
+// If the hash set does not exist, it returns an empty array.
+func hvals(args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'hvals' command"}
+	}
+
+	hash := args[0].bulk
+
+	if t := keyType(hash); t != "hash" && t != "none" {
+		return Value{typ: "error", str: "WRONGTYPE Operation against a key holding the wrong kind of value"}
+	}
+
+	HSETsMu.RLock()
+	_, fieldValues := orderedFields(hash)
+	HSETsMu.RUnlock()
+
+	if len(fieldValues) > 0 {
+		touch(hash)
+	}
+
+	values := make([]Value, 0, len(fieldValues))
+	for _, value := range fieldValues {
+		values = append(values, Value{typ: "bulk", bulk: value})
+	}
+
+	return Value{typ: "array", array: values}
+}
+
+// hrandfieldMaxRepeats is the largest number of fields, which may repeat, that HRANDFIELD
+// returns for a negative count. Redis only refuses counts below -LONG_MAX/2, but the reply
+// is built in memory here, so a huge count would exhaust it.
+const hrandfieldMaxRepeats = 1 << 20
+
+// hrandfield is a command handler that returns random fields from a hash set:
+// HRANDFIELD key [count [WITHVALUES]].
+// Without a count, it returns a single random field, or a null value if the hash set does
+// not exist. With a positive count, it returns an array of up to count distinct fields;
+// with a negative count, it returns exactly -count fields, which may repeat. With
+// WITHVALUES, the value of each field follows it in the array. If the hash set does not
+// exist, an empty array is returned when a count is given.
+// If the count is not an integer or is below -hrandfieldMaxRepeats, an option is invalid,
+// or the key holds a value of another type, it returns an error.
+// The function acquires a read lock on the HSETsMu mutex while picking the fields,
+// and releases the lock after the operation is complete.
+func hrandfield(args []Value) Value {
+	if len(args) < 1 || len(args) > 3 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'hrandfield' command"}
+	}
+
+	hash := args[0].bulk
+
+	count := 1
+	if len(args) > 1 {
+		n, err := strconv.Atoi(args[1].bulk)
+		if err != nil {
+			return Value{typ: "error", str: "ERR value is not an integer or out of range"}
+		}
+		// a negative count builds a reply of -count fields whatever the size of the hash
+		if n < -hrandfieldMaxRepeats {
+			return Value{typ: "error", str: "ERR value is out of range"}
+		}
+		count = n
+	}
+
+	withValues := false
+	if len(args) == 3 {
+		if strings.ToUpper(args[2].bulk) != "WITHVALUES" {
+			return Value{typ: "error", str: "ERR syntax error"}
+		}
+		withValues = true
+	}
+
+	if t := keyType(hash); t != "hash" && t != "none" {
+		return Value{typ: "error", str: "WRONGTYPE Operation against a key holding the wrong kind of value"}
+	}
+
+	HSETsMu.RLock()
+	defer HSETsMu.RUnlock()
+
+	// the fields are copied in insertion order rather than ranged over the map, whose
+	// order is random, so the picks only depend on the seed of rng
+	fields := append([]string{}, HSETsOrder[hash]...)
+
+	if len(args) == 1 {
+		if len(fields) == 0 {
+			return Value{typ: "null"}
+		}
+
+		touch(hash)
+
+		return Value{typ: "bulk", bulk: fields[randomIntn(len(fields))]}
+	}
+
+	picked := []string{}
+	if count < 0 {
+		// a negative count allows repeats, so every pick is independent
+		for i := 0; i < -count && len(fields) > 0; i++ {
+			picked = append(picked, fields[randomIntn(len(fields))])
+		}
+	} else {
+		randomShuffle(len(fields), func(i, j int) { fields[i], fields[j] = fields[j], fields[i] })
+		if count < len(fields) {
+			fields = fields[:count]
+		}
+		picked = fields
+	}
+
+	if len(picked) > 0 {
+		touch(hash)
+	}
+
 	values := []Value{}
-	for k, v := range value {
-		values = append(values, Value{typ: "bulk", bulk: k})
-		values = append(values, Value{typ: "bulk", bulk: v})
+	for _, field := range picked {
+		values = append(values, Value{typ: "bulk", bulk: field})
+		if withValues {
+			values = append(values, Value{typ: "bulk", bulk: HSETs[hash][field]})
+		}
 	}
 
 	return Value{typ: "array", array: values}
-}
\ No newline at end of file
+}
+
+// hscan is a command handler that iterates over the fields of a hash set a page at a
+// time: HSCAN key cursor [MATCH pattern] [COUNT count].
+// The cursor is the position in the sorted list of fields, and works like the SCAN cursor.
+// The function acquires a read lock on the HSETsMu mutex while collecting the fields,
+// and releases the lock after the operation is complete.
+// If the cursor or an option is invalid, or the key holds a value of another type, it
+// returns an error.
+// It returns an array of the next cursor and an array of the matching fields and their values.
+func hscan(args []Value) Value {
+	if len(args) < 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'hscan' command"}
+	}
+
+	hash := args[0].bulk
+	cursor, err := strconv.Atoi(args[1].bulk)
+	if err != nil || cursor < 0 {
+		return Value{typ: "error", str: "ERR invalid cursor"}
+	}
+
+	pattern, count, errValue, ok := scanOptions(args[2:])
+	if !ok {
+		return errValue
+	}
+
+	if t := keyType(hash); t != "hash" && t != "none" {
+		return Value{typ: "error", str: "WRONGTYPE Operation against a key holding the wrong kind of value"}
+	}
+
+	HSETsMu.RLock()
+	fields := make([]string, 0, len(HSETs[hash]))
+	for field := range HSETs[hash] {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	values := []Value{}
+	next := 0
+	for i := cursor; i < len(fields) && i < cursor+count; i++ {
+		if glob(pattern, fields[i]) {
+			values = append(values, Value{typ: "bulk", bulk: fields[i]})
+			values = append(values, Value{typ: "bulk", bulk: HSETs[hash][fields[i]]})
+		}
+		next = i + 1
+	}
+	HSETsMu.RUnlock()
+
+	if next >= len(fields) {
+		next = 0
+	}
+
+	return Value{typ: "array", array: []Value{
+		{typ: "bulk", bulk: strconv.Itoa(next)},
+		{typ: "array", array: values},
+	}}
+}
+
+// helpReply returns the reply of the HELP subcommand of command, like Redis does: an
+// array of bulk strings with a usage line, the given lines describing the subcommands,
+// and the description of HELP itself. Each subcommand is described by a line with its
+// syntax followed by indented lines explaining it.
+func helpReply(command string, lines ...string) Value {
+	values := make([]Value, 0, len(lines)+3)
+	values = append(values, Value{typ: "bulk", bulk: command + " <subcommand> [<arg> [value] [opt] ...]. Subcommands are:"})
+	for _, line := range lines {
+		values = append(values, Value{typ: "bulk", bulk: line})
+	}
+	values = append(values,
+		Value{typ: "bulk", bulk: "HELP"},
+		Value{typ: "bulk", bulk: "    Print this help."},
+	)
+
+	return Value{typ: "array", array: values}
+}
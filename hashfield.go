@@ -0,0 +1,540 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// hashFieldExpires is a map of hash names to the fields of the hash that have an expiry,
+// and the time each of them expires at, set with HGETEX. Like the fields themselves, it
+// is protected by the HSETsMu mutex.
+var hashFieldExpires = map[string]map[string]time.Time{}
+
+// removeFieldExpiry removes the expiry of a field, if any. The caller must hold a write
+// lock on the HSETsMu mutex.
+func removeFieldExpiry(hash, field string) {
+	delete(hashFieldExpires[hash], field)
+	if len(hashFieldExpires[hash]) == 0 {
+		delete(hashFieldExpires, hash)
+	}
+}
+
+// deleteFields removes the given fields from the hash, together with their expiries, and
+// deletes the hash once it has no fields left, in which case it returns true. The caller
+// must hold a write lock on the HSETsMu mutex, and forget the hash if it was deleted.
+func deleteFields(hash string, fields []string) bool {
+	deleted := map[string]bool{}
+	for _, field := range fields {
+		if _, ok := HSETs[hash][field]; ok {
+			delete(HSETs[hash], field)
+			removeFieldExpiry(hash, field)
+			deleted[field] = true
+		}
+	}
+
+	if len(HSETs[hash]) == 0 {
+		delete(HSETs, hash)
+		delete(HSETsOrder, hash)
+		return true
+	}
+
+	// a fresh slice, since a reader may still hold the old one, see orderedFields
+	order := make([]string, 0, len(HSETsOrder[hash]))
+	for _, field := range HSETsOrder[hash] {
+		if !deleted[field] {
+			order = append(order, field)
+		}
+	}
+	HSETsOrder[hash] = order
+
+	return false
+}
+
+// expireFields deletes the fields of the hashes among the arguments of a command that
+// have expired, before the command runs, and writes their deletion to the append-only
+// file (AOF) as an HGETDEL, like expireArgs does for keys. A hash left without fields is
+// deleted, so it no longer holds the key. The caller must not hold any of the map locks,
+// nor the persistMu or applyMu mutexes, unless EXEC holds them for s, see expireKey.
+func expireFields(s *Session, aof *Aof, args []Value) {
+	HSETsMu.RLock()
+	empty := len(hashFieldExpires) == 0
+	HSETsMu.RUnlock()
+
+	if empty {
+		return
+	}
+
+	for _, arg := range args {
+		expireHashFields(s, aof, arg.bulk)
+	}
+}
+
+// expireHashFields deletes the expired fields of the hash, see expireFields.
+func expireHashFields(s *Session, aof *Aof, hash string) {
+	now := clock()
+	expired := func() []string {
+		fields := []string{}
+		for field, at := range hashFieldExpires[hash] {
+			if !now.Before(at) {
+				fields = append(fields, field)
+			}
+		}
+		return fields
+	}
+
+	HSETsMu.RLock()
+	found := len(expired()) > 0
+	HSETsMu.RUnlock()
+
+	if !found {
+		return
+	}
+
+	if !s.inTx() {
+		persistMu.RLock()
+		defer persistMu.RUnlock()
+
+		applyMu.Lock()
+		defer applyMu.Unlock()
+	}
+
+	HSETsMu.Lock()
+	// the fields may have been deleted or changed in the meantime
+	fields := expired()
+	emptied := len(fields) > 0 && deleteFields(hash, fields)
+	HSETsMu.Unlock()
+
+	if len(fields) == 0 {
+		return
+	}
+
+	if emptied {
+		forget(hash)
+	}
+
+	args := append([]string{hash, "FIELDS", strconv.Itoa(len(fields))}, fields...)
+	s.propagate(aof, request("HGETDEL", args...))
+	notify(notifyHash, "hexpired", hash)
+}
+
+// parseFieldList parses the FIELDS numfields field [field ...] arguments that end
+// HGETDEL and HGETEX, and returns the fields. If they are malformed, or the number of
+// fields does not match numfields, it returns false with the error to reply.
+func parseFieldList(args []Value) ([]string, Value, bool) {
+	if len(args) < 2 || strings.ToUpper(args[0].bulk) != "FIELDS" {
+		return nil, Value{typ: "error", str: "ERR syntax error"}, false
+	}
+
+	n, err := strconv.Atoi(args[1].bulk)
+	if err != nil || n <= 0 {
+		return nil, Value{typ: "error", str: "ERR Number of fields must be a positive integer"}, false
+	}
+	if n != len(args)-2 {
+		return nil, Value{typ: "error", str: "ERR The `numfields` parameter must match the number of arguments"}, false
+	}
+
+	fields := make([]string, 0, n)
+	for _, arg := range args[2:] {
+		fields = append(fields, arg.bulk)
+	}
+
+	return fields, Value{}, true
+}
+
+// hgetdel is a command handler that returns the values of fields of a hash and deletes
+// them: HGETDEL key FIELDS numfields field [field ...].
+// It returns an array with the value of every field, in the order they were given, or a
+// null value for the fields that do not exist. The fields are read and deleted while the
+// write lock on the HSETsMu mutex is held, so no other connection sees them in between.
+// If the hash is left without fields, the key is deleted.
+// If the arguments are malformed, or the key holds a value of another type, it returns
+// an error.
+func hgetdel(args []Value) Value {
+	if len(args) < 4 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'hgetdel' command"}
+	}
+
+	hash := args[0].bulk
+
+	fields, errValue, ok := parseFieldList(args[1:])
+	if !ok {
+		return errValue
+	}
+
+	if t := keyType(hash); t != "hash" && t != "none" {
+		return Value{typ: "error", str: "WRONGTYPE Operation against a key holding the wrong kind of value"}
+	}
+
+	HSETsMu.Lock()
+	values := make([]Value, 0, len(fields))
+	for _, field := range fields {
+		value, ok := HSETs[hash][field]
+		if !ok {
+			values = append(values, Value{typ: "null"})
+			continue
+		}
+		values = append(values, Value{typ: "bulk", bulk: value})
+	}
+	_, exists := HSETs[hash]
+	emptied := exists && deleteFields(hash, fields)
+	HSETsMu.Unlock()
+
+	if emptied {
+		forget(hash)
+	} else if exists {
+		touch(hash)
+	}
+
+	return Value{typ: "array", array: values}
+}
+
+// hgetex is a command handler that returns the values of fields of a hash, and can set
+// or remove their expiry at the same time:
+// HGETEX key [EX seconds | PX milliseconds | EXAT unix-time-seconds |
+// PXAT unix-time-milliseconds | PERSIST] FIELDS numfields field [field ...].
+// EX and PX expire the fields after the given time, EXAT and PXAT at the given time, and
+// PERSIST removes their expiry. Only the fields that exist are changed, and a time that
+// has already passed deletes them right away, deleting the key if no field is left.
+// Expired fields are deleted before the command runs, see expireFields.
+// It publishes the hexpire keyspace event if it set the expiry of some field, hpersist if
+// it removed one, and hexpired if it deleted fields right away, like Redis.
+// It returns an array with the value of every field, in the order they were given, or a
+// null value for the fields that do not exist.
+// If the arguments are malformed, the time is not a positive integer, or the key holds a
+// value of another type, it returns an error.
+func hgetex(args []Value) Value {
+	if len(args) < 4 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'hgetex' command"}
+	}
+
+	hash := args[0].bulk
+	rest := args[1:]
+
+	var at time.Time
+	persist := false
+	if option := strings.ToUpper(rest[0].bulk); option != "FIELDS" {
+		if len(rest) < 2 {
+			return Value{typ: "error", str: "ERR syntax error"}
+		}
+
+		if option == "PERSIST" {
+			persist = true
+			rest = rest[1:]
+		} else {
+			unit, ok := hgetexUnits[option]
+			if !ok {
+				return Value{typ: "error", str: "ERR syntax error"}
+			}
+
+			n, err := strconv.ParseInt(rest[1].bulk, 10, 64)
+			if err != nil || n <= 0 {
+				return Value{typ: "error", str: "ERR invalid expire time in 'hgetex' command"}
+			}
+
+			ms, ok := expireMilliseconds(n, unit.unit, unit.absolute)
+			if !ok {
+				return Value{typ: "error", str: "ERR invalid expire time in 'hgetex' command"}
+			}
+			at = fromUnixMilli(ms)
+			rest = rest[2:]
+		}
+	}
+
+	fields, errValue, ok := parseFieldList(rest)
+	if !ok {
+		return errValue
+	}
+
+	if t := keyType(hash); t != "hash" && t != "none" {
+		return Value{typ: "error", str: "WRONGTYPE Operation against a key holding the wrong kind of value"}
+	}
+
+	now := clock()
+
+	HSETsMu.Lock()
+	values := make([]Value, 0, len(fields))
+	expired := []string{}
+	persisted, expiring := false, false
+	for _, field := range fields {
+		value, ok := HSETs[hash][field]
+		if !ok {
+			values = append(values, Value{typ: "null"})
+			continue
+		}
+		values = append(values, Value{typ: "bulk", bulk: value})
+
+		switch {
+		case persist:
+			if _, ok := hashFieldExpires[hash][field]; ok {
+				removeFieldExpiry(hash, field)
+				persisted = true
+			}
+		case at.IsZero():
+		case !at.After(now):
+			expired = append(expired, field)
+		default:
+			if _, ok := hashFieldExpires[hash]; !ok {
+				hashFieldExpires[hash] = map[string]time.Time{}
+			}
+			hashFieldExpires[hash][field] = at
+			expiring = true
+		}
+	}
+	_, exists := HSETs[hash]
+	emptied := len(expired) > 0 && deleteFields(hash, expired)
+	HSETsMu.Unlock()
+
+	if emptied {
+		forget(hash)
+	} else if exists {
+		touch(hash)
+	}
+
+	switch {
+	case len(expired) > 0:
+		notify(notifyHash, "hexpired", hash)
+	case persisted:
+		notify(notifyHash, "hpersist", hash)
+	case expiring:
+		notify(notifyHash, "hexpire", hash)
+	}
+
+	return Value{typ: "array", array: values}
+}
+
+// hgetexUnits maps the expiry options of HGETEX to the unit of their time, and whether it
+// is a Unix time rather than a time from now.
+var hgetexUnits = map[string]struct {
+	unit     time.Duration
+	absolute bool
+}{
+	"EX":   {time.Second, false},
+	"PX":   {time.Millisecond, false},
+	"EXAT": {time.Second, true},
+	"PXAT": {time.Millisecond, true},
+}
+
+// hgetexAbsolute returns the HGETEX request to write to the append-only file (AOF) for
+// value, with a relative EX or PX time, or an EXAT time, rewritten as the PXAT time the
+// fields expire at, so their expiry does not move when the file is replayed, see
+// absoluteExpiry. Requests with an invalid time, including one that is not positive, are
+// returned as is, so HGETEX rejects them.
+func hgetexAbsolute(value Value) Value {
+	if len(value.array) < 4 {
+		return value
+	}
+
+	option := strings.ToUpper(value.array[2].bulk)
+	unit, ok := hgetexUnits[option]
+	if !ok || option == "PXAT" {
+		return value
+	}
+
+	// HGETEX rejects a time that is not positive, which must not be rewritten into a valid one
+	n, err := strconv.ParseInt(value.array[3].bulk, 10, 64)
+	if err != nil || n <= 0 {
+		return value
+	}
+
+	ms, ok := expireMilliseconds(n, unit.unit, unit.absolute)
+	if !ok {
+		return value
+	}
+
+	array := []Value{value.array[0], value.array[1], {typ: "bulk", bulk: "PXAT"}, {typ: "bulk", bulk: strconv.FormatInt(ms, 10)}}
+	array = append(array, value.array[4:]...)
+
+	return Value{typ: "array", array: array}
+}
+
+// hexpire is a command handler that sets a timeout on fields of a hash, after which they
+// are deleted: HEXPIRE key seconds [NX | XX | GT | LT] FIELDS numfields field [field ...].
+// The conditions are the same as for EXPIRE, checked for every field on its own.
+// It returns an array with a result for every field, in the order they were given: -2 if
+// the field does not exist, 0 if the condition was not met, 1 if the timeout was set, or
+// 2 if the timeout was not positive and the field was deleted right away.
+// If the arguments are malformed, the timeout is not an integer or so large that the time
+// it ends at does not fit in 64 bits of milliseconds, or the key holds a value of another
+// type, it returns an error.
+func hexpire(args []Value) Value {
+	if len(args) < 5 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'hexpire' command"}
+	}
+
+	seconds, err := strconv.ParseInt(args[1].bulk, 10, 64)
+	if err != nil {
+		return Value{typ: "error", str: "ERR value is not an integer or out of range"}
+	}
+
+	ms, ok := expireMilliseconds(seconds, time.Second, false)
+	if !ok {
+		return Value{typ: "error", str: "ERR invalid expire time in 'hexpire' command"}
+	}
+
+	return hexpireAt(args[0].bulk, fromUnixMilli(ms), args[2:])
+}
+
+// hpexpireat is a command handler that sets the time fields of a hash are deleted at, as
+// a Unix time in milliseconds:
+// HPEXPIREAT key unix-time-milliseconds [NX | XX | GT | LT] FIELDS numfields field [field ...].
+// HEXPIRE is written to the append-only file (AOF) as HPEXPIREAT, so the expiry does not
+// move when the file is replayed. The conditions and results are the same as for HEXPIRE.
+func hpexpireat(args []Value) Value {
+	if len(args) < 5 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'hpexpireat' command"}
+	}
+
+	ms, err := strconv.ParseInt(args[1].bulk, 10, 64)
+	if err != nil {
+		return Value{typ: "error", str: "ERR value is not an integer or out of range"}
+	}
+
+	return hexpireAt(args[0].bulk, fromUnixMilli(ms), args[2:])
+}
+
+// hexpireAt implements HEXPIRE and HPEXPIREAT, setting the expiry of the fields listed
+// in options to at, unless the NX, XX, GT or LT condition that may precede them is not
+// met for a field.
+func hexpireAt(hash string, at time.Time, options []Value) Value {
+	condition := ""
+	if option := strings.ToUpper(options[0].bulk); option != "FIELDS" {
+		switch option {
+		case "NX", "XX", "GT", "LT":
+			condition = option
+			options = options[1:]
+		default:
+			return Value{typ: "error", str: "ERR Unsupported option " + options[0].bulk}
+		}
+	}
+
+	fields, errValue, ok := parseFieldList(options)
+	if !ok {
+		return errValue
+	}
+
+	if t := keyType(hash); t != "hash" && t != "none" {
+		return Value{typ: "error", str: "WRONGTYPE Operation against a key holding the wrong kind of value"}
+	}
+
+	now := clock()
+
+	HSETsMu.Lock()
+	results := make([]Value, 0, len(fields))
+	expired := []string{}
+	for _, field := range fields {
+		if _, ok := HSETs[hash][field]; !ok {
+			results = append(results, Value{typ: "integer", num: -2})
+			continue
+		}
+
+		current, ok := hashFieldExpires[hash][field]
+		switch {
+		case condition == "NX" && ok, condition == "XX" && !ok,
+			condition == "GT" && (!ok || !at.After(current)), condition == "LT" && ok && !at.Before(current):
+			results = append(results, Value{typ: "integer", num: 0})
+		case !at.After(now):
+			expired = append(expired, field)
+			results = append(results, Value{typ: "integer", num: 2})
+		default:
+			if _, ok := hashFieldExpires[hash]; !ok {
+				hashFieldExpires[hash] = map[string]time.Time{}
+			}
+			hashFieldExpires[hash][field] = at
+			results = append(results, Value{typ: "integer", num: 1})
+		}
+	}
+	_, exists := HSETs[hash]
+	emptied := len(expired) > 0 && deleteFields(hash, expired)
+	HSETsMu.Unlock()
+
+	if emptied {
+		forget(hash)
+	} else if exists {
+		touch(hash)
+	}
+
+	return Value{typ: "array", array: results}
+}
+
+// httl is a command handler that returns the remaining time to live of fields of a hash
+// in seconds: HTTL key FIELDS numfields field [field ...].
+// It returns an array with the time to live of every field, in the order they were
+// given, or -2 if the field does not exist, and -1 if it exists but has no expiry.
+// If the arguments are malformed, or the key holds a value of another type, it returns
+// an error.
+func httl(args []Value) Value {
+	if len(args) < 4 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'httl' command"}
+	}
+
+	hash := args[0].bulk
+
+	fields, errValue, ok := parseFieldList(args[1:])
+	if !ok {
+		return errValue
+	}
+
+	if t := keyType(hash); t != "hash" && t != "none" {
+		return Value{typ: "error", str: "WRONGTYPE Operation against a key holding the wrong kind of value"}
+	}
+
+	HSETsMu.RLock()
+	defer HSETsMu.RUnlock()
+
+	results := make([]Value, 0, len(fields))
+	for _, field := range fields {
+		if _, ok := HSETs[hash][field]; !ok {
+			results = append(results, Value{typ: "integer", num: -2})
+			continue
+		}
+
+		at, ok := hashFieldExpires[hash][field]
+		if !ok {
+			results = append(results, Value{typ: "integer", num: -1})
+			continue
+		}
+
+		results = append(results, Value{typ: "integer", num: remainingSeconds(at)})
+	}
+
+	return Value{typ: "array", array: results}
+}
+
+// expireFieldsCycle deletes expired fields in the background, the way expireCycle does
+// for keys: each round samples up to samples of the hashes with a field expiry and
+// deletes their expired fields, and another round follows only if more than
+// activeExpireStale percent of the sampled hashes had some.
+func expireFieldsCycle(aof *Aof, samples int) {
+	start := time.Now()
+
+	for {
+		now := clock()
+		sampled := 0
+		expired := []string{}
+
+		HSETsMu.RLock()
+		for hash, fields := range hashFieldExpires {
+			if sampled == samples {
+				break
+			}
+			sampled++
+
+			for _, at := range fields {
+				if !now.Before(at) {
+					expired = append(expired, hash)
+					break
+				}
+			}
+		}
+		HSETsMu.RUnlock()
+
+		for _, hash := range expired {
+			expireHashFields(nil, aof, hash)
+		}
+
+		if sampled == 0 || len(expired)*100 <= sampled*activeExpireStale || time.Since(start) > activeExpireTimeLimit {
+			return
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// startTime is the time the server process started. It is used to report uptime.
+var startTime = time.Now()
+
+// runID is a random identifier of this run of the server, reported as run_id by INFO.
+// It changes on every restart, so clients and failover tooling can detect restarts.
+var runID = newRunID()
+
+// newRunID returns 40 random hex characters from crypto/rand, like the Redis run id.
+func newRunID() string {
+	id := make([]byte, 20)
+	if _, err := rand.Read(id); err != nil {
+		panic("cannot generate the run id: " + err.Error())
+	}
+
+	return hex.EncodeToString(id)
+}
+
+// commandStat holds the statistics of a single command: how many times it has been
+// called and the total time spent executing it.
+type commandStat struct {
+	calls    int64
+	duration time.Duration
+}
+
+// CommandStats is a map of command names to their call statistics. It is updated
+// by the connection loop after every executed command and reported by the
+// commandstats section of INFO.
+var CommandStats = map[string]*commandStat{}
+
+// CommandStatsMu is a mutex that protects access to the CommandStats map.
+var CommandStatsMu = sync.Mutex{}
+
+// recordCommand adds a call of the given command, which took d to execute, to the
+// CommandStats map.
+func recordCommand(command string, d time.Duration) {
+	CommandStatsMu.Lock()
+	defer CommandStatsMu.Unlock()
+
+	stat, ok := CommandStats[command]
+	if !ok {
+		stat = &commandStat{}
+		CommandStats[command] = stat
+	}
+	stat.calls++
+	stat.duration += d
+}
+
+// info is a command handler that returns information and statistics about the server
+// as a bulk string. It takes an optional argument naming the section to return:
+// - server: general information about the server.
+// - clients: information about the connected clients.
+// - memory: the estimated memory used by the data set, and the maxmemory settings.
+// - persistence: information about snapshots.
+// - commandstats: call counts and execution time per command.
+// - all: every section.
+// Without an argument, the default sections (server, clients, memory and persistence) are returned.
+// If the section is unknown, an empty bulk string is returned, like Redis does.
+func info(args []Value) Value {
+	if len(args) > 1 {
+		return Value{typ: "error", str: "ERR syntax error"}
+	}
+
+	section := "default"
+	if len(args) == 1 {
+		section = strings.ToLower(args[0].bulk)
+	}
+
+	var sections []func(b *strings.Builder)
+	switch section {
+	case "default":
+		sections = append(sections, infoServer, infoClients, infoMemory, infoPersistence)
+	case "all", "everything":
+		sections = append(sections, infoServer, infoClients, infoMemory, infoPersistence, infoCommandStats)
+	case "server":
+		sections = append(sections, infoServer)
+	case "clients":
+		sections = append(sections, infoClients)
+	case "memory":
+		sections = append(sections, infoMemory)
+	case "persistence":
+		sections = append(sections, infoPersistence)
+	case "commandstats":
+		sections = append(sections, infoCommandStats)
+	}
+
+	var b strings.Builder
+	for i, write := range sections {
+		if i > 0 {
+			b.WriteString("\r\n")
+		}
+		write(&b)
+	}
+
+	return Value{typ: "bulk", bulk: b.String()}
+}
+
+// infoServer writes the server section of INFO to b.
+func infoServer(b *strings.Builder) {
+	uptime := time.Since(startTime)
+
+	b.WriteString("# Server\r\n")
+	fmt.Fprintf(b, "server_name:%s\r\n", ServerName)
+	fmt.Fprintf(b, "server_version:%s\r\n", ServerVersion)
+	fmt.Fprintf(b, "go_version:%s\r\n", runtime.Version())
+	fmt.Fprintf(b, "run_id:%s\r\n", runID)
+	fmt.Fprintf(b, "uptime_in_seconds:%d\r\n", int64(uptime.Seconds()))
+	fmt.Fprintf(b, "uptime_in_days:%d\r\n", int64(uptime.Hours()/24))
+}
+
+// infoClients writes the clients section of INFO to b.
+func infoClients(b *strings.Builder) {
+	SessionsMu.RLock()
+	connected := len(Sessions)
+	SessionsMu.RUnlock()
+
+	b.WriteString("# Clients\r\n")
+	fmt.Fprintf(b, "connected_clients:%d\r\n", connected)
+}
+
+// infoMemory writes the memory section of INFO to b. used_memory is the estimate of
+// usedMemory, not the memory used by the process, so it only grows with the data set.
+func infoMemory(b *strings.Builder) {
+	used := usedMemory()
+
+	ConfigMu.RLock()
+	limit := maxMemory
+	policy := maxMemoryPolicy
+	ConfigMu.RUnlock()
+
+	b.WriteString("# Memory\r\n")
+	fmt.Fprintf(b, "used_memory:%d\r\n", used)
+	fmt.Fprintf(b, "used_memory_human:%s\r\n", humanBytes(used))
+	fmt.Fprintf(b, "maxmemory:%d\r\n", limit)
+	fmt.Fprintf(b, "maxmemory_human:%s\r\n", humanBytes(limit))
+	fmt.Fprintf(b, "maxmemory_policy:%s\r\n", policy)
+}
+
+// humanBytes formats a number of bytes the way Redis does in INFO, e.g. 1.50K or 2.00M.
+func humanBytes(n int64) string {
+	units := []string{"K", "M", "G", "T"}
+
+	if n < 1024 {
+		return fmt.Sprintf("%dB", n)
+	}
+
+	value := float64(n)
+	unit := ""
+	for _, u := range units {
+		if value < 1024 {
+			break
+		}
+		value /= 1024
+		unit = u
+	}
+
+	return fmt.Sprintf("%.2f%s", value, unit)
+}
+
+// infoPersistence writes the persistence section of INFO to b.
+func infoPersistence(b *strings.Builder) {
+	last := time.Unix(0, atomic.LoadInt64(&lastSave))
+
+	b.WriteString("# Persistence\r\n")
+	fmt.Fprintf(b, "loading:%d\r\n", atomic.LoadInt32(&loading))
+	fmt.Fprintf(b, "rdb_changes_since_last_save:%d\r\n", atomic.LoadInt64(&dirty))
+	fmt.Fprintf(b, "rdb_last_save_time:%d\r\n", last.Unix())
+}
+
+// infoCommandStats writes the commandstats section of INFO to b. Each command that
+// has been called at least once gets a line of the form
+// cmdstat_<command>:calls=<n>,usec=<total>,usec_per_call=<average>.
+func infoCommandStats(b *strings.Builder) {
+	CommandStatsMu.Lock()
+	defer CommandStatsMu.Unlock()
+
+	commands := make([]string, 0, len(CommandStats))
+	for command := range CommandStats {
+		commands = append(commands, command)
+	}
+	sort.Strings(commands)
+
+	b.WriteString("# Commandstats\r\n")
+	for _, command := range commands {
+		stat := CommandStats[command]
+		usec := stat.duration.Microseconds()
+		fmt.Fprintf(b, "cmdstat_%s:calls=%d,usec=%d,usec_per_call=%.2f\r\n",
+			strings.ToLower(command), stat.calls, usec, float64(usec)/float64(stat.calls))
+	}
+}
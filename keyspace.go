@@ -0,0 +1,522 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// keyType returns the type of the value stored at key: "string", "hash", "list", "set"
+// or "zset", or "none" if the key does not exist. The maps are checked one at a time, each
+// under its own read lock, so the caller must not hold any of the map locks.
+func keyType(key string) string {
+	SETsMu.RLock()
+	_, ok := SETs[key]
+	SETsMu.RUnlock()
+	if ok {
+		return "string"
+	}
+
+	HSETsMu.RLock()
+	_, ok = HSETs[key]
+	HSETsMu.RUnlock()
+	if ok {
+		return "hash"
+	}
+
+	LISTsMu.RLock()
+	_, ok = LISTs[key]
+	LISTsMu.RUnlock()
+	if ok {
+		return "list"
+	}
+
+	SSETsMu.RLock()
+	_, ok = SSETs[key]
+	SSETsMu.RUnlock()
+	if ok {
+		return "set"
+	}
+
+	ZSETsMu.RLock()
+	_, ok = ZSETs[key]
+	ZSETsMu.RUnlock()
+	if ok {
+		return "zset"
+	}
+
+	return "none"
+}
+
+// deleteKey removes key from every data type map and forgets its access time and expiry. The maps
+// are locked one at a time, so the caller must not hold any of the map locks.
+// It returns true if the key existed.
+func deleteKey(key string) bool {
+	_, deleted := detachKey(key)
+	return deleted
+}
+
+// detachKey removes key like deleteKey, and also returns the value that was stored at it,
+// so the caller decides where its memory is reclaimed, see unlink. It returns false, with
+// a nil value, if the key did not exist.
+func detachKey(key string) (interface{}, bool) {
+	var value interface{}
+	deleted := false
+
+	SETsMu.Lock()
+	if v, ok := SETs[key]; ok {
+		delete(SETs, key)
+		value, deleted = v, true
+	}
+	SETsMu.Unlock()
+
+	HSETsMu.Lock()
+	if v, ok := HSETs[key]; ok {
+		delete(HSETs, key)
+		delete(HSETsOrder, key)
+		delete(hashFieldExpires, key)
+		value, deleted = v, true
+	}
+	HSETsMu.Unlock()
+
+	LISTsMu.Lock()
+	if v, ok := LISTs[key]; ok {
+		delete(LISTs, key)
+		value, deleted = v, true
+	}
+	LISTsMu.Unlock()
+
+	SSETsMu.Lock()
+	if v, ok := SSETs[key]; ok {
+		delete(SSETs, key)
+		value, deleted = v, true
+	}
+	SSETsMu.Unlock()
+
+	ZSETsMu.Lock()
+	if v, ok := ZSETs[key]; ok {
+		delete(ZSETs, key)
+		value, deleted = v, true
+	}
+	ZSETsMu.Unlock()
+
+	forget(key)
+
+	return value, deleted
+}
+
+// del is a command handler that deletes one or more keys, whatever the type of the
+// value stored at them. It takes at least one argument: the keys to delete.
+// If no arguments are given, it returns an error.
+// It returns the number of keys that existed and were deleted as an integer.
+func del(args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'del' command"}
+	}
+
+	deleted := 0
+	for _, arg := range args {
+		if deleteKey(arg.bulk) {
+			deleted++
+		}
+	}
+
+	return Value{typ: "integer", num: deleted}
+}
+
+// lazyfreeThreshold is the number of elements above which UNLINK frees a value in the
+// background rather than right away, like LAZYFREE_THRESHOLD in Redis.
+const lazyfreeThreshold = 64
+
+// unlink is a command handler that deletes one or more keys, like DEL, but frees large
+// values off the command: the keys are detached from the keyspace under the map locks,
+// which is constant time, and the values with more than lazyfreeThreshold elements are
+// then emptied by a goroutine, so deleting a huge collection does not stall the server,
+// like UNLINK in Redis. Smaller values are left to the garbage collector right away.
+// If no arguments are given, it returns an error.
+// It returns the number of keys that existed and were deleted as an integer.
+func unlink(args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'unlink' command"}
+	}
+
+	deleted := 0
+	large := []interface{}{}
+	for _, arg := range args {
+		value, ok := detachKey(arg.bulk)
+		if !ok {
+			continue
+		}
+		deleted++
+
+		if elementCount(value) > lazyfreeThreshold {
+			large = append(large, value)
+		}
+	}
+
+	if len(large) > 0 {
+		go func() {
+			for _, value := range large {
+				freeValue(value)
+			}
+		}()
+	}
+
+	return Value{typ: "integer", num: deleted}
+}
+
+// elementCount returns the number of elements of a value returned by detachKey, or 1 for
+// a string.
+func elementCount(value interface{}) int {
+	switch v := value.(type) {
+	case map[string]string:
+		return len(v)
+	case []string:
+		return len(v)
+	case map[string]struct{}:
+		return len(v)
+	case map[string]float64:
+		return len(v)
+	default:
+		return 1
+	}
+}
+
+// freeValue empties a value returned by detachKey, so the memory of its elements can be
+// reclaimed without walking it from the command that deleted it. The value must no longer
+// be reachable from any of the maps.
+func freeValue(value interface{}) {
+	switch v := value.(type) {
+	case map[string]string:
+		for field := range v {
+			delete(v, field)
+		}
+	case []string:
+		for i := range v {
+			v[i] = ""
+		}
+	case map[string]struct{}:
+		for member := range v {
+			delete(v, member)
+		}
+	case map[string]float64:
+		for member := range v {
+			delete(v, member)
+		}
+	}
+}
+
+// flushAll removes every key from every data type map and forgets all access times.
+func flushAll() {
+	SETsMu.Lock()
+	SETs = map[string][]byte{}
+	SETsMu.Unlock()
+
+	HSETsMu.Lock()
+	HSETs = map[string]map[string]string{}
+	HSETsOrder = map[string][]string{}
+	hashFieldExpires = map[string]map[string]time.Time{}
+	HSETsMu.Unlock()
+
+	LISTsMu.Lock()
+	LISTs = map[string][]string{}
+	LISTsMu.Unlock()
+
+	SSETsMu.Lock()
+	SSETs = map[string]map[string]struct{}{}
+	SSETsMu.Unlock()
+
+	ZSETsMu.Lock()
+	ZSETs = map[string]map[string]float64{}
+	ZSETsMu.Unlock()
+
+	forgetAll()
+}
+
+// flushdb is a command handler that deletes every key. It takes an optional ASYNC or
+// SYNC argument, which clients send to choose how memory is reclaimed. Both are
+// accepted, and in this in-memory server both flush synchronously.
+// If the argument is anything else, it returns a syntax error.
+// It returns "OK" once the data is flushed. FLUSHALL is handled the same way, since
+// there is a single database.
+func flushdb(args []Value) Value {
+	if len(args) > 1 {
+		return Value{typ: "error", str: "ERR syntax error"}
+	}
+
+	if len(args) == 1 {
+		switch strings.ToUpper(args[0].bulk) {
+		case "ASYNC", "SYNC":
+		default:
+			return Value{typ: "error", str: "ERR syntax error"}
+		}
+	}
+
+	flushAll()
+
+	return Value{typ: "string", str: "OK"}
+}
+
+// allKeys returns every key stored in any of the data type maps, sorted. The maps are
+// read one at a time, each under its own read lock.
+func allKeys() []string {
+	seen := map[string]struct{}{}
+
+	SETsMu.RLock()
+	for key := range SETs {
+		seen[key] = struct{}{}
+	}
+	SETsMu.RUnlock()
+
+	HSETsMu.RLock()
+	for key := range HSETs {
+		seen[key] = struct{}{}
+	}
+	HSETsMu.RUnlock()
+
+	LISTsMu.RLock()
+	for key := range LISTs {
+		seen[key] = struct{}{}
+	}
+	LISTsMu.RUnlock()
+
+	SSETsMu.RLock()
+	for key := range SSETs {
+		seen[key] = struct{}{}
+	}
+	SSETsMu.RUnlock()
+
+	ZSETsMu.RLock()
+	for key := range ZSETs {
+		seen[key] = struct{}{}
+	}
+	ZSETsMu.RUnlock()
+
+	keys := make([]string, 0, len(seen))
+	for key := range seen {
+		// expired keys are logically gone, even if they have not been deleted yet
+		if !isExpired(key) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// keys is a command handler that returns every key matching a glob pattern.
+// It takes one argument: the pattern, as understood by glob.
+// If the number of arguments is not exactly 1, it returns an error.
+// It returns the matching keys as an array, sorted.
+//
+// NOTE: This walks the whole keyspace, so it is slow on large data sets. SCAN returns
+// the same keys a page at a time.
+func keys(args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'keys' command"}
+	}
+
+	pattern := args[0].bulk
+
+	values := []Value{}
+	for _, key := range allKeys() {
+		if glob(pattern, key) {
+			values = append(values, Value{typ: "bulk", bulk: key})
+		}
+	}
+
+	return Value{typ: "array", array: values}
+}
+
+// scanOptions parses the optional MATCH and COUNT arguments shared by SCAN and HSCAN.
+// The count defaults to 10, and the pattern to "*". It returns an error Value if an
+// argument is unknown or invalid.
+func scanOptions(args []Value) (pattern string, count int, errValue Value, ok bool) {
+	pattern = "*"
+	count = 10
+
+	for i := 0; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return "", 0, Value{typ: "error", str: "ERR syntax error"}, false
+		}
+
+		switch strings.ToUpper(args[i].bulk) {
+		case "MATCH":
+			pattern = args[i+1].bulk
+		case "COUNT":
+			n, err := strconv.Atoi(args[i+1].bulk)
+			if err != nil {
+				return "", 0, Value{typ: "error", str: "ERR value is not an integer or out of range"}, false
+			}
+			if n < 1 {
+				return "", 0, Value{typ: "error", str: "ERR syntax error"}, false
+			}
+			count = n
+		default:
+			return "", 0, Value{typ: "error", str: "ERR syntax error"}, false
+		}
+	}
+
+	return pattern, count, Value{}, true
+}
+
+// scanSnapshots is a map of scan generation ids to the sorted list of keys taken when
+// that scan started with cursor 0. Every page of a scan is read from the same list, so
+// keys that are added or deleted between pages cannot shift the others and make the scan
+// skip or repeat them.
+//
+// NOTE: Every snapshot holds a copy of every key name until its scan reaches the end, so
+// a scan costs memory proportional to the size of the keyspace for as long as it runs.
+// Clients can abandon a scan at any time, so only the maxScanSnapshots most recent ones
+// are kept; continuing an older scan returns an error.
+var scanSnapshots = map[int64][]string{}
+
+// scanGenerations lists the generation ids in scanSnapshots from oldest to newest, so the
+// oldest snapshot can be dropped once there are more than maxScanSnapshots.
+var scanGenerations = []int64{}
+
+// scanGeneration is the last generation id handed out to a scan. It is protected by the
+// scanSnapshotsMu mutex, together with scanSnapshots and scanGenerations.
+var scanGeneration int64
+
+// scanSnapshotsMu is a mutex that protects access to the scan snapshots.
+var scanSnapshotsMu = sync.Mutex{}
+
+// maxScanSnapshots is the number of scans that can be in progress at the same time.
+const maxScanSnapshots = 64
+
+// scanOffsetBits is the number of low bits of a cursor holding the position in the
+// snapshot; the bits above hold the generation id.
+const scanOffsetBits = 32
+
+// startScan takes a snapshot of the sorted keys for a new scan and returns its
+// generation id, dropping the oldest snapshot if there are too many.
+func startScan() (int64, []string) {
+	keys := allKeys()
+
+	scanSnapshotsMu.Lock()
+	defer scanSnapshotsMu.Unlock()
+
+	scanGeneration++
+	scanSnapshots[scanGeneration] = keys
+	scanGenerations = append(scanGenerations, scanGeneration)
+
+	if len(scanGenerations) > maxScanSnapshots {
+		delete(scanSnapshots, scanGenerations[0])
+		scanGenerations = scanGenerations[1:]
+	}
+
+	return scanGeneration, keys
+}
+
+// scanSnapshot returns the snapshot of the scan with the given generation id, and false
+// if there is no such scan.
+func scanSnapshot(generation int64) ([]string, bool) {
+	scanSnapshotsMu.Lock()
+	defer scanSnapshotsMu.Unlock()
+
+	keys, ok := scanSnapshots[generation]
+
+	return keys, ok
+}
+
+// finishScan drops the snapshot of the scan with the given generation id once it has
+// returned every key.
+func finishScan(generation int64) {
+	scanSnapshotsMu.Lock()
+	defer scanSnapshotsMu.Unlock()
+
+	delete(scanSnapshots, generation)
+	for i, g := range scanGenerations {
+		if g == generation {
+			scanGenerations = append(scanGenerations[:i], scanGenerations[i+1:]...)
+			break
+		}
+	}
+}
+
+// scan is a command handler that iterates over the keyspace a page at a time:
+// SCAN cursor [MATCH pattern] [COUNT count] [TYPE type].
+// A scan starts with cursor 0, which takes a snapshot of the sorted keys (see
+// scanSnapshots), and ends when the returned cursor is 0 again. The other cursors encode
+// the generation id of the snapshot and the position in it. Each call looks at up to
+// count keys of the snapshot, and returns the ones that still exist and match the
+// pattern, so every key that exists for the whole scan is returned exactly once. With
+// TYPE, only the keys holding a value of that type (string, hash, list, set or zset) are
+// returned.
+// If the cursor or an option is invalid, or the scan was dropped, it returns an error.
+// It returns an array of the next cursor and an array of the matching keys.
+func scan(args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'scan' command"}
+	}
+
+	cursor, err := strconv.ParseInt(args[0].bulk, 10, 64)
+	if err != nil || cursor < 0 {
+		return Value{typ: "error", str: "ERR invalid cursor"}
+	}
+
+	// TYPE is only supported by SCAN, so it is taken out before the shared options are parsed
+	typ := ""
+	options := []Value{}
+	for i := 1; i < len(args); i += 2 {
+		if strings.ToUpper(args[i].bulk) == "TYPE" && i+1 < len(args) {
+			typ = strings.ToLower(args[i+1].bulk)
+			continue
+		}
+		end := i + 2
+		if end > len(args) {
+			end = len(args)
+		}
+		options = append(options, args[i:end]...)
+	}
+
+	switch typ {
+	case "", "string", "hash", "list", "set", "zset":
+	default:
+		return Value{typ: "error", str: "ERR unknown type name '" + typ + "'"}
+	}
+
+	pattern, count, errValue, ok := scanOptions(options)
+	if !ok {
+		return errValue
+	}
+
+	var generation int64
+	var all []string
+	if cursor == 0 {
+		generation, all = startScan()
+	} else {
+		generation = cursor >> scanOffsetBits
+		all, ok = scanSnapshot(generation)
+		if !ok {
+			return Value{typ: "error", str: "ERR invalid cursor"}
+		}
+	}
+
+	offset := int(cursor & (1<<scanOffsetBits - 1))
+
+	values := []Value{}
+	next := offset
+	for i := offset; i < len(all) && i < offset+count; i++ {
+		if glob(pattern, all[i]) {
+			if t := keyType(all[i]); t != "none" && (typ == "" || t == typ) {
+				values = append(values, Value{typ: "bulk", bulk: all[i]})
+			}
+		}
+		next = i + 1
+	}
+
+	nextCursor := generation<<scanOffsetBits | int64(next)
+	if next >= len(all) {
+		finishScan(generation)
+		nextCursor = 0
+	}
+
+	return Value{typ: "array", array: []Value{
+		{typ: "bulk", bulk: strconv.FormatInt(nextCursor, 10)},
+		{typ: "array", array: values},
+	}}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// lcsLength returns the length of the longest common subsequence of a and b. Only two
+// rows of the table are kept, so it needs memory proportional to the length of b rather
+// than to the product of both lengths.
+func lcsLength(a, b []byte) int {
+	prev := make([]uint32, len(b)+1)
+	curr := make([]uint32, len(b)+1)
+
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			switch {
+			case a[i-1] == b[j-1]:
+				curr[j] = prev[j-1] + 1
+			case prev[j] > curr[j-1]:
+				curr[j] = prev[j]
+			default:
+				curr[j] = curr[j-1]
+			}
+		}
+		prev, curr = curr, prev
+	}
+
+	return int(prev[len(b)])
+}
+
+// lcsTable returns the table of the lengths of the longest common subsequences of every
+// prefix of a and b, where the entry for the first i bytes of a and the first j bytes of
+// b is at i*(len(b)+1)+j. The lengths are 32-bit, like in Redis, since the table has an
+// entry for every pair of bytes.
+func lcsTable(a, b []byte) []uint32 {
+	width := len(b) + 1
+	table := make([]uint32, (len(a)+1)*width)
+
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			switch {
+			case a[i-1] == b[j-1]:
+				table[i*width+j] = table[(i-1)*width+j-1] + 1
+			case table[(i-1)*width+j] > table[i*width+j-1]:
+				table[i*width+j] = table[(i-1)*width+j]
+			default:
+				table[i*width+j] = table[i*width+j-1]
+			}
+		}
+	}
+
+	return table
+}
+
+// lcsMatch is a range of bytes that is part of the longest common subsequence, given by
+// its inclusive start and end offsets in both strings.
+type lcsMatch struct {
+	aStart, aEnd int
+	bStart, bEnd int
+}
+
+// lcsBacktrack walks the table from the end of both strings back to their start, and
+// returns the longest common subsequence together with the ranges of contiguous bytes it
+// is made of, from the last one to the first one, like Redis reports them.
+func lcsBacktrack(a, b []byte, table []uint32) ([]byte, []lcsMatch) {
+	width := len(b) + 1
+	length := int(table[len(a)*width+len(b)])
+
+	result := make([]byte, length)
+	matches := []lcsMatch{}
+
+	// a range is open while current.aStart is not -1
+	current := lcsMatch{aStart: -1}
+
+	i, j := len(a), len(b)
+	for i > 0 && j > 0 {
+		emit := false
+
+		if a[i-1] == b[j-1] {
+			result[length-1] = a[i-1]
+
+			switch {
+			case current.aStart == -1:
+				current = lcsMatch{aStart: i - 1, aEnd: i - 1, bStart: j - 1, bEnd: j - 1}
+			case current.aStart == i && current.bStart == j:
+				// the match is contiguous with the range, so it extends it backward
+				current.aStart--
+				current.bStart--
+			default:
+				emit = true
+			}
+
+			// the range cannot extend past the start of either string
+			if current.aStart == 0 || current.bStart == 0 {
+				emit = true
+			}
+
+			length--
+			i--
+			j--
+		} else {
+			if table[(i-1)*width+j] > table[i*width+j-1] {
+				i--
+			} else {
+				j--
+			}
+
+			if current.aStart != -1 {
+				emit = true
+			}
+		}
+
+		if emit && current.aStart != -1 {
+			matches = append(matches, current)
+			current = lcsMatch{aStart: -1}
+		}
+	}
+
+	return result, matches
+}
+
+// lcs is a command handler that finds the longest common subsequence of the strings
+// stored at two keys: LCS key1 key2 [LEN] [IDX] [MINMATCHLEN len] [WITHMATCHLEN].
+// By default it returns the subsequence as a bulk string. With LEN, it returns its
+// length as an integer. With IDX, it returns an array of "matches", the ranges of
+// contiguous bytes the subsequence is made of in both strings, from the last one to
+// the first one, and "len", its length. MINMATCHLEN leaves out the ranges shorter than
+// len, and WITHMATCHLEN adds the length of every range after it.
+// Missing keys are treated as empty strings.
+// If the options are invalid, LEN and IDX are both given, a key holds a value of another
+// type, or the table the subsequence is computed with would take more memory than
+// proto-max-bulk-len, it returns an error, like Redis does.
+// The LEN form only keeps two rows of the table, so it needs much less memory.
+func lcs(args []Value) Value {
+	if len(args) < 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'lcs' command"}
+	}
+
+	var getLen, getIdx, withMatchLen bool
+	minMatchLen := 0
+	for i := 2; i < len(args); i++ {
+		switch strings.ToUpper(args[i].bulk) {
+		case "LEN":
+			getLen = true
+		case "IDX":
+			getIdx = true
+		case "WITHMATCHLEN":
+			withMatchLen = true
+		case "MINMATCHLEN":
+			if i+1 == len(args) {
+				return Value{typ: "error", str: "ERR syntax error"}
+			}
+			n, err := strconv.Atoi(args[i+1].bulk)
+			if err != nil {
+				return Value{typ: "error", str: "ERR value is not an integer or out of range"}
+			}
+			if n > 0 {
+				minMatchLen = n
+			}
+			i++
+		default:
+			return Value{typ: "error", str: "ERR syntax error"}
+		}
+	}
+
+	if getLen && getIdx {
+		return Value{typ: "error", str: "ERR If you want both the length and indexes, please just use IDX."}
+	}
+
+	for _, arg := range args[:2] {
+		if t := keyType(arg.bulk); t != "string" && t != "none" {
+			return Value{typ: "error", str: "ERR The specified keys must contain string values"}
+		}
+	}
+
+	// the values can be changed in place, so they are copied while the lock is held
+	SETsMu.RLock()
+	a := append([]byte{}, SETs[args[0].bulk]...)
+	b := append([]byte{}, SETs[args[1].bulk]...)
+	SETsMu.RUnlock()
+
+	if getLen {
+		return Value{typ: "integer", num: lcsLength(a, b)}
+	}
+
+	if int64(len(a)+1)*int64(len(b)+1)*4 > maxBulkLen() {
+		return Value{typ: "error", str: "ERR Insufficient memory, transient memory for LCS exceeds proto-max-bulk-len"}
+	}
+
+	result, matches := lcsBacktrack(a, b, lcsTable(a, b))
+
+	if !getIdx {
+		return Value{typ: "bulk", bulk: string(result)}
+	}
+
+	values := []Value{}
+	for _, match := range matches {
+		matchLen := match.aEnd - match.aStart + 1
+		if matchLen < minMatchLen {
+			continue
+		}
+
+		value := []Value{
+			{typ: "array", array: []Value{{typ: "integer", num: match.aStart}, {typ: "integer", num: match.aEnd}}},
+			{typ: "array", array: []Value{{typ: "integer", num: match.bStart}, {typ: "integer", num: match.bEnd}}},
+		}
+		if withMatchLen {
+			value = append(value, Value{typ: "integer", num: matchLen})
+		}
+
+		values = append(values, Value{typ: "array", array: value})
+	}
+
+	return Value{typ: "array", array: []Value{
+		{typ: "bulk", bulk: "matches"},
+		{typ: "array", array: values},
+		{typ: "bulk", bulk: "len"},
+		{typ: "integer", num: len(result)},
+	}}
+}
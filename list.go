@@ -0,0 +1,349 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+)
+
+// LISTs is a map that stores lists for the list commands. Each list is a slice of
+// elements ordered from the head (index 0) to the tail.
+var LISTs = map[string][]string{}
+
+// LISTsMu is a read-write mutex that protects access to the LISTs map.
+var LISTsMu = sync.RWMutex{}
+
+// listRange converts the inclusive start and stop indices of a list command into
+// slice bounds for a list of the given length. Negative indices count back from the
+// tail of the list, so -1 is the last element. Indices past either end are clamped.
+// It returns ok as false if the resulting range is empty.
+func listRange(start, stop, length int) (from int, to int, ok bool) {
+	if start < 0 {
+		start += length
+	}
+	if stop < 0 {
+		stop += length
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= length {
+		stop = length - 1
+	}
+	if start > stop || start >= length {
+		return 0, 0, false
+	}
+
+	return start, stop + 1, true
+}
+
+// lpush is a command handler that inserts one or more elements at the head of a list.
+// It takes at least two arguments: the name of the list and the elements to insert.
+// If fewer than 2 arguments are given, or the key holds a value of another type, it
+// returns an error.
+// The function acquires a write lock on the LISTsMu mutex before modifying the LISTs map,
+// and releases the lock after the operation is complete.
+// Elements are inserted one after the other, so the last argument ends up at the head.
+// Connections blocked in BLPOP or BRPOP on the list are woken up.
+// It returns the length of the list after the push as an integer.
+func lpush(args []Value) Value {
+	if len(args) < 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'lpush' command"}
+	}
+
+	key := args[0].bulk
+
+	if t := keyType(key); t != "list" && t != "none" {
+		return Value{typ: "error", str: "WRONGTYPE Operation against a key holding the wrong kind of value"}
+	}
+
+	LISTsMu.Lock()
+	list := LISTs[key]
+	elements := make([]string, 0, len(args)-1+len(list))
+	for i := len(args) - 1; i >= 1; i-- {
+		elements = append(elements, args[i].bulk)
+	}
+	list = append(elements, list...)
+	LISTs[key] = list
+	LISTsMu.Unlock()
+
+	touch(key)
+	signalPush(key)
+
+	return Value{typ: "integer", num: len(list)}
+}
+
+// rpush is a command handler that appends one or more elements to the tail of a list.
+// It takes at least two arguments: the name of the list and the elements to append.
+// If fewer than 2 arguments are given, or the key holds a value of another type, it
+// returns an error.
+// The function acquires a write lock on the LISTsMu mutex before modifying the LISTs map,
+// and releases the lock after the operation is complete.
+// Connections blocked in BLPOP or BRPOP on the list are woken up.
+// It returns the length of the list after the push as an integer.
+func rpush(args []Value) Value {
+	if len(args) < 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'rpush' command"}
+	}
+
+	key := args[0].bulk
+
+	if t := keyType(key); t != "list" && t != "none" {
+		return Value{typ: "error", str: "WRONGTYPE Operation against a key holding the wrong kind of value"}
+	}
+
+	LISTsMu.Lock()
+	list := LISTs[key]
+	for _, arg := range args[1:] {
+		list = append(list, arg.bulk)
+	}
+	LISTs[key] = list
+	LISTsMu.Unlock()
+
+	touch(key)
+	signalPush(key)
+
+	return Value{typ: "integer", num: len(list)}
+}
+
+// lpop is a command handler that removes and returns the first elements of a list:
+// LPOP key [count]. See popElements.
+func lpop(args []Value) Value {
+	return popElements("lpop", true, args)
+}
+
+// rpop is a command handler that removes and returns the last elements of a list:
+// RPOP key [count]. See popElements.
+func rpop(args []Value) Value {
+	return popElements("rpop", false, args)
+}
+
+// popElements implements LPOP and RPOP, popping from the head of the list if head is
+// true, and from the tail otherwise.
+// Without a count, it returns the popped element as a bulk string. With a count, it
+// returns an array of up to count elements, in the order they were popped, and a count
+// of 0 returns an empty array.
+// If the list does not exist, it returns a null value in both forms. If the list becomes
+// empty, the key is deleted.
+// If there are more than 2 arguments, the count is not a non-negative integer, or the key
+// holds a value of another type, it returns an error.
+// The function acquires a write lock on the LISTsMu mutex before modifying the LISTs map,
+// and releases the lock after the operation is complete.
+func popElements(command string, head bool, args []Value) Value {
+	if len(args) < 1 || len(args) > 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for '" + command + "' command"}
+	}
+
+	key := args[0].bulk
+
+	count := 1
+	if len(args) == 2 {
+		n, err := strconv.Atoi(args[1].bulk)
+		if err != nil || n < 0 {
+			return Value{typ: "error", str: "ERR value is out of range, must be positive"}
+		}
+		count = n
+	}
+
+	if t := keyType(key); t != "list" && t != "none" {
+		return Value{typ: "error", str: "WRONGTYPE Operation against a key holding the wrong kind of value"}
+	}
+
+	LISTsMu.Lock()
+	defer LISTsMu.Unlock()
+
+	list, ok := LISTs[key]
+	if !ok {
+		return Value{typ: "null"}
+	}
+
+	if count > len(list) {
+		count = len(list)
+	}
+
+	elements := make([]Value, 0, count)
+	for i := 0; i < count; i++ {
+		if head {
+			elements = append(elements, Value{typ: "bulk", bulk: list[i]})
+		} else {
+			elements = append(elements, Value{typ: "bulk", bulk: list[len(list)-1-i]})
+		}
+	}
+
+	if count == len(list) {
+		delete(LISTs, key)
+		forget(key)
+	} else if head {
+		LISTs[key] = list[count:]
+	} else {
+		LISTs[key] = list[:len(list)-count]
+	}
+
+	if len(args) == 1 {
+		return elements[0]
+	}
+
+	return Value{typ: "array", array: elements}
+}
+
+// llen is a command handler that returns the length of a list.
+// It takes one argument: the name of the list.
+// If the number of arguments is not exactly 1, or the key holds a value of another type,
+// it returns an error.
+// The function acquires a read lock on the LISTsMu mutex before accessing the LISTs map,
+// and releases the lock after the operation is complete.
+// A missing list has a length of 0.
+func llen(args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'llen' command"}
+	}
+
+	key := args[0].bulk
+
+	if t := keyType(key); t != "list" && t != "none" {
+		return Value{typ: "error", str: "WRONGTYPE Operation against a key holding the wrong kind of value"}
+	}
+
+	LISTsMu.RLock()
+	length := len(LISTs[key])
+	LISTsMu.RUnlock()
+
+	return Value{typ: "integer", num: length}
+}
+
+// lrange is a command handler that returns the elements of a list in the inclusive
+// range [start, stop]. It takes three arguments: the name of the list, the start index,
+// and the stop index. Negative indices count back from the tail of the list.
+// If the number of arguments is not exactly 3, an index is not an integer, or the key
+// holds a value of another type, it returns an error.
+// The function acquires a read lock on the LISTsMu mutex before accessing the LISTs map,
+// and releases the lock after the operation is complete.
+// If the list does not exist or the range is empty, it returns an empty array.
+func lrange(args []Value) Value {
+	if len(args) != 3 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'lrange' command"}
+	}
+
+	key := args[0].bulk
+	start, err := strconv.Atoi(args[1].bulk)
+	if err != nil {
+		return Value{typ: "error", str: "ERR value is not an integer or out of range"}
+	}
+	stop, err := strconv.Atoi(args[2].bulk)
+	if err != nil {
+		return Value{typ: "error", str: "ERR value is not an integer or out of range"}
+	}
+
+	if t := keyType(key); t != "list" && t != "none" {
+		return Value{typ: "error", str: "WRONGTYPE Operation against a key holding the wrong kind of value"}
+	}
+
+	LISTsMu.RLock()
+	defer LISTsMu.RUnlock()
+
+	list := LISTs[key]
+	values := []Value{}
+
+	from, to, ok := listRange(start, stop, len(list))
+	if !ok {
+		return Value{typ: "array", array: values}
+	}
+
+	for _, element := range list[from:to] {
+		values = append(values, Value{typ: "bulk", bulk: element})
+	}
+
+	touch(key)
+
+	return Value{typ: "array", array: values}
+}
+
+// ltrim is a command handler that trims a list so that it only contains the elements
+// in the inclusive range [start, stop]. It takes three arguments: the name of the list,
+// the start index, and the stop index. Negative indices count back from the tail of
+// the list.
+// If the number of arguments is not exactly 3, an index is not an integer, or the key
+// holds a value of another type, it returns an error.
+// The function acquires a write lock on the LISTsMu mutex before modifying the LISTs map,
+// and releases the lock after the operation is complete.
+// If the range is empty, the key is deleted.
+// It returns a Value with a "string" type and the value "OK" upon successful completion.
+func ltrim(args []Value) Value {
+	if len(args) != 3 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'ltrim' command"}
+	}
+
+	key := args[0].bulk
+	start, err := strconv.Atoi(args[1].bulk)
+	if err != nil {
+		return Value{typ: "error", str: "ERR value is not an integer or out of range"}
+	}
+	stop, err := strconv.Atoi(args[2].bulk)
+	if err != nil {
+		return Value{typ: "error", str: "ERR value is not an integer or out of range"}
+	}
+
+	if t := keyType(key); t != "list" && t != "none" {
+		return Value{typ: "error", str: "WRONGTYPE Operation against a key holding the wrong kind of value"}
+	}
+
+	LISTsMu.Lock()
+	defer LISTsMu.Unlock()
+
+	list, exists := LISTs[key]
+	if !exists {
+		return Value{typ: "string", str: "OK"}
+	}
+
+	from, to, ok := listRange(start, stop, len(list))
+	if !ok {
+		delete(LISTs, key)
+		forget(key)
+		return Value{typ: "string", str: "OK"}
+	}
+
+	// copy the kept range so the trimmed elements can be garbage collected
+	trimmed := make([]string, to-from)
+	copy(trimmed, list[from:to])
+	LISTs[key] = trimmed
+
+	return Value{typ: "string", str: "OK"}
+}
+
+// lindex is a command handler that returns the element at the given index of a list.
+// It takes two arguments: the name of the list and the index. Negative indices count
+// back from the tail of the list, so -1 is the last element.
+// If the number of arguments is not exactly 2, the index is not an integer, or the key
+// holds a value of another type, it returns an error.
+// The function acquires a read lock on the LISTsMu mutex before accessing the LISTs map,
+// and releases the lock after the operation is complete.
+// If the list does not exist or the index is out of range, it returns a null value.
+func lindex(args []Value) Value {
+	if len(args) != 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'lindex' command"}
+	}
+
+	key := args[0].bulk
+	index, err := strconv.Atoi(args[1].bulk)
+	if err != nil {
+		return Value{typ: "error", str: "ERR value is not an integer or out of range"}
+	}
+
+	if t := keyType(key); t != "list" && t != "none" {
+		return Value{typ: "error", str: "WRONGTYPE Operation against a key holding the wrong kind of value"}
+	}
+
+	LISTsMu.RLock()
+	defer LISTsMu.RUnlock()
+
+	list := LISTs[key]
+	if index < 0 {
+		index += len(list)
+	}
+	if index < 0 || index >= len(list) {
+		return Value{typ: "null"}
+	}
+
+	touch(key)
+
+	return Value{typ: "bulk", bulk: list[index]}
+}
@@ -0,0 +1,12 @@
+package main
+
+// port is the TCP port the server listens on, 6379 by default like Redis. Another port
+// lets a replica run on the same host as its master. It can only be set on startup, and
+// is protected by the ConfigMu mutex.
+var port = 6379
+
+// tcpBacklog is the length of the queue of connections the kernel accepts on behalf of
+// the server before it accepts them itself, or 0 to keep the system default. A larger
+// queue keeps bursts of new connections from being dropped. It can only be set on
+// startup, and is protected by the ConfigMu mutex.
+var tcpBacklog = 0
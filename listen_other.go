@@ -0,0 +1,13 @@
+//go:build !unix
+
+package main
+
+import "net"
+
+// listen listens for TCP connections on addr with the default socket options.
+//
+// NOTE: tcp-backlog is ignored on systems other than Unix, where the backlog cannot be
+// changed once the socket listens, so the system default is always used.
+func listen(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
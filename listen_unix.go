@@ -0,0 +1,44 @@
+//go:build unix
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// listen listens for TCP connections on addr. Go sets SO_REUSEADDR on the socket before
+// binding it, so the server can restart while connections from its previous run are
+// still in TIME_WAIT. If tcp-backlog is set, the backlog is changed to it afterwards by
+// calling listen on the socket again, which Linux and macOS allow.
+func listen(addr string) (net.Listener, error) {
+	ConfigMu.RLock()
+	backlog := tcpBacklog
+	ConfigMu.RUnlock()
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if backlog == 0 {
+		return l, nil
+	}
+
+	c, err := l.(*net.TCPListener).SyscallConn()
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	var backlogErr error
+	if err := c.Control(func(fd uintptr) { backlogErr = syscall.Listen(int(fd), backlog) }); err != nil {
+		backlogErr = err
+	}
+	if backlogErr != nil {
+		l.Close()
+		return nil, backlogErr
+	}
+
+	return l, nil
+}
@@ -1,79 +1,298 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"net"
+	"os"
+	"os/signal"
 	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
-// main is the entry point for the Redis-compatible server. It listens on port :6379 for incoming connections,
-// reads commands from the connection, and executes the appropriate handler for the command. It also reads
-// commands from an append-only file (AOF) and replays them on startup.
+// main is the entry point for the Redis-compatible server. It listens on the configured port, :6379 by default, for incoming connections,
+// reads commands from the connection, and executes the appropriate handler for the command. On startup it
+// loads the last snapshot, if any, and then replays the commands from the append-only file (AOF) that were
+// executed after it. Connections are accepted while the data is loading, but most commands are refused with
+// a LOADING error until it is done, so clients can tell a server that is starting up from one that is down.
+// It runs until it receives SIGINT or SIGTERM, and then shuts down cleanly, removing its pidfile, if any.
 func main() {
-	fmt.Println("Listening on port :6379")
+	// Every configuration parameter can also be set with a command-line flag of the same name.
+	registerConfigFlags()
+	flag.Parse()
 
-	// Listen listens on the default Redis port (:6379) for incoming TCP connections.
- 	// If an error occurs while listening, it is printed to the console and the program exits.
- l, err := net.Listen("tcp", ":6379")
+	ConfigMu.RLock()
+	addr := fmt.Sprintf(":%d", port)
+	ConfigMu.RUnlock()
+
+	fmt.Println("Listening on port " + addr)
+
+	// listen listens on the configured port, the default Redis port (:6379) unless set, for incoming TCP
+	// connections, with the configured tcp-backlog. If an error occurs while listening, it is printed to the
+	// console and the program exits.
+	l, err := listen(addr)
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
 
+	// writePidFile writes the process ID to the configured pidfile, which is removed again on shutdown.
+	if err := writePidFile(); err != nil {
+		fmt.Println("Error writing the PID file: ", err)
+		return
+	}
+	defer removePidFile()
+
 	// NewAof creates a new append-only file (AOF) at the specified path. If the file does not exist, it is created.
 	// If an error occurs while opening or creating the file, it is returned.
 	// The AOF is used to store and replay commands executed by the Redis-compatible server.
- aof, err := NewAof("database.aof")
+	aof, err := NewAof("database.aof")
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
 	defer aof.Close()
 
-	// aof.Read reads commands from the append-only file (AOF) and executes them. For each command read from the AOF:
-	// - The command name is extracted from the first element of the command array.
-	// - The command arguments are extracted from the remaining elements of the command array.
-	// - The appropriate command handler is looked up in the Handlers map.
-	// - If the command handler is found, it is called with the extracted arguments.
-	// - If the command handler is not found, an error message is printed.
- aof.Read(func(value Value) {
-		command := strings.ToUpper(value.array[0].bulk)
-		args := value.array[1:]
-
-		handler, ok := Handlers[command]
-		if !ok {
-			fmt.Println("Invalid command: ", command)
-			return
-		}
+	// serve accepts connections in the background from now on, while the data is loading.
+	atomic.StoreInt32(&loading, 1)
+	go serve(l, aof)
+
+	// LoadSnapshot restores the data set from the last snapshot, which is the base state the AOF applies to.
+	// The AOF is rewritten every time a snapshot is saved, so it only holds the commands executed since then.
+	// If the snapshot cannot be read, the server exits rather than start with partial data.
+	ConfigMu.RLock()
+	path := dbFilename
+	ConfigMu.RUnlock()
+
+	id, err := LoadSnapshot(path, replay)
+	if err != nil {
+		fmt.Println("Error loading snapshot: ", err)
+		return
+	}
+
+	// matchSnapshot replaces an AOF left over from before the snapshot by a crash, whose commands are already in it.
+	if err := aof.matchSnapshot(id); err != nil {
+		fmt.Println("Error matching the AOF to the snapshot: ", err)
+		return
+	}
+
+	// aof.Read reads the commands from the append-only file (AOF) and replays them on top of the snapshot.
+	// If the AOF cannot be read, the server exits as well, rather than start without the commands after the error.
+	if err := aof.Read(replay); err != nil {
+		fmt.Println("Error reading the AOF: ", err)
+		return
+	}
+
+	// From now on every snapshot rewrites the AOF.
+	snapshotAof = aof
+
+	// Every command is accepted from now on.
+	atomic.StoreInt32(&loading, 0)
+
+	// startSaveTimer writes a snapshot in the background whenever one of the save points is met,
+	// and rewrites the AOF once it grows past the auto-aof-rewrite thresholds.
+	startSaveTimer(aof)
 
-		handler(args)
-	})
+	// startExpireSweeper deletes expired keys in the background, so keys that are never accessed again
+	// do not stay in memory.
+	startExpireSweeper(aof)
+
+	// The connections are served by serve, so main only has to keep the process running until it is
+	// interrupted or terminated. Returning runs the deferred calls, which remove the PID file and close
+	// the AOF, syncing it to disk first.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+
+	fmt.Println("Shutting down")
+}
+
+// serve accepts incoming TCP connections on the listener l. Each connection is served by its own
+// goroutine, so a slow or idle client does not block the others. If an error occurs while accepting
+// a connection, it is printed to the console and the server keeps accepting.
+// TCP keepalive is enabled on every connection, so that peers that went away without closing it,
+// e.g. behind a load balancer, are eventually detected and their connection closed.
+// If connection-workers is set, at most that many connections are served at once: a slot is taken
+// before accepting, so connections beyond the cap wait in the listen backlog until one is closed.
+func serve(l net.Listener, aof *Aof) {
+	ConfigMu.RLock()
+	workers := connectionWorkers
+	ConfigMu.RUnlock()
+
+	var slots chan struct{}
+	if workers > 0 {
+		slots = make(chan struct{}, workers)
+	}
+
+	for {
+		if slots != nil {
+			slots <- struct{}{}
+		}
 
-	// Accept accepts an incoming TCP connection on the listener l. If an error occurs while accepting the connection,
-	// it is printed to the console and the function returns.
-	conn, err := l.Accept()
+		conn, err := l.Accept()
 		if err != nil {
 			fmt.Println(err)
-			return
+			if slots != nil {
+				<-slots
+			}
+			continue
+		}
+
+		if err := setKeepAlive(conn); err != nil {
+			fmt.Println("Error enabling TCP keepalive: ", err)
 		}
 
+		go func() {
+			handleConnection(conn, aof)
+			if slots != nil {
+				<-slots
+			}
+		}()
+	}
+}
+
+// connectionWorkers is the maximum number of connections served at the same time, or 0
+// for no limit, in which case every connection gets its own goroutine as soon as it is
+// accepted. It can only be set on startup, and is protected by the ConfigMu mutex.
+//
+// NOTE: Idle connections keep their slot, so with a low cap a few idle clients can
+// starve the others until they disconnect.
+var connectionWorkers = 0
+
+// readOnly makes the server refuse every command in WriteCommands, so it can serve as a
+// read replica or a protected cache. It is protected by the ConfigMu mutex.
+var readOnly = false
+
+// readBufferSize is the size in bytes of the buffer requests are read through, for each
+// connection. The default is the default size of a bufio.Reader. It only applies to
+// connections accepted after it is changed, and is protected by the ConfigMu mutex.
+var readBufferSize = 4096
+
+// tcpKeepAlive is the TCP keepalive period of client connections in seconds, or 0 to
+// disable keepalive. It is protected by the ConfigMu mutex.
+var tcpKeepAlive = 300
+
+// setKeepAlive enables TCP keepalive with the configured tcp-keepalive period on conn, if
+// it is a TCP connection. A period of 0 disables keepalive instead.
+//
+// NOTE: The period is used both as the idle time before the first probe and as the
+// interval between probes on Linux. Other platforms may only support part of it, e.g.
+// some only let the idle time be changed system-wide, so dead peers can take longer to
+// be detected there.
+func setKeepAlive(conn net.Conn) error {
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+
+	ConfigMu.RLock()
+	seconds := tcpKeepAlive
+	ConfigMu.RUnlock()
+
+	if seconds == 0 {
+		return tcp.SetKeepAlive(false)
+	}
+
+	if err := tcp.SetKeepAlive(true); err != nil {
+		return err
+	}
+
+	return tcp.SetKeepAlivePeriod(time.Duration(seconds) * time.Second)
+}
+
+// replay executes a command read from a snapshot or from the append-only file (AOF) on startup:
+// - Values that are not arrays, such as simple-string replies in a hand-edited file, are not commands,
+// so they are logged and skipped. Empty arrays, e.g. from a partially corrupted file, are skipped too.
+// - The command name is extracted from the first element of the command array.
+// - The command arguments are extracted from the remaining elements of the command array.
+// - The appropriate command handler is looked up in the Handlers map.
+// - If the command handler is found, it is called with the extracted arguments.
+// - If the command handler is not found, an error message is printed.
+func replay(value Value) {
+	if value.typ != "array" {
+		fmt.Println("Skipping non-command value of type: ", value.typ)
+		return
+	}
+
+	if len(value.array) == 0 {
+		fmt.Println("Skipping empty array")
+		return
+	}
+
+	command := strings.ToUpper(value.array[0].bulk)
+	args := value.array[1:]
+
+	handler, ok := Handlers[command]
+	if !ok {
+		fmt.Println("Invalid command: ", command)
+		return
+	}
+
+	handler(args)
+}
+
+// handleConnection is the main loop for a single client connection. It reads requests from the client,
+// processes the commands, and writes the responses back to the client until the connection is closed.
+// For each request:
+// - The request is read from the connection using the connection's Resp. If it is not valid RESP, such as a value
+// with an unknown type byte or an invalid length, the protocol error is sent to the client and the connection is
+// closed, like Redis does, since the requests that follow cannot be told apart reliably. Bulk strings longer than
+// proto-max-bulk-len are refused the same way, and so are requests whose bulk strings add up to more than
+// client-query-buffer-limit.
+// - Requests that are not a non-empty array are logged and skipped.
+// - If a DEBUG SLEEP GLOBAL is in progress, the command waits for it to end with waitForStall().
+// - The command is executed with execute(), and the result is written back to the client using session.Write(),
+// unless the handler already wrote its own replies.
+// - After QUIT has been replied to, the connection is closed.
+// - If the result cannot be written, the client has gone away, so the error is logged and the connection is closed
+// instead of processing commands whose replies can never be delivered.
+func handleConnection(conn net.Conn, aof *Aof) {
 	// Close the connection when the function returns.
 	defer conn.Close()
 
-	// The main loop of the Redis-compatible server. It reads requests from the client connection,
-	// processes the commands, and writes the responses back to the client.
-	// For each request:
-	// - The request is read from the connection using NewResp().
-	// - The command name and arguments are extracted from the request.
-	// - The appropriate command handler is looked up in the Handlers map.
-	// - If the command handler is found, it is called with the extracted arguments, and the result is written back to the client using NewWriter().
-	// - If the command handler is not found, an error message is written back to the client.
-	// - If the command is "SET" or "HSET", the request is also written to the append-only file (AOF) using aof.Write().
- 	for {
-		resp := NewResp(conn)
+	session := NewSession(conn)
+	session.Register()
+	defer session.Unregister()
+	defer session.unsubscribeAll()
+	defer session.stopMonitor()
+	defer session.stopPusher()
+
+	// The Resp is created once per connection so that pipelined requests buffered
+	// by the reader are not discarded between commands.
+	ConfigMu.RLock()
+	size := readBufferSize
+	ConfigMu.RUnlock()
+
+	resp := NewRespSize(conn, size)
+	session.resp = resp
+	defer session.cancel()
+
+	for {
+		// the limits are read for every request, so changing them applies to open connections too
+		resp.maxBulk = maxBulkLen()
+		resp.maxRequest = queryBufferLimit()
+		resp.read = 0
+
 		value, err := resp.Read()
 		if err != nil {
 			fmt.Println(err)
+
+			// a malformed request is reported to the client before the connection is closed,
+			// since the rest of the stream cannot be parsed reliably
+			var perr protocolError
+			if errors.As(err, &perr) {
+				session.Write(Value{typ: "error", str: perr.Error()})
+			}
+
+			// the client stopped in the middle of a request, such as a bulk string shorter
+			// than its declared length, which is a protocol error rather than a clean close
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				session.Write(Value{typ: "error", str: "ERR Protocol error: unexpected end of request"})
+			}
 			return
 		}
 
@@ -87,23 +306,164 @@ func main() {
 			continue
 		}
 
-		command := strings.ToUpper(value.array[0].bulk)
-		args := value.array[1:]
-
-		writer := NewWriter(conn)
+		waitForStall()
 
-		handler, ok := Handlers[command]
-		if !ok {
-			fmt.Println("Invalid command: ", command)
-			writer.Write(Value{typ: "string", str: ""})
+		result := execute(session, aof, value)
+		if result.typ == "none" {
 			continue
 		}
 
-		if command == "SET" || command == "HSET" {
-			aof.Write(value)
+		if err := session.Write(result); err != nil {
+			fmt.Println("Error writing reply: ", err)
+			return
+		}
+
+		if session.quit {
+			return
+		}
+	}
+}
+
+// execute runs a single request for the session and returns the reply to send back to the client.
+// - The command name and arguments are extracted from the request.
+// - While the data is loading on startup, only the loadingCommands are allowed, so the others are not run
+// against a partial data set.
+// - If the session is subscribed to a channel or pattern, only the subscribeModeCommands are allowed.
+// - If the session is inside a MULTI block and the command is not a transaction command, the request is queued,
+// unless queueCheck() refuses it, which makes EXEC abort the transaction.
+// - Otherwise the request is sent to the connections in MONITOR mode with feedMonitors().
+// - EXEC runs the queued requests through execute() and returns their replies as an array.
+// - If the command is in BlockingHandlers, it is called with the Session and the AOF, and writes its own
+// changes to the AOF, unless the server is in read-only mode.
+// - If the command is in SessionHandlers, it is called with the connection's Session and the arguments.
+// - Otherwise the appropriate command handler is looked up in the Handlers map and called with the arguments.
+// - If the command handler is not found, an error message is returned.
+// - If the server is in read-only mode, commands in WriteCommands are refused.
+// - Expired keys among the arguments are deleted with expireArgs() before the command runs, and the expired fields
+// of the hashes among them with expireFields().
+// - If the command is in WriteCommands, the persistMu read lock is held until it has run, so a snapshot
+// cannot discard the AOF between the command being appended and applied.
+// - If the command is in WriteCommands, keys are evicted if maxmemory is reached, and an OOM error is returned
+// if not enough memory could be freed, unless the command is one of the freeingCommands.
+// - If the command is in WriteCommands, the request is also written to the append-only file (AOF) using
+// session.propagate(), which defers it to the end of EXEC inside a transaction, and the dirty counter used by the
+// save points is incremented. The applyMu mutex is held from then until the command has run, so commands are
+// appended in the order they change the data. Inside a transaction, EXEC holds both persistMu and applyMu for all
+// of its commands instead, so they are applied and appended without other writes in between. EXPIRE is written as PEXPIREAT with absoluteExpiry(), so its expiry does not move on replay,
+// and it is executed as that PEXPIREAT too, so the expiry in memory and in the AOF are the same. HEXPIRE is written and
+// executed as HPEXPIREAT the same way, and HGETEX is rewritten to an absolute PXAT time.
+// - The handler changes the data before execute returns, even when the AOF only queues the request with
+// aof-write-queue, so the reply is only sent once the change is visible to every later command and a connection
+// always reads its own writes.
+// - The call and its execution time are recorded in CommandStats.
+// - If the command is in WriteCommands and changed the data, its keyspace event is published with notifyCommand().
+func execute(session *Session, aof *Aof, value Value) Value {
+	command := strings.ToUpper(value.array[0].bulk)
+	args := value.array[1:]
+
+	if atomic.LoadInt32(&loading) == 1 && !loadingCommands[command] {
+		return Value{typ: "error", str: "LOADING Redis is loading the dataset in memory"}
+	}
+
+	if session.inSubscribeMode() && !subscribeModeCommands[command] {
+		return Value{typ: "error", str: "ERR Can't execute '" + strings.ToLower(command) + "': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT / RESET are allowed in subscribe mode"}
+	}
+
+	if session.inMulti && !transactionCommands[command] {
+		if err, ok := queueCheck(value.array); !ok {
+			session.queueFailed = true
+			return err
+		}
+
+		session.queued = append(session.queued, value)
+		return Value{typ: "string", str: "QUEUED"}
+	}
+
+	feedMonitors(session, value)
+
+	if command == "EXEC" {
+		return session.exec(aof, func(value Value) Value {
+			return execute(session, aof, value)
+		})
+	}
+
+	ConfigMu.RLock()
+	rejectWrites := readOnly
+	ConfigMu.RUnlock()
+
+	if blockingHandler, ok := BlockingHandlers[command]; ok {
+		if rejectWrites {
+			return Value{typ: "error", str: "READONLY You can't write against a read only replica."}
+		}
+
+		start := time.Now()
+		result := blockingHandler(session, aof, args)
+		recordCommand(command, time.Since(start))
+
+		return result
+	}
+
+	if sessionHandler, ok := SessionHandlers[command]; ok {
+		start := time.Now()
+		result := sessionHandler(session, args)
+		recordCommand(command, time.Since(start))
+
+		return result
+	}
+
+	handler, ok := Handlers[command]
+	if !ok {
+		fmt.Println("Invalid command: ", command)
+		return Value{typ: "string", str: ""}
+	}
+
+	if WriteCommands[command] && rejectWrites {
+		return Value{typ: "error", str: "READONLY You can't write against a read only replica."}
+	}
+
+	expireArgs(session, aof, args)
+	expireFields(session, aof, args)
+
+	// EXEC holds both persistMu and applyMu for the whole transaction
+	inTx := session.inTx()
+
+	if WriteCommands[command] && !inTx {
+		persistMu.RLock()
+		defer persistMu.RUnlock()
+	}
+
+	if WriteCommands[command] && !freeMemoryIfNeeded(session, aof) && !freeingCommands[command] {
+		return Value{typ: "error", str: "OOM command not allowed when used memory > 'maxmemory'."}
+	}
+
+	if WriteCommands[command] {
+		// EXPIRE and HEXPIRE run as the PEXPIREAT and HPEXPIREAT they are written as, and
+		// HGETEX with the PXAT time it is written with, so the expiry in memory is exactly the one that is replayed
+		value = absoluteExpiry(value)
+		handler = Handlers[strings.ToUpper(value.array[0].bulk)]
+		args = value.array[1:]
+
+		if !inTx {
+			applyMu.Lock()
+			defer applyMu.Unlock()
 		}
 
-		result := handler(args)
-		writer.Write(result)
+		session.propagate(aof, value)
+		atomic.AddInt64(&dirty, 1)
 	}
-}
\ No newline at end of file
+
+	var keys []string
+	if WriteCommands[command] {
+		keys = eventKeys(value.array)
+	}
+
+	start := time.Now()
+	result := handler(args)
+	recordCommand(command, time.Since(start))
+
+	if WriteCommands[command] {
+		notifyCommand(command, keys, result)
+	}
+
+	return result
+}
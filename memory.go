@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// memory is a command handler for the MEMORY command, which reports the estimated memory
+// used by the data set. It takes a subcommand as its first argument:
+// - USAGE <key> [SAMPLES <count>]: returns the estimated number of bytes used by the key
+// and its value, including the overhead of the key and of every entry stored in it. The
+// whole value is always counted, so SAMPLES is accepted for compatibility but ignored.
+// If the key does not exist, it returns a null value.
+// - DOCTOR: returns a human readable report on the memory used by the data set.
+// - HELP: returns an array of lines describing the subcommands.
+// If the subcommand is unknown or has the wrong number of arguments, it returns an error.
+// The sizes are estimated the same way as for maxmemory, see keySizes.
+func memory(args []Value) Value {
+	if len(args) == 0 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'memory' command"}
+	}
+
+	subcommand := strings.ToUpper(args[0].bulk)
+	args = args[1:]
+
+	switch subcommand {
+	case "HELP":
+		return helpReply("MEMORY",
+			"DOCTOR",
+			"    Return memory problems reports.",
+			"USAGE <key> [SAMPLES <count>]",
+			"    Return memory in bytes used by <key> and its value.",
+		)
+	case "USAGE":
+		if len(args) != 1 && len(args) != 3 {
+			return Value{typ: "error", str: "ERR wrong number of arguments for 'memory|usage' command"}
+		}
+
+		if len(args) == 3 {
+			if strings.ToUpper(args[1].bulk) != "SAMPLES" {
+				return Value{typ: "error", str: "ERR syntax error"}
+			}
+			if n, err := strconv.Atoi(args[2].bulk); err != nil || n < 0 {
+				return Value{typ: "error", str: "ERR value is not an integer or out of range"}
+			}
+		}
+
+		size, ok := keySize(args[0].bulk)
+		if !ok {
+			return Value{typ: "null"}
+		}
+
+		return Value{typ: "integer", num: int(size)}
+	case "DOCTOR":
+		if len(args) != 0 {
+			return Value{typ: "error", str: "ERR wrong number of arguments for 'memory|doctor' command"}
+		}
+
+		return Value{typ: "bulk", bulk: memoryDoctor()}
+	default:
+		return Value{typ: "error", str: "ERR unknown subcommand '" + subcommand + "'"}
+	}
+}
+
+// memoryDoctor returns the report of MEMORY DOCTOR. It compares the estimated memory
+// used by the data set with maxmemory, and points out the largest key if it holds a
+// large share of the data set.
+func memoryDoctor() string {
+	ConfigMu.RLock()
+	limit := maxMemory
+	policy := maxMemoryPolicy
+	ConfigMu.RUnlock()
+
+	sizes := keySizes()
+	if len(sizes) == 0 {
+		return "The data set is empty, so there is no memory issue to report."
+	}
+
+	var used, largest int64
+	largestKey := ""
+	for key, size := range sizes {
+		used += size
+		if size > largest || (size == largest && key < largestKey) {
+			largest, largestKey = size, key
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "The data set holds %d keys using about %s.", len(sizes), humanBytes(used))
+
+	problems := 0
+	if limit > 0 && used*10 >= limit*9 {
+		fmt.Fprintf(&b, "\n* The data set uses %d%% of maxmemory (%s).", used*100/limit, humanBytes(limit))
+		if policy == "noeviction" {
+			b.WriteString(" Write commands are refused while it is exceeded, consider an eviction policy or a higher maxmemory.")
+		} else {
+			b.WriteString(" Keys are evicted with the " + policy + " policy while it is exceeded.")
+		}
+		problems++
+	}
+
+	if len(sizes) > 1 && largest*2 > used {
+		fmt.Fprintf(&b, "\n* The key '%s' alone uses %s, more than half of the data set.", largestKey, humanBytes(largest))
+		problems++
+	}
+
+	if problems == 0 {
+		b.WriteString(" I can't find any memory issue.")
+	}
+
+	return b.String()
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Monitors is the set of sessions that issued MONITOR and receive every command
+// processed by the server.
+var Monitors = map[*Session]struct{}{}
+
+// MonitorsMu is a read-write mutex that protects access to the Monitors map.
+var MonitorsMu = sync.RWMutex{}
+
+// monitorCount is the number of sessions in Monitors. It is read atomically by
+// feedMonitors, so commands are not formatted at all while no one is monitoring.
+var monitorCount int64
+
+// monitor is a command handler that puts the session into monitor mode: from then on
+// every command executed by any client is streamed to it, formatted by
+// monitorLine. The mode lasts until the connection is closed or RESET is issued.
+// It returns "OK".
+//
+// NOTE: While at least one monitor is connected, every command is formatted and
+// written to every monitor from the goroutine of the client that issued it, so a slow
+// monitor slows down all the other clients.
+func monitor(s *Session, args []Value) Value {
+	if len(args) != 0 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'monitor' command"}
+	}
+
+	MonitorsMu.Lock()
+	if _, ok := Monitors[s]; !ok {
+		Monitors[s] = struct{}{}
+		atomic.AddInt64(&monitorCount, 1)
+	}
+	MonitorsMu.Unlock()
+
+	return Value{typ: "string", str: "OK"}
+}
+
+// stopMonitor takes the session out of monitor mode, if it is in it. It is used by
+// RESET and when the connection is closed.
+func (s *Session) stopMonitor() {
+	MonitorsMu.Lock()
+	if _, ok := Monitors[s]; ok {
+		delete(Monitors, s)
+		atomic.AddInt64(&monitorCount, -1)
+	}
+	MonitorsMu.Unlock()
+}
+
+// feedMonitors sends the request issued by the session to every monitor as a simple
+// string. It returns immediately if there are no monitors.
+func feedMonitors(s *Session, value Value) {
+	if atomic.LoadInt64(&monitorCount) == 0 {
+		return
+	}
+
+	line := Value{typ: "string", str: monitorLine(time.Now(), s, value)}
+
+	MonitorsMu.RLock()
+	monitors := make([]*Session, 0, len(Monitors))
+	for m := range Monitors {
+		monitors = append(monitors, m)
+	}
+	MonitorsMu.RUnlock()
+
+	for _, m := range monitors {
+		m.Write(line)
+	}
+}
+
+// monitorLine formats a request the way Redis does for MONITOR: the Unix time with
+// microseconds, the database number and the client address in brackets, and then the
+// quoted command and arguments, e.g.
+// 1339518083.107412 [0 127.0.0.1:60866] "set" "key" "value".
+// There is a single database, so the number is always 0.
+func monitorLine(t time.Time, s *Session, value Value) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d.%06d [0 %s]", t.Unix(), t.Nanosecond()/1000, s.conn.RemoteAddr())
+	for _, arg := range value.array {
+		b.WriteByte(' ')
+		b.WriteString(quoteArg(arg.bulk))
+	}
+
+	return b.String()
+}
+
+// quoteArg returns s in double quotes, escaping quotes, backslashes and non-printable
+// bytes, so the monitor line stays on a single line whatever the arguments contain.
+func quoteArg(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\\', '"':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\a':
+			b.WriteString(`\a`)
+		case '\b':
+			b.WriteString(`\b`)
+		default:
+			if c < 0x20 || c >= 0x7f {
+				fmt.Fprintf(&b, `\x%02x`, c)
+			} else {
+				b.WriteByte(c)
+			}
+		}
+	}
+	b.WriteByte('"')
+
+	return b.String()
+}
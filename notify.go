@@ -0,0 +1,213 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+// The classes of keyspace events, which notify-keyspace-events enables with one character
+// each, like in Redis. notifyKeyspace and notifyKeyevent select the channels the events
+// are published to, and the others the events themselves.
+const (
+	notifyKeyspace = 1 << iota // K
+	notifyKeyevent             // E
+	notifyGeneric              // g
+	notifyString               // $
+	notifyList                 // l
+	notifySet                  // s
+	notifyHash                 // h
+	notifyZset                 // z
+	notifyExpired              // x
+	notifyEvicted              // e
+
+	// notifyAll is the class of every event, which A stands for.
+	notifyAll = notifyGeneric | notifyString | notifyList | notifySet | notifyHash | notifyZset | notifyExpired | notifyEvicted
+)
+
+// notifyClasses maps the characters of notify-keyspace-events to their classes, in the
+// order they are reported by CONFIG GET.
+var notifyClasses = []struct {
+	char  byte
+	class int
+}{
+	{'g', notifyGeneric},
+	{'$', notifyString},
+	{'l', notifyList},
+	{'s', notifySet},
+	{'h', notifyHash},
+	{'z', notifyZset},
+	{'x', notifyExpired},
+	{'e', notifyEvicted},
+	{'K', notifyKeyspace},
+	{'E', notifyKeyevent},
+}
+
+// notifyKeyspaceEvents is the set of keyspace event classes that are published, or 0 to
+// publish none, which is the default since every write command then has to publish. It is
+// protected by the ConfigMu mutex.
+var notifyKeyspaceEvents = 0
+
+// parseNotifyFlags parses the value of notify-keyspace-events, where every character
+// enables a class of events, and A enables every class of events except K and E.
+func parseNotifyFlags(value string) (int, error) {
+	flags := 0
+	for i := 0; i < len(value); i++ {
+		if value[i] == 'A' {
+			flags |= notifyAll
+			continue
+		}
+
+		found := false
+		for _, c := range notifyClasses {
+			if c.char == value[i] {
+				flags |= c.class
+				found = true
+			}
+		}
+		if !found {
+			return 0, errors.New("argument must only contain the characters A, g, $, l, s, h, z, x, e, K and E")
+		}
+	}
+
+	return flags, nil
+}
+
+// formatNotifyFlags returns the value of notify-keyspace-events for the given classes,
+// using A when every class of events is enabled.
+func formatNotifyFlags(flags int) string {
+	var b strings.Builder
+	for _, c := range notifyClasses {
+		if c.class&notifyAll != 0 && flags&notifyAll == notifyAll {
+			continue
+		}
+		if flags&c.class != 0 {
+			b.WriteByte(c.char)
+		}
+	}
+
+	s := b.String()
+	if flags&notifyAll == notifyAll {
+		s = "A" + s
+	}
+
+	return s
+}
+
+// keyspaceEvent is the event a write command notifies, with its class. Commands with
+// every key set are notified for all their keys that exist before they run, and the
+// others for their first key only, such as the destination of SINTERSTORE.
+type keyspaceEvent struct {
+	class int
+	name  string
+	every bool
+}
+
+// commandEvents maps the write commands to the keyspace events they notify, using the
+// same event names as Redis. Commands that are not in it notify nothing, such as
+// FLUSHALL, or publish their events themselves, such as MSETNX, which notifies every key
+// it sets, and HGETEX, whose event depends on what it did to the expiry of the fields.
+var commandEvents = map[string]keyspaceEvent{
+	"DEL":       {notifyGeneric, "del", true},
+	"UNLINK":    {notifyGeneric, "del", true},
+	"GETDEL":    {notifyGeneric, "del", false},
+	"EXPIRE":    {notifyGeneric, "expire", false},
+	"PEXPIREAT": {notifyGeneric, "expire", false},
+	"PERSIST":   {notifyGeneric, "persist", false},
+
+	"SET":      {notifyString, "set", false},
+	"SETBIT":   {notifyString, "setbit", false},
+	"SETRANGE": {notifyString, "setrange", false},
+	"APPEND":   {notifyString, "append", false},
+	"BITOP":    {notifyString, "set", false},
+
+	"HSET":       {notifyHash, "hset", false},
+	"HGETDEL":    {notifyHash, "hdel", false},
+	"HEXPIRE":    {notifyHash, "hexpire", false},
+	"HPEXPIREAT": {notifyHash, "hexpire", false},
+
+	"LPUSH": {notifyList, "lpush", false},
+	"RPUSH": {notifyList, "rpush", false},
+	"LPOP":  {notifyList, "lpop", false},
+	"RPOP":  {notifyList, "rpop", false},
+	"LTRIM": {notifyList, "ltrim", false},
+
+	"SADD":        {notifySet, "sadd", false},
+	"SREM":        {notifySet, "srem", false},
+	"SINTERSTORE": {notifySet, "sinterstore", false},
+	"SUNIONSTORE": {notifySet, "sunionstore", false},
+	"SDIFFSTORE":  {notifySet, "sdiffstore", false},
+
+	"ZADD":            {notifyZset, "zadd", false},
+	"ZINCRBY":         {notifyZset, "zincr", false},
+	"ZREM":            {notifyZset, "zrem", false},
+	"ZREMRANGEBYRANK": {notifyZset, "zremrangebyrank", false},
+}
+
+// notify publishes a keyspace event for key, if its class is enabled: the event name to
+// the __keyspace@0__:<key> channel with K, and the key to the __keyevent@0__:<event>
+// channel with E. The messages go through PUBLISH, so pattern subscribers get them too.
+func notify(class int, event, key string) {
+	ConfigMu.RLock()
+	flags := notifyKeyspaceEvents
+	ConfigMu.RUnlock()
+
+	if flags&class == 0 {
+		return
+	}
+
+	if flags&notifyKeyspace != 0 {
+		publish([]Value{{typ: "bulk", bulk: "__keyspace@0__:" + key}, {typ: "bulk", bulk: event}})
+	}
+	if flags&notifyKeyevent != 0 {
+		publish([]Value{{typ: "bulk", bulk: "__keyevent@0__:" + event}, {typ: "bulk", bulk: key}})
+	}
+}
+
+// eventKeys returns the keys a write command, name included, notifies an event for if it
+// succeeds, see commandEvents. It is called before the command runs, so the keys DEL
+// deletes can still be told apart from the missing ones.
+func eventKeys(argv []Value) []string {
+	event, ok := commandEvents[strings.ToUpper(argv[0].bulk)]
+	if !ok {
+		return nil
+	}
+
+	keys := commandKeys(argv)
+	if keys.typ != "array" || len(keys.array) == 0 {
+		return nil
+	}
+
+	if !event.every {
+		return []string{keys.array[0].bulk}
+	}
+
+	names := []string{}
+	for _, key := range keys.array {
+		if keyType(key.bulk) != "none" {
+			names = append(names, key.bulk)
+		}
+	}
+
+	return names
+}
+
+// notifyCommand publishes the keyspace event of a write command for the given keys,
+// found with eventKeys, unless the reply shows that it changed nothing: an error, a null
+// value, or an integer 0.
+func notifyCommand(command string, keys []string, result Value) {
+	event, ok := commandEvents[command]
+	if !ok {
+		return
+	}
+
+	switch {
+	case result.typ == "error", result.typ == "null":
+		return
+	case result.typ == "integer" && result.num == 0:
+		return
+	}
+
+	for _, key := range keys {
+		notify(event.class, event.name, key)
+	}
+}
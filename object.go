@@ -0,0 +1,351 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// accessTimes is a map of keys to the time they were last read or written. It is used
+// to report OBJECT IDLETIME.
+var accessTimes = map[string]time.Time{}
+
+// accessCounters is a map of keys to their LFU access frequency counter. It is used to
+// report OBJECT FREQ and by the allkeys-lfu eviction policy.
+var accessCounters = map[string]lfuCounter{}
+
+// accessTimesMu is a mutex that protects access to the accessTimes and accessCounters
+// maps. It is separate from the map locks so read-only commands can record an access
+// while only holding a read lock on their map.
+var accessTimesMu = sync.Mutex{}
+
+// lfuLogFactor and lfuDecayTime tune the LFU counters like in Redis: the higher the log
+// factor, the more accesses it takes to increment a counter, and a counter is decremented
+// once for every lfuDecayTime minutes without access. They are protected by the
+// ConfigMu mutex.
+var (
+	lfuLogFactor = 10
+	lfuDecayTime = 1
+)
+
+// lfuInitValue is the counter of a key that was just created, so new keys are not
+// evicted before they had a chance to be accessed.
+const lfuInitValue = 5
+
+// lfuCounter is a logarithmic access frequency counter, as used by Redis: it saturates
+// at 255, and its value decays over time when the key is not accessed.
+type lfuCounter struct {
+	value   uint8
+	decayed time.Time
+}
+
+// decay returns the value of the counter at now, decremented once for every
+// decayTime minutes since it was last decayed. A decayTime of 0 disables decay.
+func (c lfuCounter) decay(now time.Time, decayTime int) uint8 {
+	if decayTime == 0 {
+		return c.value
+	}
+
+	periods := int(now.Sub(c.decayed) / (time.Duration(decayTime) * time.Minute))
+	if periods >= int(c.value) {
+		return 0
+	}
+
+	return c.value - uint8(periods)
+}
+
+// increment returns the counter after an access at now. The counter is decayed first,
+// and then incremented with a probability that gets lower as it grows, so it grows
+// logarithmically with the number of accesses.
+func (c lfuCounter) increment(now time.Time, logFactor, decayTime int) lfuCounter {
+	value := c.decay(now, decayTime)
+	if decayTime == 0 || now.Sub(c.decayed) >= time.Duration(decayTime)*time.Minute {
+		c.decayed = now
+	}
+
+	if value < 255 {
+		base := float64(value) - lfuInitValue
+		if base < 0 {
+			base = 0
+		}
+		if randomFloat64() < 1/(base*float64(logFactor)+1) {
+			value++
+		}
+	}
+
+	c.value = value
+
+	return c
+}
+
+// touch records that key was accessed now.
+func touch(key string) {
+	ConfigMu.RLock()
+	logFactor, decayTime := lfuLogFactor, lfuDecayTime
+	ConfigMu.RUnlock()
+
+	now := time.Now()
+
+	accessTimesMu.Lock()
+	accessTimes[key] = now
+
+	counter, ok := accessCounters[key]
+	if !ok {
+		counter = lfuCounter{value: lfuInitValue, decayed: now}
+	}
+	accessCounters[key] = counter.increment(now, logFactor, decayTime)
+	accessTimesMu.Unlock()
+}
+
+// frequency returns the current LFU access frequency counter of key. Keys that have not
+// been accessed since the server started have a counter of 0.
+func frequency(key string) int {
+	ConfigMu.RLock()
+	decayTime := lfuDecayTime
+	ConfigMu.RUnlock()
+
+	accessTimesMu.Lock()
+	counter, ok := accessCounters[key]
+	accessTimesMu.Unlock()
+
+	if !ok {
+		return 0
+	}
+
+	return int(counter.decay(time.Now(), decayTime))
+}
+
+// forget removes the access time, frequency and expiry of key, once it has been deleted,
+// so a new key with the same name starts afresh.
+func forget(key string) {
+	accessTimesMu.Lock()
+	delete(accessTimes, key)
+	delete(accessCounters, key)
+	accessTimesMu.Unlock()
+
+	removeExpiry(key)
+}
+
+// forgetAll removes the access times, frequencies and expiries of every key, once the
+// whole data set has been deleted.
+func forgetAll() {
+	accessTimesMu.Lock()
+	accessTimes = map[string]time.Time{}
+	accessCounters = map[string]lfuCounter{}
+	accessTimesMu.Unlock()
+
+	expiresMu.Lock()
+	expires = map[string]time.Time{}
+	expiresMu.Unlock()
+}
+
+// idleTime returns how long ago key was last accessed. Keys that have not been
+// accessed since the server started are reported as idle since startup.
+func idleTime(key string) time.Duration {
+	accessTimesMu.Lock()
+	last, ok := accessTimes[key]
+	accessTimesMu.Unlock()
+
+	if !ok {
+		last = startTime
+	}
+
+	return time.Since(last)
+}
+
+// The thresholds below which collections are reported with a compact encoding, using the
+// same names and defaults as Redis. They are protected by the ConfigMu mutex.
+var (
+	hashMaxListpackEntries = 128
+	hashMaxListpackValue   = 64
+	listMaxListpackSize    = 128
+	setMaxIntsetEntries    = 512
+	setMaxListpackEntries  = 128
+	setMaxListpackValue    = 64
+	zsetMaxListpackEntries = 128
+	zsetMaxListpackValue   = 64
+)
+
+// objectEncoding returns the name of the encoding Redis would use for the value stored
+// at key, based on its current size. Strings that are integers are "int", other strings
+// of up to 44 bytes are "embstr" and longer ones "raw". Hashes, lists, sets and sorted
+// sets within the configured thresholds are "listpack", and sets of integers within
+// set-max-intset-entries are "intset". Larger hashes and sets are "hashtable", larger
+// lists are "quicklist", and larger sorted sets are "skiplist". The thresholds are read
+// on every call, so a CONFIG SET applies to the next check. It returns an empty string if
+// the key does not exist.
+//
+// NOTE: Redis only converts an encoding one way, e.g. from "intset" to "listpack" or
+// "hashtable" once a member that is not an integer is added, and keeps it even if that
+// member is removed again. Values are always stored in maps here, so the encoding is
+// computed from the current contents instead, and such a set reports "intset" again.
+func objectEncoding(key string) string {
+	ConfigMu.RLock()
+	hashEntries, hashValue := hashMaxListpackEntries, hashMaxListpackValue
+	listSize := listMaxListpackSize
+	intsetEntries, setEntries, setValue := setMaxIntsetEntries, setMaxListpackEntries, setMaxListpackValue
+	zsetEntries, zsetValue := zsetMaxListpackEntries, zsetMaxListpackValue
+	ConfigMu.RUnlock()
+
+	switch keyType(key) {
+	case "string":
+		SETsMu.RLock()
+		value := SETs[key]
+		length := len(value)
+		integer := isInteger(string(value))
+		SETsMu.RUnlock()
+
+		if integer {
+			return "int"
+		}
+		if length <= 44 {
+			return "embstr"
+		}
+		return "raw"
+	case "hash":
+		HSETsMu.RLock()
+		defer HSETsMu.RUnlock()
+
+		hash := HSETs[key]
+		if len(hash) > hashEntries {
+			return "hashtable"
+		}
+		for field, value := range hash {
+			if len(field) > hashValue || len(value) > hashValue {
+				return "hashtable"
+			}
+		}
+		return "listpack"
+	case "list":
+		LISTsMu.RLock()
+		length := len(LISTs[key])
+		LISTsMu.RUnlock()
+
+		if length > listSize {
+			return "quicklist"
+		}
+		return "listpack"
+	case "set":
+		SSETsMu.RLock()
+		defer SSETsMu.RUnlock()
+
+		set := SSETs[key]
+		if len(set) <= intsetEntries && allIntegers(set) {
+			return "intset"
+		}
+		if len(set) > setEntries {
+			return "hashtable"
+		}
+		for member := range set {
+			if len(member) > setValue {
+				return "hashtable"
+			}
+		}
+		return "listpack"
+	case "zset":
+		ZSETsMu.RLock()
+		defer ZSETsMu.RUnlock()
+
+		zset := ZSETs[key]
+		if len(zset) > zsetEntries {
+			return "skiplist"
+		}
+		for member := range zset {
+			if len(member) > zsetValue {
+				return "skiplist"
+			}
+		}
+		return "listpack"
+	default:
+		return ""
+	}
+}
+
+// allIntegers reports whether every member of the set is a 64-bit integer in canonical
+// form, which is what Redis stores in an intset.
+func allIntegers(set map[string]struct{}) bool {
+	for member := range set {
+		if !isInteger(member) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// isInteger reports whether s is a 64-bit integer in canonical form, without a sign
+// other than a leading '-' and without leading zeros, which Redis stores as a number
+// rather than as a string.
+func isInteger(s string) bool {
+	n, err := strconv.ParseInt(s, 10, 64)
+
+	return err == nil && strconv.FormatInt(n, 10) == s
+}
+
+// object is a command handler for the OBJECT command, which inspects the value stored
+// at a key. It takes a subcommand and a key:
+// - REFCOUNT <key>: returns the number of references to the value, which is always 1
+// since values are never shared.
+// - IDLETIME <key>: returns the number of seconds since the key was last read or written.
+// - ENCODING <key>: returns the name of the internal encoding of the value.
+// - FREQ <key>: returns the LFU access frequency counter of the key. It is only
+// available when an LFU maxmemory-policy is selected.
+// - HELP: returns an array of lines describing the subcommands.
+// If the key does not exist, it returns a null value. If the subcommand is unknown or
+// has the wrong number of arguments, it returns an error.
+// Inspecting a key with OBJECT does not count as an access.
+func object(args []Value) Value {
+	if len(args) == 0 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'object' command"}
+	}
+
+	subcommand := strings.ToUpper(args[0].bulk)
+	args = args[1:]
+
+	switch subcommand {
+	case "HELP":
+		return helpReply("OBJECT",
+			"ENCODING <key>",
+			"    Return the kind of internal representation used to store the value",
+			"    associated with <key>.",
+			"FREQ <key>",
+			"    Return the access frequency index of <key>. It is only available when an",
+			"    LFU maxmemory-policy is selected.",
+			"IDLETIME <key>",
+			"    Return the idle time of <key>, in seconds.",
+			"REFCOUNT <key>",
+			"    Return the number of references of the value associated with <key>.",
+		)
+	case "REFCOUNT", "IDLETIME", "ENCODING", "FREQ":
+		if len(args) != 1 {
+			return Value{typ: "error", str: "ERR wrong number of arguments for 'object|" + strings.ToLower(subcommand) + "' command"}
+		}
+	default:
+		return Value{typ: "error", str: "ERR unknown subcommand '" + subcommand + "'"}
+	}
+
+	key := args[0].bulk
+	if keyType(key) == "none" {
+		return Value{typ: "null"}
+	}
+
+	switch subcommand {
+	case "REFCOUNT":
+		return Value{typ: "integer", num: 1}
+	case "ENCODING":
+		return Value{typ: "bulk", bulk: objectEncoding(key)}
+	case "FREQ":
+		ConfigMu.RLock()
+		policy := maxMemoryPolicy
+		ConfigMu.RUnlock()
+
+		if !strings.HasSuffix(policy, "-lfu") {
+			return Value{typ: "error", str: "ERR An LFU maxmemory policy is not selected, access frequency not tracked."}
+		}
+
+		return Value{typ: "integer", num: frequency(key)}
+	default:
+		return Value{typ: "integer", num: int(idleTime(key).Seconds())}
+	}
+}
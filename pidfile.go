@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// pidFile is the path the process ID of the server is written to on startup, and removed
+// from on shutdown, so a service manager can find and signal the server, or "" to write
+// no PID file. It can only be set on startup, and is protected by the ConfigMu mutex.
+var pidFile = ""
+
+// writePidFile writes the process ID of the server to pidFile, followed by a newline
+// like Redis does, unless no PID file is configured.
+func writePidFile() error {
+	ConfigMu.RLock()
+	path := pidFile
+	ConfigMu.RUnlock()
+
+	if path == "" {
+		return nil
+	}
+
+	return os.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+}
+
+// removePidFile removes the PID file written by writePidFile, if any. It is called on a
+// clean shutdown, so a PID file left behind means the server did not stop cleanly.
+func removePidFile() {
+	ConfigMu.RLock()
+	path := pidFile
+	ConfigMu.RUnlock()
+
+	if path == "" {
+		return
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		fmt.Println("Error removing the PID file: ", err)
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Channels is a map of pub/sub channel names to the sessions subscribed to them.
+var Channels = map[string]map[*Session]struct{}{}
+
+// Patterns is a map of glob patterns to the sessions subscribed to them with PSUBSCRIBE.
+var Patterns = map[string]map[*Session]struct{}{}
+
+// ChannelsMu is a read-write mutex that protects access to the Channels and Patterns maps.
+var ChannelsMu = sync.RWMutex{}
+
+// subscribeModeCommands is the set of commands a session can still execute while it is
+// subscribed to at least one channel or pattern.
+var subscribeModeCommands = map[string]bool{
+	"SUBSCRIBE":    true,
+	"PSUBSCRIBE":   true,
+	"UNSUBSCRIBE":  true,
+	"PUNSUBSCRIBE": true,
+	"PING":         true,
+	"QUIT":         true,
+	"RESET":        true,
+}
+
+// noReply is returned by handlers that already wrote their replies to the session,
+// such as SUBSCRIBE, which sends one confirmation per channel.
+var noReply = Value{typ: "none"}
+
+// pubsubBufferSize is the number of pub/sub messages that can be queued for a session
+// before it is disconnected, like the pubsub class of client-output-buffer-limit in
+// Redis. It is read when a session receives its first message, and is protected by the
+// ConfigMu mutex.
+var pubsubBufferSize = 1024
+
+// push queues a pub/sub message for the session's writer goroutine, which is started on
+// the first message, and returns right away so PUBLISH is never held up by a slow
+// subscriber. If the queue is full, the subscriber is not keeping up, so its connection
+// is closed instead and push returns false.
+func (s *Session) push(message Value) bool {
+	s.pushOnce.Do(s.startPusher)
+
+	select {
+	case s.pushes <- message:
+		return true
+	default:
+		fmt.Println("Closing client", s.id, "for exceeding the pub/sub output buffer")
+		s.Kill()
+		return false
+	}
+}
+
+// startPusher creates the session's message queue and starts the goroutine that writes
+// the queued messages to the connection, until the connection is closed.
+func (s *Session) startPusher() {
+	ConfigMu.RLock()
+	size := pubsubBufferSize
+	ConfigMu.RUnlock()
+
+	// an unbuffered queue would drop every message published while one is being written
+	if size < 1 {
+		size = 1
+	}
+
+	s.pushes = make(chan Value, size)
+
+	go func() {
+		for {
+			select {
+			case message := <-s.pushes:
+				if err := s.Write(message); err != nil {
+					s.Kill()
+					return
+				}
+			case <-s.done:
+				return
+			}
+		}
+	}()
+}
+
+// stopPusher stops the session's writer goroutine, if it was started. It is called when
+// the connection is closed.
+func (s *Session) stopPusher() {
+	close(s.done)
+}
+
+// subscriptionCount returns the number of channels and patterns the session is
+// subscribed to, which is reported in every subscribe and unsubscribe confirmation.
+func (s *Session) subscriptionCount() int {
+	return len(s.channels) + len(s.patterns)
+}
+
+// inSubscribeMode reports whether the session is subscribed to any channel or pattern,
+// in which case it can only execute the subscribeModeCommands.
+func (s *Session) inSubscribeMode() bool {
+	return s.subscriptionCount() > 0
+}
+
+// subscribe is a command handler that subscribes the session to one or more channels.
+// For every channel it sends a confirmation of the form
+// ["subscribe", channel, count], where count is the number of channels and patterns
+// the session is subscribed to after that channel was added. Clients wait for one confirmation per
+// channel, so they are written directly and no other reply is sent.
+func subscribe(s *Session, args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'subscribe' command"}
+	}
+
+	for _, arg := range args {
+		s.addSubscription(s.channels, Channels, arg.bulk)
+		s.Write(subscriptionReply("subscribe", arg.bulk, s.subscriptionCount()))
+	}
+
+	return noReply
+}
+
+// psubscribe is a command handler that subscribes the session to one or more glob
+// patterns. Messages published to any channel matching a pattern are delivered as
+// ["pmessage", pattern, channel, message]. For every pattern it sends a confirmation
+// of the form ["psubscribe", pattern, count], like SUBSCRIBE does.
+func psubscribe(s *Session, args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'psubscribe' command"}
+	}
+
+	for _, arg := range args {
+		s.addSubscription(s.patterns, Patterns, arg.bulk)
+		s.Write(subscriptionReply("psubscribe", arg.bulk, s.subscriptionCount()))
+	}
+
+	return noReply
+}
+
+// unsubscribe is a command handler that unsubscribes the session from the given
+// channels, or from every channel if none are given. For every channel it sends a
+// confirmation of the form ["unsubscribe", channel, count], where count is the number
+// of channels the session is still subscribed to. If the session was not subscribed
+// to any channel and none are given, a single confirmation with a null channel is sent.
+func unsubscribe(s *Session, args []Value) Value {
+	return s.unsubscribeReplies("unsubscribe", s.channels, Channels, args)
+}
+
+// punsubscribe is a command handler that unsubscribes the session from the given
+// patterns, or from every pattern if none are given. It sends one confirmation of the
+// form ["punsubscribe", pattern, count] per pattern, like UNSUBSCRIBE does.
+func punsubscribe(s *Session, args []Value) Value {
+	return s.unsubscribeReplies("punsubscribe", s.patterns, Patterns, args)
+}
+
+// unsubscribeReplies removes the subscriptions named in args from the session, or all
+// of the subscriptions in own if args is empty, and sends a confirmation of the given
+// kind for each of them. own is the session's set of channels or patterns, and all is
+// the matching global map.
+func (s *Session) unsubscribeReplies(kind string, own map[string]struct{}, all map[string]map[*Session]struct{}, args []Value) Value {
+	names := make([]string, 0, len(args))
+	for _, arg := range args {
+		names = append(names, arg.bulk)
+	}
+
+	if len(names) == 0 {
+		for name := range own {
+			names = append(names, name)
+		}
+	}
+
+	if len(names) == 0 {
+		s.Write(Value{typ: "array", array: []Value{
+			{typ: "bulk", bulk: kind},
+			{typ: "null"},
+			{typ: "integer", num: s.subscriptionCount()},
+		}})
+		return noReply
+	}
+
+	for _, name := range names {
+		s.removeSubscription(own, all, name)
+		s.Write(subscriptionReply(kind, name, s.subscriptionCount()))
+	}
+
+	return noReply
+}
+
+// addSubscription subscribes the session to name, a channel or a pattern. own is the
+// session's set of channels or patterns, and all is the matching global map.
+func (s *Session) addSubscription(own map[string]struct{}, all map[string]map[*Session]struct{}, name string) {
+	if _, ok := own[name]; ok {
+		return
+	}
+	own[name] = struct{}{}
+
+	ChannelsMu.Lock()
+	if _, ok := all[name]; !ok {
+		all[name] = map[*Session]struct{}{}
+	}
+	all[name][s] = struct{}{}
+	ChannelsMu.Unlock()
+}
+
+// removeSubscription removes the subscription of the session to name, if any.
+// own is the session's set of channels or patterns, and all is the matching global map.
+func (s *Session) removeSubscription(own map[string]struct{}, all map[string]map[*Session]struct{}, name string) {
+	if _, ok := own[name]; !ok {
+		return
+	}
+	delete(own, name)
+
+	ChannelsMu.Lock()
+	delete(all[name], s)
+	if len(all[name]) == 0 {
+		delete(all, name)
+	}
+	ChannelsMu.Unlock()
+}
+
+// unsubscribeAll removes every channel and pattern subscription of the session without
+// sending any confirmation. It is used by RESET and when the connection is closed.
+func (s *Session) unsubscribeAll() {
+	for channel := range s.channels {
+		s.removeSubscription(s.channels, Channels, channel)
+	}
+	for pattern := range s.patterns {
+		s.removeSubscription(s.patterns, Patterns, pattern)
+	}
+}
+
+// subscriptionReply returns a subscribe or unsubscribe confirmation: an array of the
+// kind of confirmation, the channel, and the number of active subscriptions.
+func subscriptionReply(kind, channel string, count int) Value {
+	return Value{typ: "array", array: []Value{
+		{typ: "bulk", bulk: kind},
+		{typ: "bulk", bulk: channel},
+		{typ: "integer", num: count},
+	}}
+}
+
+// publish is a command handler that sends a message to every session subscribed to a
+// channel. It takes two arguments: the channel and the message.
+// If the number of arguments is not exactly 2, it returns an error.
+// Each channel subscriber receives an array of the form ["message", channel, message],
+// and each session subscribed to a pattern matching the channel receives
+// ["pmessage", pattern, channel, message], once per matching pattern.
+// The messages are queued for every subscriber with push rather than written, so a slow
+// subscriber never holds up the publisher; it is disconnected once its queue is full.
+// It returns the number of messages delivered, counting both kinds, as an integer.
+func publish(args []Value) Value {
+	if len(args) != 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'publish' command"}
+	}
+
+	channel := args[0].bulk
+	payload := args[1].bulk
+
+	type delivery struct {
+		session *Session
+		message Value
+	}
+
+	ChannelsMu.RLock()
+	deliveries := []delivery{}
+	for s := range Channels[channel] {
+		deliveries = append(deliveries, delivery{s, Value{typ: "array", array: []Value{
+			{typ: "bulk", bulk: "message"},
+			{typ: "bulk", bulk: channel},
+			{typ: "bulk", bulk: payload},
+		}}})
+	}
+	for pattern, sessions := range Patterns {
+		if !glob(pattern, channel) {
+			continue
+		}
+		for s := range sessions {
+			deliveries = append(deliveries, delivery{s, Value{typ: "array", array: []Value{
+				{typ: "bulk", bulk: "pmessage"},
+				{typ: "bulk", bulk: pattern},
+				{typ: "bulk", bulk: channel},
+				{typ: "bulk", bulk: payload},
+			}}})
+		}
+	}
+	ChannelsMu.RUnlock()
+
+	// the messages are queued after the lock is released, so the lock is never held
+	// while a subscriber that is not keeping up is being disconnected
+	for _, d := range deliveries {
+		d.session.push(d.message)
+	}
+
+	return Value{typ: "integer", num: len(deliveries)}
+}
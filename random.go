@@ -0,0 +1,50 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// rng is the source of randomness of every command that picks something at random, like
+// HRANDFIELD and the allkeys-random eviction policy. It is used instead of the global
+// math/rand functions so that tests can make these commands deterministic with seedRandom.
+var rng = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+// rngMu is a mutex that protects access to rng, since a *rand.Rand is not safe for
+// concurrent use.
+var rngMu = sync.Mutex{}
+
+// seedRandom reseeds rng, so that the random commands return the same results every time
+// they are called in the same order after it.
+func seedRandom(seed int64) {
+	rngMu.Lock()
+	defer rngMu.Unlock()
+
+	rng.Seed(seed)
+}
+
+// randomIntn returns a random number in [0, n) from rng. It panics if n <= 0.
+func randomIntn(n int) int {
+	rngMu.Lock()
+	defer rngMu.Unlock()
+
+	return rng.Intn(n)
+}
+
+// randomFloat64 returns a random number in [0.0, 1.0) from rng.
+func randomFloat64() float64 {
+	rngMu.Lock()
+	defer rngMu.Unlock()
+
+	return rng.Float64()
+}
+
+// randomShuffle shuffles n elements with rng, using swap to swap the elements at two
+// indices, like rand.Shuffle.
+func randomShuffle(n int, swap func(i, j int)) {
+	rngMu.Lock()
+	defer rngMu.Unlock()
+
+	rng.Shuffle(n, swap)
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// replicaBufferSize is the number of writes that can be queued for a replica before it
+// is disconnected, like the replica class of client-output-buffer-limit in Redis. It is
+// read when a replica connects, and is protected by the ConfigMu mutex.
+var replicaBufferSize = 4096
+
+// replica is a connection that issued SYNC, and receives every write appended to the
+// append-only file (AOF) from then on, queued in stream. skip is the number of commands
+// of each transaction that was running when the snapshot sent to the replica was taken,
+// which are already in it, the same way a rewrite skips them.
+type replica struct {
+	session *Session
+	stream  chan []byte
+	skip    map[*aofTx]int
+}
+
+// addReplica registers a replica for the session. It must be called while the snapshot
+// sent to the replica is taken, with the persistMu mutex held for writing, so every
+// write is either in the snapshot or streamed to the replica, but not in both.
+func (aof *Aof) addReplica(s *Session) *replica {
+	ConfigMu.RLock()
+	size := replicaBufferSize
+	ConfigMu.RUnlock()
+
+	// an unbuffered stream would drop every write made while one is being sent
+	if size < 1 {
+		size = 1
+	}
+
+	aof.mu.Lock()
+	defer aof.mu.Unlock()
+
+	r := &replica{session: s, stream: make(chan []byte, size), skip: map[*aofTx]int{}}
+	for tx := range aof.txs {
+		r.skip[tx] = len(tx.values)
+	}
+	aof.replicas[r] = struct{}{}
+
+	return r
+}
+
+// removeReplica stops streaming writes to the replica.
+func (aof *Aof) removeReplica(r *replica) {
+	aof.mu.Lock()
+	delete(aof.replicas, r)
+	aof.mu.Unlock()
+}
+
+// feedReplicas queues data, the RESP representation of one command, for every replica.
+// A replica whose queue is full is not keeping up, so its connection is closed instead,
+// since it would miss the write. The caller must hold the lock on the mu mutex, which
+// keeps the writes in the order they are appended to the file.
+func (aof *Aof) feedReplicas(data []byte) {
+	for r := range aof.replicas {
+		aof.feedReplica(r, data)
+	}
+}
+
+// feedReplicasTx queues the commands of a committed transaction for every replica,
+// wrapped in MULTI and EXEC, leaving out the ones already in the replica's snapshot. The
+// caller must hold the lock on the mu mutex.
+func (aof *Aof) feedReplicasTx(tx *aofTx) {
+	for r := range aof.replicas {
+		skip := r.skip[tx]
+		delete(r.skip, tx)
+
+		if skip < len(tx.values) {
+			aof.feedReplica(r, wrapTx(tx.values[skip:]))
+		}
+	}
+}
+
+// feedReplica queues data for the replica, or disconnects it if its queue is full.
+func (aof *Aof) feedReplica(r *replica, data []byte) {
+	select {
+	case r.stream <- data:
+	default:
+		fmt.Println("Closing replica", r.session.id, "for exceeding the replica output buffer")
+		delete(aof.replicas, r)
+		r.session.Kill()
+	}
+}
+
+// syncCmd is a command handler that turns the connection into a replica of this server:
+// it replies with a snapshot of the data set as a bulk string, in the same format as the
+// snapshot file, and then streams every write appended to the append-only file (AOF)
+// from then on, as the same RESP commands, until the connection is closed.
+// This is a minimal protocol rather than the PSYNC of Redis: there are no replication
+// offsets, so a replica that reconnects always starts over from a full snapshot.
+// The connection is not read from while it streams, so any request the replica sends is
+// ignored until it disconnects.
+func syncCmd(s *Session, args []Value) Value {
+	if len(args) != 0 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'sync' command"}
+	}
+
+	aof := snapshotAof
+	if aof == nil {
+		return Value{typ: "error", str: "ERR the append-only file is not open yet"}
+	}
+
+	persistMu.Lock()
+	data := snapshot()
+	r := aof.addReplica(s)
+	persistMu.Unlock()
+
+	defer aof.removeReplica(r)
+
+	if err := s.Write(Value{typ: "bulk", bulk: string(data)}); err != nil {
+		s.Kill()
+		return noReply
+	}
+
+	ctx, stop := s.watchDisconnect(s.ctx)
+	defer stop()
+
+	for {
+		select {
+		case data := <-r.stream:
+			s.writeMu.Lock()
+			_, err := s.conn.Write(data)
+			s.writeMu.Unlock()
+
+			if err != nil {
+				s.Kill()
+				return noReply
+			}
+		case <-ctx.Done():
+			s.Kill()
+			return noReply
+		}
+	}
+}
+
+// masterAddr is the address of the master this server replicates, or "" if it is not a
+// replica. stopReplication stops the goroutine that replicates it. Both are protected by
+// the replicationMu mutex.
+var (
+	masterAddr      = ""
+	stopReplication context.CancelFunc
+	replicationMu   = sync.Mutex{}
+)
+
+// replicaof is a command handler that makes this server a replica of another one:
+// REPLICAOF host port, or REPLICAOF NO ONE to stop replicating and keep the data as it
+// is. It is also registered as SLAVEOF, its old name.
+// A replica deletes its data, loads the snapshot of the master and then applies the
+// writes the master streams, see replicate. It keeps accepting writes of its own, which
+// the master does not know about, so it should be made read-only with the read-only
+// option to stay an exact copy.
+// If the arguments are malformed, it returns an error.
+// It returns "OK" right away, while the replica connects in the background.
+func replicaof(args []Value) Value {
+	if len(args) != 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'replicaof' command"}
+	}
+
+	host, port := args[0].bulk, args[1].bulk
+
+	if strings.ToUpper(host) == "NO" && strings.ToUpper(port) == "ONE" {
+		replicationMu.Lock()
+		if stopReplication != nil {
+			stopReplication()
+			stopReplication = nil
+		}
+		masterAddr = ""
+		replicationMu.Unlock()
+
+		return Value{typ: "string", str: "OK"}
+	}
+
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return Value{typ: "error", str: "ERR Invalid master port"}
+	}
+
+	if snapshotAof == nil {
+		return Value{typ: "error", str: "ERR the append-only file is not open yet"}
+	}
+
+	addr := net.JoinHostPort(host, port)
+
+	replicationMu.Lock()
+	defer replicationMu.Unlock()
+
+	if addr == masterAddr {
+		return Value{typ: "string", str: "OK"}
+	}
+
+	if stopReplication != nil {
+		stopReplication()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	masterAddr = addr
+	stopReplication = cancel
+
+	go replicate(ctx, snapshotAof, addr)
+
+	return Value{typ: "string", str: "OK"}
+}
+
+// REPLICAOF is registered here rather than in the Handlers literal, because the replica
+// applies the writes of the master with replay, which looks them up in Handlers.
+func init() {
+	Handlers["REPLICAOF"] = replicaof
+	Handlers["SLAVEOF"] = replicaof
+}
+
+// replicate keeps this server in sync with the master at addr until ctx is cancelled.
+// When the connection fails, it reconnects after a second and starts over with a full
+// sync.
+func replicate(ctx context.Context, aof *Aof, addr string) {
+	for {
+		err := syncWithMaster(ctx, aof, addr)
+		if ctx.Err() != nil {
+			return
+		}
+		fmt.Println("Error replicating ", addr, ": ", err)
+
+		select {
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// syncWithMaster connects to the master at addr, issues SYNC, replaces the data set with
+// the snapshot it replies with, and then applies the writes it streams until the
+// connection fails or ctx is cancelled. Like when the append-only file (AOF) is read,
+// the commands of a transaction are only applied once its EXEC has been received.
+func syncWithMaster(ctx context.Context, aof *Aof, addr string) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+
+	// closing the connection stops the read the loop below is blocked in
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	if err := NewWriter(conn).Write(request("SYNC")); err != nil {
+		return err
+	}
+
+	resp := NewResp(conn)
+
+	reply, err := resp.Read()
+	if err != nil {
+		return err
+	}
+	if reply.typ == "error" {
+		return errors.New(reply.str)
+	}
+	if reply.typ != "bulk" {
+		return errors.New("unexpected reply to SYNC")
+	}
+
+	if err := loadFromMaster(reply.bulk); err != nil {
+		return err
+	}
+	fmt.Println("Synchronized with master ", addr)
+
+	var queued []Value
+	inMulti := false
+
+	for {
+		value, err := resp.Read()
+		if err != nil {
+			return err
+		}
+
+		switch txMarker(value) {
+		case "MULTI":
+			inMulti = true
+			queued = nil
+		case "EXEC":
+			inMulti = false
+			applyFromMaster(aof, queued...)
+			queued = nil
+		default:
+			if inMulti {
+				queued = append(queued, value)
+			} else {
+				applyFromMaster(aof, value)
+			}
+		}
+	}
+}
+
+// loadFromMaster replaces the data set with the snapshot received from the master, and
+// then saves a snapshot of its own, which rewrites the append-only file (AOF), so the
+// data set of the master is what is loaded on the next startup.
+func loadFromMaster(data string) error {
+	if err := replaceData(data); err != nil {
+		return err
+	}
+
+	ConfigMu.RLock()
+	path := dbFilename
+	ConfigMu.RUnlock()
+
+	return SaveSnapshot(path)
+}
+
+// replaceData deletes every key and loads the snapshot in data instead. Write commands
+// are blocked meanwhile, so none of them is applied to a partial data set.
+func replaceData(data string) error {
+	persistMu.Lock()
+	defer persistMu.Unlock()
+
+	applyMu.Lock()
+	defer applyMu.Unlock()
+
+	flushAll()
+
+	reader := NewResp(strings.NewReader(data))
+	for {
+		value, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		replay(value)
+	}
+}
+
+// applyFromMaster applies the writes streamed by the master, and appends them to the
+// append-only file (AOF) the same way write commands are, so they are also streamed to
+// the replicas of this server. Several values are applied as a transaction.
+func applyFromMaster(aof *Aof, values ...Value) {
+	persistMu.RLock()
+	defer persistMu.RUnlock()
+
+	applyMu.Lock()
+	defer applyMu.Unlock()
+
+	if len(values) == 1 {
+		aof.Write(values[0])
+		replay(values[0])
+		atomic.AddInt64(&dirty, 1)
+		return
+	}
+
+	tx := aof.beginTx()
+	for _, value := range values {
+		aof.writeTx(tx, value)
+		replay(value)
+		atomic.AddInt64(&dirty, 1)
+	}
+	aof.commitTx(tx)
+}
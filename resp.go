@@ -32,9 +32,59 @@ type Value struct {
 	array []Value
 }
 
+// protocolError is returned by Read when the input is not valid RESP. Its message is an
+// error reply, such as "ERR Protocol error: invalid bulk length", so it can be sent back
+// to the client before the connection is closed, like Redis does.
+type protocolError string
+
+func (e protocolError) Error() string {
+	return string(e)
+}
+
+// protoMaxBulkLen is the largest length in bytes of a bulk string a client may send, and
+// of a string that APPEND and SETRANGE may grow a value to, 512MB by default like in
+// Redis. It is protected by the ConfigMu mutex.
+var protoMaxBulkLen int64 = 512 << 20
+
+// maxBulkLen returns the configured proto-max-bulk-len.
+func maxBulkLen() int64 {
+	ConfigMu.RLock()
+	defer ConfigMu.RUnlock()
+
+	return protoMaxBulkLen
+}
+
+// clientQueryBufferLimit is the largest total length in bytes of the bulk strings of a
+// single request, plus valueOverhead for each of its values, 1GB by default like in
+// Redis, so a request cannot make the server allocate much more than proto-max-bulk-len
+// by declaring many large arguments, or many empty ones. It is protected by the ConfigMu
+// mutex.
+var clientQueryBufferLimit int64 = 1 << 30
+
+// queryBufferLimit returns the configured client-query-buffer-limit.
+func queryBufferLimit() int64 {
+	ConfigMu.RLock()
+	defer ConfigMu.RUnlock()
+
+	return clientQueryBufferLimit
+}
+
+// valueOverhead is the number of bytes every value read is charged against maxRequest on
+// top of its bulk string, about the size of a Value, so a request of many empty or
+// nested elements cannot allocate far more than the limit either.
+const valueOverhead = 80
+
 // Resp is a struct that holds a bufio.Reader for reading RESP (Redis Serialization Protocol) responses.
+// If maxBulk is not 0, bulk strings declared longer than maxBulk bytes are refused before
+// anything is allocated for them. Likewise, if maxRequest is not 0, a value that would take
+// the values read since read was last reset past maxRequest bytes, counting their bulk
+// strings and valueOverhead for each of them, is refused, so the caller resets read to 0
+// before every request.
 type Resp struct {
-	reader *bufio.Reader
+	reader     *bufio.Reader
+	maxBulk    int64
+	maxRequest int64
+	read       int64
 }
 
 // NewResp creates a new Resp instance that reads from the provided io.Reader.
@@ -42,6 +92,23 @@ func NewResp(rd io.Reader) *Resp {
 	return &Resp{reader: bufio.NewReader(rd)}
 }
 
+// NewRespSize creates a new Resp instance that reads from the provided io.Reader through
+// a buffer of the given size. A larger buffer needs fewer reads for large values.
+func NewRespSize(rd io.Reader, size int) *Resp {
+	return &Resp{reader: bufio.NewReaderSize(rd, size)}
+}
+
+// charge adds n bytes to the bytes read for the current request, and returns a protocol
+// error if they go past maxRequest.
+func (r *Resp) charge(n int64) error {
+	r.read += n
+	if r.maxRequest > 0 && r.read > r.maxRequest {
+		return protocolError("ERR Protocol error: request exceeds client-query-buffer-limit")
+	}
+
+	return nil
+}
+
 // readLine reads a line of text from the Resp's reader, excluding the trailing newline characters.
 // It returns the line as a byte slice, the number of bytes read, and any error that occurred during the read.
 // The function reads bytes from the reader until it encounters a newline character, and returns the line
@@ -64,23 +131,43 @@ func (r *Resp) readLine() (line []byte, n int, err error) {
 // readInteger reads an integer value from the Resp's reader.
 // It reads a line of text from the reader, converts it to an integer,
 // and returns the integer value, the number of bytes read, and any error that occurred.
-// The function assumes the line contains a valid integer representation.
-func (r *Resp) readInteger() (x int, n int, err error) {
+// The line must be a canonical decimal integer: digits with an optional leading '-', and
+// nothing else, not even a '+' or spaces. Otherwise the given protocol error is returned,
+// so callers can report which length or value was invalid.
+func (r *Resp) readInteger(invalid protocolError) (x int, n int, err error) {
 	line, n, err := r.readLine()
 	if err != nil {
 		return 0, 0, err
 	}
+
+	digits := line
+	if len(digits) > 0 && digits[0] == '-' {
+		digits = digits[1:]
+	}
+	if len(digits) == 0 {
+		return 0, n, invalid
+	}
+	for _, b := range digits {
+		if b < '0' || b > '9' {
+			return 0, n, invalid
+		}
+	}
+
 	i64, err := strconv.ParseInt(string(line), 10, 64)
 	if err != nil {
-		return 0, n, err
+		// the only possible error left is an out of range value
+		return 0, n, invalid
 	}
 	return int(i64), n, nil
 }
 
 // Read reads a RESP value from the Resp's reader. It determines the type of the value
 // based on the first byte read, and then calls the appropriate parsing function to
-// read the value. If the type is unknown, it prints a message and returns an empty
-// Value and a nil error.
+// read the value. Arrays, bulk strings, simple strings, errors, and integers are supported. If the type is unknown, it
+// returns a protocol error, since the rest of the input cannot be parsed reliably once the stream is out of step.
+// It returns io.EOF only if the input ends before the first byte of the value. If it ends
+// in the middle of the value, such as a bulk string shorter than its declared length, it
+// returns io.ErrUnexpectedEOF, so callers can tell a truncated input from a clean end.
 func (r *Resp) Read() (Value, error) {
 	_type, err := r.reader.ReadByte()
 
@@ -88,15 +175,31 @@ func (r *Resp) Read() (Value, error) {
 		return Value{}, err
 	}
 
+	if err := r.charge(valueOverhead); err != nil {
+		return Value{}, err
+	}
+
+	var v Value
 	switch _type {
 	case ARRAY:
-		return r.readArray()
+		v, err = r.readArray()
 	case BULK:
-		return r.readBulk()
+		v, err = r.readBulk()
+	case STRING:
+		v, err = r.readLineValue("string")
+	case ERROR:
+		v, err = r.readLineValue("error")
+	case INTEGER:
+		v, err = r.readIntegerValue()
 	default:
-		fmt.Printf("Unknown type: %v", string(_type))
-		return Value{}, nil
+		return Value{}, protocolError(fmt.Sprintf("ERR Protocol error: unexpected type byte '%c'", _type))
+	}
+
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
 	}
+
+	return v, err
 }
 
 // readArray reads an array value from the Resp's reader. It reads the length of the
@@ -108,7 +211,7 @@ func (r *Resp) readArray() (Value, error) {
 	v.typ = "array"
 
 	// read length of array
-	len, _, err := r.readInteger()
+	len, _, err := r.readInteger("ERR Protocol error: invalid multibulk length")
 	if err != nil {
 		return v, err
 	}
@@ -128,28 +231,77 @@ func (r *Resp) readArray() (Value, error) {
 	return v, nil
 }
 
+// readLineValue reads a simple string or error value from the Resp's reader. Both
+// types are a single line of text, which is stored in the str field of the returned
+// Value with the given type. If any errors occur during reading, the function
+// returns the error.
+func (r *Resp) readLineValue(typ string) (Value, error) {
+	v := Value{typ: typ}
+
+	line, _, err := r.readLine()
+	if err != nil {
+		return v, err
+	}
+
+	v.str = string(line)
+
+	return v, nil
+}
+
+// readIntegerValue reads an integer value from the Resp's reader and stores it in
+// the num field of the returned Value. If any errors occur during reading, the
+// function returns the error.
+func (r *Resp) readIntegerValue() (Value, error) {
+	v := Value{typ: "integer"}
+
+	num, _, err := r.readInteger("ERR Protocol error: invalid integer")
+	if err != nil {
+		return v, err
+	}
+
+	v.num = num
+
+	return v, nil
+}
+
 // readBulk reads a bulk value from the Resp's reader. It reads the length of the
 // bulk string, then reads the bytes of the string and stores them in the bulk
-// field of the returned Value. If any errors occur during reading, the function
-// returns the error.
+// field of the returned Value. If the length is not a non-negative integer, or is
+// larger than the Resp's maxBulk, or takes the request read so far past maxRequest, it
+// returns a protocol error. If any errors occur
+// during reading, the function returns the error.
+// The whole declared length is read, even if it arrives in several reads. If the input
+// ends before the string and its trailing CRLF, Read reports it as io.ErrUnexpectedEOF.
 func (r *Resp) readBulk() (Value, error) {
 	v := Value{}
 
 	v.typ = "bulk"
 
-	len, _, err := r.readInteger()
+	len, _, err := r.readInteger("ERR Protocol error: invalid bulk length")
 	if err != nil {
 		return v, err
 	}
 
+	if len < 0 || (r.maxBulk > 0 && int64(len) > r.maxBulk) {
+		return v, protocolError("ERR Protocol error: invalid bulk length")
+	}
+
+	if err := r.charge(int64(len)); err != nil {
+		return v, err
+	}
+
 	bulk := make([]byte, len)
 
-	r.reader.Read(bulk)
+	if _, err := io.ReadFull(r.reader, bulk); err != nil {
+		return v, err
+	}
 
 	v.bulk = string(bulk)
 
 	// Read the trailing CRLF
-	r.readLine()
+	if _, _, err := r.readLine(); err != nil {
+		return v, err
+	}
 
 	return v, nil
 }
@@ -165,6 +317,8 @@ func (v Value) Marshal() []byte {
 		return v.marshalBulk()
 	case "string":
 		return v.marshalString()
+	case "integer":
+		return v.marshalInteger()
 	case "null":
 		return v.marshallNull()
 	case "error":
@@ -186,6 +340,18 @@ func (v Value) marshalString() []byte {
 	return bytes
 }
 
+// marshalInteger returns the RESP representation of an integer value. It prepends
+// the integer type identifier, appends the decimal value, and adds the trailing
+// CRLF.
+func (v Value) marshalInteger() []byte {
+	var bytes []byte
+	bytes = append(bytes, INTEGER)
+	bytes = append(bytes, strconv.Itoa(v.num)...)
+	bytes = append(bytes, '\r', '\n')
+
+	return bytes
+}
+
 // marshalBulk returns the RESP representation of a bulk string value. It prepends
 // the bulk string type identifier, appends the length of the string value, adds
 // the trailing CRLF, and then appends the string value followed by another CRLF.
@@ -248,12 +414,22 @@ func NewWriter(w io.Writer) *Writer {
 
 // Write writes the RESP-encoded representation of the provided Value to the
 // underlying io.Writer. It returns an error if the write operation fails.
+// A writer that breaks the io.Writer contract by writing only part of the bytes without
+// an error is called again with the rest, so a reply is never cut short. If it makes no
+// progress at all, it returns io.ErrShortWrite rather than retry forever.
 func (w *Writer) Write(v Value) error {
 	var bytes = v.Marshal()
 
-	_, err := w.writer.Write(bytes)
-	if err != nil {
-		return err
+	for len(bytes) > 0 {
+		n, err := w.writer.Write(bytes)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return io.ErrShortWrite
+		}
+
+		bytes = bytes[n:]
 	}
 
 	return nil
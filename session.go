@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Session holds the state of a single client connection. A new Session is created
+// for every accepted connection and lives until the connection is closed.
+// The mu mutex protects the fields that other connections can read, such as the
+// name reported by CLIENT LIST. The transaction state (inMulti, inExec, queued, queueFailed and tx) and
+// the subscribed channels and patterns are only used by the connection's own goroutine.
+// Replies are written with Write, which serializes them with the messages that
+// other connections publish to this one.
+type Session struct {
+	id   int64
+	conn net.Conn
+	mu   sync.Mutex
+	name string
+
+	writer  *Writer
+	writeMu sync.Mutex
+
+	// resp is the reader of the connection's requests, which blocking commands watch
+	// for the client going away, see watchDisconnect.
+	resp *Resp
+
+	// ctx is cancelled once the connection is closed, so blocking commands stop waiting.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	inMulti bool
+	inExec  bool
+	queued  []Value
+	tx      *aofTx
+
+	// queueFailed is set when a command could not be queued since MULTI, so EXEC aborts.
+	queueFailed bool
+
+	channels map[string]struct{}
+	patterns map[string]struct{}
+
+	// pushes queues the pub/sub messages written by the session's writer goroutine, see push.
+	pushes   chan Value
+	pushOnce sync.Once
+	done     chan struct{}
+
+	// quit is set by QUIT, so the connection is closed once the reply has been written.
+	quit bool
+}
+
+// nextClientID is the last client id handed out to a connection. It is only ever
+// incremented atomically, so every connection gets a unique, monotonically
+// increasing id.
+var nextClientID int64
+
+// NewSession creates a new Session for the given connection and assigns it the
+// next client id.
+func NewSession(conn net.Conn) *Session {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Session{
+		id:       atomic.AddInt64(&nextClientID, 1),
+		conn:     conn,
+		ctx:      ctx,
+		cancel:   cancel,
+		writer:   NewWriter(conn),
+		channels: map[string]struct{}{},
+		patterns: map[string]struct{}{},
+		done:     make(chan struct{}),
+	}
+}
+
+// Write writes the RESP-encoded value to the session's connection. It is safe to
+// call from any goroutine, so PUBLISH can deliver messages to other sessions.
+func (s *Session) Write(v Value) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	return s.writer.Write(v)
+}
+
+// Sessions is a registry of the currently connected clients, keyed by client id.
+var Sessions = map[int64]*Session{}
+
+// SessionsMu is a read-write mutex that protects access to the Sessions map.
+var SessionsMu = sync.RWMutex{}
+
+// Register adds the session to the Sessions registry so it is visible to
+// CLIENT LIST and CLIENT KILL.
+func (s *Session) Register() {
+	SessionsMu.Lock()
+	Sessions[s.id] = s
+	SessionsMu.Unlock()
+}
+
+// Unregister removes the session from the Sessions registry. It is called when
+// the connection is closed.
+func (s *Session) Unregister() {
+	SessionsMu.Lock()
+	delete(Sessions, s.id)
+	SessionsMu.Unlock()
+}
+
+// Name returns the name set on the session with CLIENT SETNAME.
+func (s *Session) Name() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.name
+}
+
+// SetName sets the name of the session.
+func (s *Session) SetName(name string) {
+	s.mu.Lock()
+	s.name = name
+	s.mu.Unlock()
+}
+
+// Kill closes the session's connection. The connection's goroutine then fails its
+// next read and unwinds, unregistering the session on the way out. A blocking command
+// the session is waiting in returns right away, since the session's context is cancelled.
+func (s *Session) Kill() error {
+	s.cancel()
+	return s.conn.Close()
+}
+
+// SessionHandlers is a map of command names to handler functions that need access
+// to the state of the connection issuing the command. These commands only affect
+// the connection itself, so they are never written to the append-only file (AOF).
+var SessionHandlers = map[string]func(*Session, []Value) Value{
+	"CLIENT":       client,
+	"SUBSCRIBE":    subscribe,
+	"UNSUBSCRIBE":  unsubscribe,
+	"PSUBSCRIBE":   psubscribe,
+	"PUNSUBSCRIBE": punsubscribe,
+	"MONITOR":      monitor,
+	"MULTI":        multi,
+	"DISCARD":      discard,
+	"RESET":        reset,
+	"QUIT":         quit,
+	"PING":         ping,
+	"SYNC":         syncCmd,
+}
+
+// quit is a command handler that closes the connection. The connection loop closes it
+// once the "OK" reply has been written, so the client knows the server received the
+// request before the connection goes away.
+func quit(s *Session, args []Value) Value {
+	s.quit = true
+
+	return Value{typ: "string", str: "OK"}
+}
+
+// client is a command handler for the CLIENT command, which inspects and modifies
+// the issuing connection. It takes a subcommand as its first argument:
+// - SETNAME <name>: stores a name on the session and returns "OK".
+// - GETNAME: returns the name of the session, or an empty bulk string if none is set.
+// - ID: returns the unique id assigned to the connection when it was accepted.
+// - LIST: returns a bulk string with one line per connected client (id, addr, name).
+// - KILL <addr>: closes the client connected from addr and returns "OK".
+// - KILL <ID id | ADDR addr> ...: closes the matching clients and returns how many were closed.
+// - HELP: returns an array of lines describing the subcommands.
+// If the subcommand is unknown or has the wrong number of arguments, it returns an error.
+func client(s *Session, args []Value) Value {
+	if len(args) == 0 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'client' command"}
+	}
+
+	subcommand := strings.ToUpper(args[0].bulk)
+	args = args[1:]
+
+	switch subcommand {
+	case "HELP":
+		return helpReply("CLIENT",
+			"GETNAME",
+			"    Return the name of the current connection.",
+			"ID",
+			"    Return the ID of the current connection.",
+			"KILL <ip:port>",
+			"    Kill the connection made from <ip:port>.",
+			"KILL <option> <value> [<option> <value> [...]]",
+			"    Kill the connections matching all the filters. Options are:",
+			"    * ID <client-id>",
+			"      Kill the connection with the given ID.",
+			"    * ADDR <ip:port>",
+			"      Kill the connection made from <ip:port>.",
+			"LIST",
+			"    Return information about the client connections.",
+			"SETNAME <name>",
+			"    Assign the name <name> to the current connection.",
+		)
+	case "SETNAME":
+		if len(args) != 1 {
+			return Value{typ: "error", str: "ERR wrong number of arguments for 'client|setname' command"}
+		}
+
+		name := args[0].bulk
+		if strings.ContainsAny(name, " \r\n") {
+			return Value{typ: "error", str: "ERR Client names cannot contain spaces, newlines or special characters."}
+		}
+
+		s.SetName(name)
+		return Value{typ: "string", str: "OK"}
+	case "GETNAME":
+		if len(args) != 0 {
+			return Value{typ: "error", str: "ERR wrong number of arguments for 'client|getname' command"}
+		}
+
+		return Value{typ: "bulk", bulk: s.Name()}
+	case "ID":
+		if len(args) != 0 {
+			return Value{typ: "error", str: "ERR wrong number of arguments for 'client|id' command"}
+		}
+
+		return Value{typ: "integer", num: int(s.id)}
+	case "LIST":
+		if len(args) != 0 {
+			return Value{typ: "error", str: "ERR syntax error"}
+		}
+
+		return Value{typ: "bulk", bulk: clientList()}
+	case "KILL":
+		return clientKill(args)
+	default:
+		return Value{typ: "error", str: "ERR unknown subcommand '" + subcommand + "'"}
+	}
+}
+
+// clientList returns the CLIENT LIST representation of all connected clients,
+// one line per client ordered by client id.
+func clientList() string {
+	SessionsMu.RLock()
+	sessions := make([]*Session, 0, len(Sessions))
+	for _, s := range Sessions {
+		sessions = append(sessions, s)
+	}
+	SessionsMu.RUnlock()
+
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].id < sessions[j].id })
+
+	var b strings.Builder
+	for _, s := range sessions {
+		fmt.Fprintf(&b, "id=%d addr=%s name=%s\n", s.id, s.conn.RemoteAddr(), s.Name())
+	}
+
+	return b.String()
+}
+
+// clientKill implements CLIENT KILL. With a single argument it uses the old form,
+// closing the client connected from that address and returning "OK", or an error if
+// there is no such client. Otherwise the arguments are ID <id> and ADDR <addr> filter
+// pairs, and every client matching all the filters is closed. The new form returns
+// the number of clients closed as an integer.
+func clientKill(args []Value) Value {
+	if len(args) == 0 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'client|kill' command"}
+	}
+
+	if len(args) == 1 {
+		addr := args[0].bulk
+		if killSessions(func(s *Session) bool { return s.conn.RemoteAddr().String() == addr }) == 0 {
+			return Value{typ: "error", str: "ERR No such client"}
+		}
+
+		return Value{typ: "string", str: "OK"}
+	}
+
+	if len(args)%2 != 0 {
+		return Value{typ: "error", str: "ERR syntax error"}
+	}
+
+	id := int64(-1)
+	addr := ""
+	for i := 0; i < len(args); i += 2 {
+		switch strings.ToUpper(args[i].bulk) {
+		case "ID":
+			n, err := strconv.ParseInt(args[i+1].bulk, 10, 64)
+			if err != nil || n <= 0 {
+				return Value{typ: "error", str: "ERR client-id should be greater than 0"}
+			}
+			id = n
+		case "ADDR":
+			addr = args[i+1].bulk
+		default:
+			return Value{typ: "error", str: "ERR syntax error"}
+		}
+	}
+
+	killed := killSessions(func(s *Session) bool {
+		if id != -1 && s.id != id {
+			return false
+		}
+		if addr != "" && s.conn.RemoteAddr().String() != addr {
+			return false
+		}
+		return true
+	})
+
+	return Value{typ: "integer", num: killed}
+}
+
+// killSessions closes the connection of every registered session for which match
+// returns true, and returns the number of sessions closed.
+func killSessions(match func(s *Session) bool) int {
+	SessionsMu.RLock()
+	defer SessionsMu.RUnlock()
+
+	killed := 0
+	for _, s := range Sessions {
+		if match(s) {
+			s.Kill()
+			killed++
+		}
+	}
+
+	return killed
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// SSETs is a map that stores sets for the set commands. The outer map maps set names
+// to inner maps, and the keys of each inner map are the members of that set.
+var SSETs = map[string]map[string]struct{}{}
+
+// SSETsMu is a read-write mutex that protects access to the SSETs map.
+var SSETsMu = sync.RWMutex{}
+
+// sadd is a command handler that adds one or more members to a set.
+// It takes at least two arguments: the name of the set and the members to add.
+// If fewer than 2 arguments are given, or the key holds a value of another type, it
+// returns an error.
+// The function acquires a write lock on the SSETsMu mutex before modifying the SSETs map,
+// and releases the lock after the operation is complete.
+// If the set does not exist, it creates a new one before adding the members.
+// It returns the number of members that were not already in the set as an integer.
+func sadd(args []Value) Value {
+	if len(args) < 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'sadd' command"}
+	}
+
+	key := args[0].bulk
+
+	if t := keyType(key); t != "set" && t != "none" {
+		return Value{typ: "error", str: "WRONGTYPE Operation against a key holding the wrong kind of value"}
+	}
+
+	SSETsMu.Lock()
+	defer SSETsMu.Unlock()
+
+	set, ok := SSETs[key]
+	if !ok {
+		set = map[string]struct{}{}
+		SSETs[key] = set
+	}
+
+	added := 0
+	for _, arg := range args[1:] {
+		if _, ok := set[arg.bulk]; !ok {
+			set[arg.bulk] = struct{}{}
+			added++
+		}
+	}
+
+	touch(key)
+
+	return Value{typ: "integer", num: added}
+}
+
+// srem is a command handler that removes one or more members from a set.
+// It takes at least two arguments: the name of the set and the members to remove.
+// If fewer than 2 arguments are given, or the key holds a value of another type, it
+// returns an error.
+// The function acquires a write lock on the SSETsMu mutex before modifying the SSETs map,
+// and releases the lock after the operation is complete.
+// If the set becomes empty, the key is deleted.
+// It returns the number of members that were removed as an integer.
+func srem(args []Value) Value {
+	if len(args) < 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'srem' command"}
+	}
+
+	key := args[0].bulk
+
+	if t := keyType(key); t != "set" && t != "none" {
+		return Value{typ: "error", str: "WRONGTYPE Operation against a key holding the wrong kind of value"}
+	}
+
+	SSETsMu.Lock()
+	defer SSETsMu.Unlock()
+
+	set, ok := SSETs[key]
+	if !ok {
+		return Value{typ: "integer", num: 0}
+	}
+
+	removed := 0
+	for _, arg := range args[1:] {
+		if _, ok := set[arg.bulk]; ok {
+			delete(set, arg.bulk)
+			removed++
+		}
+	}
+
+	if len(set) == 0 {
+		delete(SSETs, key)
+		forget(key)
+	}
+
+	return Value{typ: "integer", num: removed}
+}
+
+// smembers is a command handler that returns all the members of a set.
+// It takes one argument: the name of the set.
+// If the number of arguments is not exactly 1, or the key holds a value of another
+// type, it returns an error.
+// The function acquires a read lock on the SSETsMu mutex before accessing the SSETs map,
+// and releases the lock after the operation is complete.
+// If the set does not exist, it returns an empty array.
+func smembers(args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'smembers' command"}
+	}
+
+	key := args[0].bulk
+
+	if t := keyType(key); t != "set" && t != "none" {
+		return Value{typ: "error", str: "WRONGTYPE Operation against a key holding the wrong kind of value"}
+	}
+
+	SSETsMu.RLock()
+	defer SSETsMu.RUnlock()
+
+	set, ok := SSETs[key]
+	if ok {
+		touch(key)
+	}
+
+	values := []Value{}
+	for member := range set {
+		values = append(values, Value{typ: "bulk", bulk: member})
+	}
+
+	return Value{typ: "array", array: values}
+}
+
+// sismember is a command handler that checks whether a value is a member of a set.
+// It takes two arguments: the name of the set and the value.
+// If the number of arguments is not exactly 2, or the key holds a value of another
+// type, it returns an error.
+// The function acquires a read lock on the SSETsMu mutex before accessing the SSETs map,
+// and releases the lock after the operation is complete.
+// It returns 1 if the value is a member of the set, or 0 otherwise.
+func sismember(args []Value) Value {
+	if len(args) != 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'sismember' command"}
+	}
+
+	key := args[0].bulk
+	member := args[1].bulk
+
+	if t := keyType(key); t != "set" && t != "none" {
+		return Value{typ: "error", str: "WRONGTYPE Operation against a key holding the wrong kind of value"}
+	}
+
+	SSETsMu.RLock()
+	_, ok := SSETs[key][member]
+	SSETsMu.RUnlock()
+
+	if !ok {
+		return Value{typ: "integer", num: 0}
+	}
+
+	return Value{typ: "integer", num: 1}
+}
+
+// scard is a command handler that returns the number of members in a set.
+// It takes one argument: the name of the set.
+// If the number of arguments is not exactly 1, or the key holds a value of another
+// type, it returns an error.
+// The function acquires a read lock on the SSETsMu mutex before accessing the SSETs map,
+// and releases the lock after the operation is complete.
+// A missing set has a cardinality of 0.
+func scard(args []Value) Value {
+	if len(args) != 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'scard' command"}
+	}
+
+	key := args[0].bulk
+
+	if t := keyType(key); t != "set" && t != "none" {
+		return Value{typ: "error", str: "WRONGTYPE Operation against a key holding the wrong kind of value"}
+	}
+
+	SSETsMu.RLock()
+	length := len(SSETs[key])
+	SSETsMu.RUnlock()
+
+	return Value{typ: "integer", num: length}
+}
+
+// intersect calls fn for every member that is in all of the given sets, stopping
+// early if fn returns false. It iterates over the smallest set and looks the
+// members up in the others, so the intersection is never materialized.
+// The caller must hold at least a read lock on the SSETsMu mutex.
+func intersect(keys []string, fn func(member string) bool) {
+	sets := make([]map[string]struct{}, 0, len(keys))
+	smallest := 0
+	for i, key := range keys {
+		set, ok := SSETs[key]
+		if !ok {
+			// a missing set is empty, so the intersection is empty too
+			return
+		}
+		sets = append(sets, set)
+		if len(set) < len(sets[smallest]) {
+			smallest = i
+		}
+	}
+
+	for member := range sets[smallest] {
+		inAll := true
+		for i, set := range sets {
+			if i == smallest {
+				continue
+			}
+			if _, ok := set[member]; !ok {
+				inAll = false
+				break
+			}
+		}
+
+		if inAll && !fn(member) {
+			return
+		}
+	}
+}
+
+// sinter is a command handler that returns the members of the intersection of all
+// the given sets. It takes at least one argument: the names of the sets.
+// If no arguments are given, or a key holds a value of another type, it returns an error.
+// The function acquires a read lock on the SSETsMu mutex before accessing the SSETs map,
+// and releases the lock after the operation is complete.
+// If any of the sets does not exist, it returns an empty array.
+func sinter(args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'sinter' command"}
+	}
+
+	keys := make([]string, 0, len(args))
+	for _, arg := range args {
+		if t := keyType(arg.bulk); t != "set" && t != "none" {
+			return Value{typ: "error", str: "WRONGTYPE Operation against a key holding the wrong kind of value"}
+		}
+		keys = append(keys, arg.bulk)
+	}
+
+	SSETsMu.RLock()
+	defer SSETsMu.RUnlock()
+
+	values := []Value{}
+	intersect(keys, func(member string) bool {
+		values = append(values, Value{typ: "bulk", bulk: member})
+		return true
+	})
+
+	return Value{typ: "array", array: values}
+}
+
+// sintercard is a command handler that returns the number of members in the
+// intersection of the given sets, without building the intersection itself.
+// It takes the number of keys, the names of the sets, and an optional LIMIT
+// argument: SINTERCARD numkeys key [key ...] [LIMIT limit].
+// With a non-zero limit, counting stops as soon as the limit is reached.
+// If numkeys or the limit is invalid, or a key holds a value of another type, it returns
+// an error.
+// The function acquires a read lock on the SSETsMu mutex before accessing the SSETs map,
+// and releases the lock after the operation is complete.
+func sintercard(args []Value) Value {
+	if len(args) < 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'sintercard' command"}
+	}
+
+	numkeys, err := strconv.Atoi(args[0].bulk)
+	if err != nil || numkeys <= 0 {
+		return Value{typ: "error", str: "ERR numkeys should be greater than 0"}
+	}
+	if numkeys > len(args)-1 {
+		return Value{typ: "error", str: "ERR Number of keys can't be greater than number of args"}
+	}
+
+	keys := make([]string, 0, numkeys)
+	for _, arg := range args[1 : 1+numkeys] {
+		if t := keyType(arg.bulk); t != "set" && t != "none" {
+			return Value{typ: "error", str: "WRONGTYPE Operation against a key holding the wrong kind of value"}
+		}
+		keys = append(keys, arg.bulk)
+	}
+
+	limit := 0
+	rest := args[1+numkeys:]
+	switch {
+	case len(rest) == 0:
+	case len(rest) == 2 && strings.ToUpper(rest[0].bulk) == "LIMIT":
+		limit, err = strconv.Atoi(rest[1].bulk)
+		if err != nil || limit < 0 {
+			return Value{typ: "error", str: "ERR LIMIT can't be negative"}
+		}
+	default:
+		return Value{typ: "error", str: "ERR syntax error"}
+	}
+
+	SSETsMu.RLock()
+	defer SSETsMu.RUnlock()
+
+	count := 0
+	intersect(keys, func(member string) bool {
+		count++
+		return limit == 0 || count < limit
+	})
+
+	return Value{typ: "integer", num: count}
+}
+
+// union calls fn for every member that is in at least one of the given sets, stopping
+// early if fn returns false. Every member is passed once, even if it is in several sets.
+// The caller must hold at least a read lock on the SSETsMu mutex.
+func union(keys []string, fn func(member string) bool) {
+	seen := map[string]struct{}{}
+	for _, key := range keys {
+		for member := range SSETs[key] {
+			if _, ok := seen[member]; ok {
+				continue
+			}
+			seen[member] = struct{}{}
+
+			if !fn(member) {
+				return
+			}
+		}
+	}
+}
+
+// diff calls fn for every member of the first of the given sets that is in none of the
+// others, stopping early if fn returns false.
+// The caller must hold at least a read lock on the SSETsMu mutex.
+func diff(keys []string, fn func(member string) bool) {
+	for member := range SSETs[keys[0]] {
+		inOther := false
+		for _, key := range keys[1:] {
+			if _, ok := SSETs[key][member]; ok {
+				inOther = true
+				break
+			}
+		}
+
+		if !inOther && !fn(member) {
+			return
+		}
+	}
+}
+
+// sinterstore is a command handler that stores the intersection of the given sets in a
+// destination key: SINTERSTORE destination key [key ...]. See storeSetOp.
+func sinterstore(args []Value) Value {
+	return storeSetOp("sinterstore", intersect, args)
+}
+
+// sunionstore is a command handler that stores the union of the given sets in a
+// destination key: SUNIONSTORE destination key [key ...]. See storeSetOp.
+func sunionstore(args []Value) Value {
+	return storeSetOp("sunionstore", union, args)
+}
+
+// sdiffstore is a command handler that stores the members of the first set that are in
+// none of the others in a destination key: SDIFFSTORE destination key [key ...]. See
+// storeSetOp.
+func sdiffstore(args []Value) Value {
+	return storeSetOp("sdiffstore", diff, args)
+}
+
+// storeSetOp implements SINTERSTORE, SUNIONSTORE and SDIFFSTORE, computing the result
+// with the given set operation. Missing keys are treated as empty sets.
+// If fewer than 2 arguments are given, or a source key holds a value of another type,
+// it returns an error.
+// The destination key is replaced whatever its type, and loses its expiry. If the result
+// is empty, the destination key is deleted instead.
+// The function acquires a read lock on the SSETsMu mutex while computing the result from
+// the sources, and a write lock while storing it.
+// It returns the number of members in the stored set as an integer.
+func storeSetOp(command string, op func(keys []string, fn func(member string) bool), args []Value) Value {
+	if len(args) < 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for '" + command + "' command"}
+	}
+
+	dest := args[0].bulk
+
+	keys := make([]string, 0, len(args)-1)
+	for _, arg := range args[1:] {
+		if t := keyType(arg.bulk); t != "set" && t != "none" {
+			return Value{typ: "error", str: "WRONGTYPE Operation against a key holding the wrong kind of value"}
+		}
+		keys = append(keys, arg.bulk)
+	}
+
+	SSETsMu.RLock()
+	result := map[string]struct{}{}
+	op(keys, func(member string) bool {
+		result[member] = struct{}{}
+		return true
+	})
+	SSETsMu.RUnlock()
+
+	deleteKey(dest)
+
+	if len(result) == 0 {
+		return Value{typ: "integer", num: 0}
+	}
+
+	SSETsMu.Lock()
+	SSETs[dest] = result
+	SSETsMu.Unlock()
+
+	touch(dest)
+
+	return Value{typ: "integer", num: len(result)}
+}
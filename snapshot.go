@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// dbFilename is the path of the snapshot file written by SAVE and by the save points.
+// It is protected by the ConfigMu mutex.
+var dbFilename = "database.snapshot"
+
+// savePoint is a condition that triggers a background snapshot: once at least seconds
+// have passed since the last snapshot and at least changes write commands have been
+// executed, the data is saved.
+type savePoint struct {
+	seconds int
+	changes int64
+}
+
+// savePoints are the conditions checked by the save timer, using the same defaults as
+// Redis. An empty slice disables automatic snapshots. It is protected by the ConfigMu
+// mutex.
+var savePoints = []savePoint{{3600, 1}, {300, 100}, {60, 10000}}
+
+// snapshotAof is the append-only file that is rewritten after every snapshot. It is set
+// by main once the data has been loaded, and nil before that.
+var snapshotAof *Aof
+
+// persistMu is held for reading by write commands from the moment they are appended to
+// the AOF until they have been applied, and for writing by SaveSnapshot while it encodes
+// the data. This way a snapshot never misses a command that is in the part of the AOF
+// it discards.
+var persistMu = sync.RWMutex{}
+
+// loading is 1 while the snapshot and the AOF are loaded on startup, and 0 once the data
+// set is complete. It is only ever accessed atomically.
+var loading int32
+
+// loadingCommands is the set of commands that are executed while the data is loading,
+// because they do not touch the data set. INFO reports loading:1 meanwhile, so it can
+// serve as a healthcheck.
+var loadingCommands = map[string]bool{
+	"INFO":    true,
+	"CONFIG":  true,
+	"CLIENT":  true,
+	"COMMAND": true,
+	"QUIT":    true,
+}
+
+// dirty is the number of write commands executed since the last snapshot. It is only
+// ever accessed atomically.
+var dirty int64
+
+// snapshotMu is a mutex that serializes snapshots, so SAVE and the save timer never
+// write the snapshot file at the same time.
+var snapshotMu = sync.Mutex{}
+
+// lastSave is the time of the last successful snapshot as Unix nanoseconds, or the start
+// of the server if no snapshot has been written yet. It is only ever accessed atomically,
+// so reading it does not wait for a snapshot in progress.
+var lastSave = time.Now().UnixNano()
+
+// getSavePoints returns the save points in the format used by the "save" configuration
+// parameter, e.g. "3600 1 300 100".
+func getSavePoints() string {
+	ConfigMu.RLock()
+	defer ConfigMu.RUnlock()
+
+	parts := make([]string, 0, len(savePoints)*2)
+	for _, point := range savePoints {
+		parts = append(parts, strconv.Itoa(point.seconds), strconv.FormatInt(point.changes, 10))
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// setSavePoints parses value as a list of "<seconds> <changes>" pairs and replaces the
+// save points with it. An empty value disables automatic snapshots.
+func setSavePoints(value string) error {
+	fields := strings.Fields(value)
+	if len(fields)%2 != 0 {
+		return errors.New("save points must be <seconds> <changes> pairs")
+	}
+
+	points := make([]savePoint, 0, len(fields)/2)
+	for i := 0; i < len(fields); i += 2 {
+		seconds, err := strconv.Atoi(fields[i])
+		if err != nil || seconds <= 0 {
+			return fmt.Errorf("invalid save seconds %q", fields[i])
+		}
+		changes, err := strconv.ParseInt(fields[i+1], 10, 64)
+		if err != nil || changes <= 0 {
+			return fmt.Errorf("invalid save changes %q", fields[i+1])
+		}
+		points = append(points, savePoint{seconds: seconds, changes: changes})
+	}
+
+	ConfigMu.Lock()
+	savePoints = points
+	ConfigMu.Unlock()
+
+	return nil
+}
+
+// snapshot returns the current data set encoded as a sequence of RESP commands that
+// rebuild it when replayed: SET for strings, HSET for every hash field, RPUSH for lists,
+// SADD for sets, and ZADD for sorted sets, followed by a PEXPIREAT with the time every key
+// with an expiry expires at, so it does not move when the snapshot is loaded later.
+// Expired keys are left out. Every value is encoded with encodeValue. The read locks on
+// all the maps are held together while encoding, so the snapshot is consistent, but only
+// for as long as it takes to fill the buffer.
+func snapshot() []byte {
+	SETsMu.RLock()
+	HSETsMu.RLock()
+	LISTsMu.RLock()
+	SSETsMu.RLock()
+	ZSETsMu.RLock()
+	defer SETsMu.RUnlock()
+	defer HSETsMu.RUnlock()
+	defer LISTsMu.RUnlock()
+	defer SSETsMu.RUnlock()
+	defer ZSETsMu.RUnlock()
+
+	expiresMu.RLock()
+	defer expiresMu.RUnlock()
+
+	now := clock()
+	expired := func(key string) bool {
+		at, ok := expires[key]
+		return ok && !now.Before(at)
+	}
+
+	var buf bytes.Buffer
+
+	for key := range SETs {
+		if !expired(key) {
+			encodeValue(&buf, key)
+		}
+	}
+	for key := range HSETs {
+		if !expired(key) {
+			encodeValue(&buf, key)
+		}
+	}
+	for key := range LISTs {
+		if !expired(key) {
+			encodeValue(&buf, key)
+		}
+	}
+	for key := range SSETs {
+		if !expired(key) {
+			encodeValue(&buf, key)
+		}
+	}
+	for key := range ZSETs {
+		if !expired(key) {
+			encodeValue(&buf, key)
+		}
+	}
+
+	for key, at := range expires {
+		if expired(key) {
+			continue
+		}
+		// round up, so a key never expires earlier than it would have
+		buf.Write(request("PEXPIREAT", key, strconv.FormatInt(unixMilliUp(at), 10)).Marshal())
+	}
+
+	return buf.Bytes()
+}
+
+// encodeValue writes the commands that rebuild the value at key to buf: SET for a string,
+// HSET for every field of a hash in insertion order, so the order survives a reload,
+// followed by an HGETEX with the PXAT time every field with an expiry expires at,
+// RPUSH for a list, SADD for a set, and ZADD for a sorted set. The expiry of the key is
+// not included. It returns false if the key does not exist. The caller must hold the
+// read locks on the maps.
+func encodeValue(buf *bytes.Buffer, key string) bool {
+	if value, ok := SETs[key]; ok {
+		buf.Write(request("SET", key, string(value)).Marshal())
+		return true
+	}
+
+	if _, ok := HSETs[key]; ok {
+		fields, values := orderedFields(key)
+		for i, field := range fields {
+			buf.Write(request("HSET", key, field, values[i]).Marshal())
+		}
+		for field, at := range hashFieldExpires[key] {
+			// fields that have expired already are deleted by the HGETEX when it is loaded
+			buf.Write(request("HGETEX", key, "PXAT", strconv.FormatInt(unixMilliUp(at), 10), "FIELDS", "1", field).Marshal())
+		}
+		return true
+	}
+
+	if list, ok := LISTs[key]; ok {
+		buf.Write(request("RPUSH", append([]string{key}, list...)...).Marshal())
+		return true
+	}
+
+	if set, ok := SSETs[key]; ok {
+		args := make([]string, 0, len(set)+1)
+		args = append(args, key)
+		for member := range set {
+			args = append(args, member)
+		}
+		buf.Write(request("SADD", args...).Marshal())
+		return true
+	}
+
+	if zset, ok := ZSETs[key]; ok {
+		args := make([]string, 0, 2*len(zset)+1)
+		args = append(args, key)
+		for member, score := range zset {
+			args = append(args, formatScore(score), member)
+		}
+		buf.Write(request("ZADD", args...).Marshal())
+		return true
+	}
+
+	return false
+}
+
+// serializedLength returns the number of bytes the value at key takes in a snapshot, as
+// encoded by encodeValue, without its expiry. It returns false if the key does not exist.
+// It acquires the read locks on all the maps in the same order as snapshot.
+func serializedLength(key string) (int, bool) {
+	if keyType(key) == "none" {
+		return 0, false
+	}
+
+	SETsMu.RLock()
+	HSETsMu.RLock()
+	LISTsMu.RLock()
+	SSETsMu.RLock()
+	ZSETsMu.RLock()
+	defer SETsMu.RUnlock()
+	defer HSETsMu.RUnlock()
+	defer LISTsMu.RUnlock()
+	defer SSETsMu.RUnlock()
+	defer ZSETsMu.RUnlock()
+
+	var buf bytes.Buffer
+	if !encodeValue(&buf, key) {
+		return 0, false
+	}
+
+	return buf.Len(), true
+}
+
+// request returns the RESP array Value of a request for the given command and
+// arguments, as a client would send it.
+func request(name string, args ...string) Value {
+	values := make([]Value, 0, len(args)+1)
+	values = append(values, Value{typ: "bulk", bulk: name})
+	for _, arg := range args {
+		values = append(values, Value{typ: "bulk", bulk: arg})
+	}
+
+	return Value{typ: "array", array: values}
+}
+
+// SaveSnapshot writes a snapshot of the data set to the given path. The data is encoded
+// into memory under the read locks, and then written to a temporary file outside of them,
+// which is synced to disk and renamed over path, so a crash never leaves a partial
+// snapshot. The AOF is rewritten along with it to only contain the commands executed
+// after the data was encoded, since the snapshot contains all the others. Both start with
+// the same generation id, and the rewritten AOF is synced before the snapshot is renamed
+// into place, so a crash in between never replays the old AOF on top of the new snapshot,
+// see finishRewrite and matchSnapshot. On success the dirty counter is reduced by the
+// changes the snapshot covers.
+func SaveSnapshot(path string) error {
+	snapshotMu.Lock()
+	defer snapshotMu.Unlock()
+
+	// Write commands are only blocked while the data is encoded, so that every command
+	// is either in the snapshot or buffered for the rewritten AOF, but not in both.
+	aof := snapshotAof
+
+	persistMu.Lock()
+	changes := atomic.LoadInt64(&dirty)
+	data := snapshot()
+	id := ""
+	if aof != nil {
+		if err := aof.beginRewrite(); err != nil {
+			persistMu.Unlock()
+			return err
+		}
+
+		id = strconv.FormatInt(time.Now().UnixNano(), 10)
+		data = append(baseMarker(id), data...)
+	}
+	persistMu.Unlock()
+
+	tmp := path + ".tmp"
+	publish := func() error {
+		return os.Rename(tmp, path)
+	}
+
+	if err := writeSnapshotFile(tmp, data); err != nil {
+		if aof != nil {
+			aof.abortRewrite()
+		}
+		return err
+	}
+
+	if aof == nil {
+		if err := publish(); err != nil {
+			return err
+		}
+	} else if err := aof.finishRewrite(id, publish); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	atomic.AddInt64(&dirty, -changes)
+	atomic.StoreInt64(&lastSave, time.Now().UnixNano())
+
+	return nil
+}
+
+// writeSnapshotFile writes data to the file at path and syncs it to disk. SaveSnapshot
+// then renames it into place.
+func writeSnapshotFile(path string, data []byte) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// LoadSnapshot replays the snapshot at the given path with the given function, which
+// is called for every command in it, and returns the generation id of the snapshot, see
+// SaveSnapshot, or an empty string if it has none. A missing snapshot file is not an
+// error, since the server may never have saved one.
+func LoadSnapshot(path string, fn func(value Value)) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", nil
+		}
+
+		return "", err
+	}
+	defer f.Close()
+
+	reader := NewResp(f)
+	id := ""
+
+	for {
+		value, err := reader.Read()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+
+			return "", err
+		}
+
+		if base, ok := baseID(value); ok {
+			id = base
+			continue
+		}
+
+		fn(value)
+	}
+
+	return id, nil
+}
+
+// startSaveTimer starts a goroutine that checks the save points every second, and
+// writes a snapshot when one of them is met. Otherwise, if the AOF has grown past the
+// auto-aof-rewrite thresholds, it is rewritten.
+func startSaveTimer(aof *Aof) {
+	go func() {
+		for {
+			time.Sleep(time.Second)
+
+			ConfigMu.RLock()
+			points := savePoints
+			path := dbFilename
+			ConfigMu.RUnlock()
+
+			elapsed := time.Since(time.Unix(0, atomic.LoadInt64(&lastSave)))
+			changes := atomic.LoadInt64(&dirty)
+
+			saved := false
+			for _, point := range points {
+				if elapsed >= time.Duration(point.seconds)*time.Second && changes >= point.changes {
+					fmt.Printf("%d changes in %d seconds. Saving...\n", point.changes, point.seconds)
+					if err := SaveSnapshot(path); err != nil {
+						fmt.Println("Error saving snapshot: ", err)
+					}
+					saved = true
+					break
+				}
+			}
+
+			// a snapshot already rewrites the AOF
+			if !saved && aof.rewriteNeeded() {
+				fmt.Println("AOF has grown past the auto-aof-rewrite thresholds. Rewriting...")
+				if err := aof.Rewrite(); err != nil {
+					fmt.Println("Error rewriting AOF: ", err)
+				}
+			}
+		}
+	}()
+}
+
+// save is a command handler that synchronously writes a snapshot of the data set to the
+// configured dbfilename. It takes no arguments.
+// It returns "OK" once the snapshot is on disk, or an error if it could not be written.
+func save(args []Value) Value {
+	if len(args) != 0 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'save' command"}
+	}
+
+	ConfigMu.RLock()
+	path := dbFilename
+	ConfigMu.RUnlock()
+
+	if err := SaveSnapshot(path); err != nil {
+		return Value{typ: "error", str: "ERR " + err.Error()}
+	}
+
+	return Value{typ: "string", str: "OK"}
+}
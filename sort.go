@@ -0,0 +1,131 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// sortElements returns a copy of the elements of the list or set stored at key, so they
+// can be sorted without holding a lock. It returns false if the key holds a value of
+// another type. A missing key has no elements.
+func sortElements(key string) ([]string, bool) {
+	switch keyType(key) {
+	case "list":
+		LISTsMu.RLock()
+		elements := append([]string{}, LISTs[key]...)
+		LISTsMu.RUnlock()
+
+		return elements, true
+	case "set":
+		SSETsMu.RLock()
+		elements := make([]string, 0, len(SSETs[key]))
+		for member := range SSETs[key] {
+			elements = append(elements, member)
+		}
+		SSETsMu.RUnlock()
+
+		return elements, true
+	case "none":
+		return []string{}, true
+	default:
+		return nil, false
+	}
+}
+
+// sortCmd is a command handler that returns the elements of a list or set sorted.
+// It takes the name of the key followed by optional modifiers:
+// SORT key [LIMIT offset count] [ASC | DESC] [ALPHA].
+// By default elements are compared as numbers, in ascending order. ALPHA compares them
+// as strings instead, DESC reverses the order, and LIMIT returns only count elements
+// starting at offset, where a negative count means all the remaining elements.
+// If an element cannot be parsed as a number in numeric mode, the key holds a value of
+// another type, or the modifiers are invalid, it returns an error.
+// The key is only read, so the stored list or set is left unchanged.
+func sortCmd(args []Value) Value {
+	if len(args) < 1 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'sort' command"}
+	}
+
+	key := args[0].bulk
+	alpha := false
+	desc := false
+	offset, count := 0, -1
+
+	for i := 1; i < len(args); i++ {
+		switch strings.ToUpper(args[i].bulk) {
+		case "ASC":
+			desc = false
+		case "DESC":
+			desc = true
+		case "ALPHA":
+			alpha = true
+		case "LIMIT":
+			if i+2 >= len(args) {
+				return Value{typ: "error", str: "ERR syntax error"}
+			}
+
+			var err error
+			offset, err = strconv.Atoi(args[i+1].bulk)
+			if err != nil {
+				return Value{typ: "error", str: "ERR value is not an integer or out of range"}
+			}
+			count, err = strconv.Atoi(args[i+2].bulk)
+			if err != nil {
+				return Value{typ: "error", str: "ERR value is not an integer or out of range"}
+			}
+			i += 2
+		default:
+			return Value{typ: "error", str: "ERR syntax error"}
+		}
+	}
+
+	elements, ok := sortElements(key)
+	if !ok {
+		return Value{typ: "error", str: "WRONGTYPE Operation against a key holding the wrong kind of value"}
+	}
+
+	if alpha {
+		sort.Strings(elements)
+	} else {
+		scores := make(map[string]float64, len(elements))
+		for _, element := range elements {
+			score, err := strconv.ParseFloat(element, 64)
+			if err != nil {
+				return Value{typ: "error", str: "ERR One or more scores can't be converted into double"}
+			}
+			scores[element] = score
+		}
+
+		sort.SliceStable(elements, func(i, j int) bool {
+			if scores[elements[i]] != scores[elements[j]] {
+				return scores[elements[i]] < scores[elements[j]]
+			}
+			return elements[i] < elements[j]
+		})
+	}
+
+	if desc {
+		for i, j := 0, len(elements)-1; i < j; i, j = i+1, j-1 {
+			elements[i], elements[j] = elements[j], elements[i]
+		}
+	}
+
+	if offset < 0 {
+		offset = 0
+	}
+	if offset > len(elements) {
+		offset = len(elements)
+	}
+	elements = elements[offset:]
+	if count >= 0 && count < len(elements) {
+		elements = elements[:count]
+	}
+
+	values := make([]Value, 0, len(elements))
+	for _, element := range elements {
+		values = append(values, Value{typ: "bulk", bulk: element})
+	}
+
+	return Value{typ: "array", array: values}
+}
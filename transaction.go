@@ -0,0 +1,169 @@
+package main
+
+import "strings"
+
+// transactionCommands is the set of commands that are executed immediately while
+// a session is inside a MULTI block, instead of being queued for EXEC.
+var transactionCommands = map[string]bool{
+	"MULTI":   true,
+	"EXEC":    true,
+	"DISCARD": true,
+	"RESET":   true,
+	"QUIT":    true,
+}
+
+// multi is a command handler that starts a transaction on the session. Commands
+// issued after MULTI are queued instead of executed, until EXEC runs them or
+// DISCARD drops them.
+// If the session is already inside a transaction, it returns an error.
+func multi(s *Session, args []Value) Value {
+	if len(args) != 0 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'multi' command"}
+	}
+
+	if s.inMulti {
+		return Value{typ: "error", str: "ERR MULTI calls can not be nested"}
+	}
+
+	s.inMulti = true
+	s.queued = nil
+	s.queueFailed = false
+
+	return Value{typ: "string", str: "OK"}
+}
+
+// queueCheck reports whether a full command, name included, can be queued by MULTI. If
+// the command is unknown, its number of arguments does not match its arity, or it has
+// the "no_multi" flag, it returns false with the error to reply instead. Once a command
+// fails to queue, EXEC aborts the transaction.
+func queueCheck(argv []Value) (Value, bool) {
+	name := strings.ToUpper(argv[0].bulk)
+
+	spec, ok := commandSpecs[name]
+	if !ok {
+		return Value{typ: "error", str: "ERR unknown command '" + argv[0].bulk + "'"}, false
+	}
+
+	if (spec.arity > 0 && len(argv) != spec.arity) || (spec.arity < 0 && len(argv) < -spec.arity) {
+		return Value{typ: "error", str: "ERR wrong number of arguments for '" + strings.ToLower(name) + "' command"}, false
+	}
+
+	for _, flag := range commandFlags[name] {
+		if flag == "no_multi" {
+			return Value{typ: "error", str: "ERR Command not allowed inside a transaction"}, false
+		}
+	}
+
+	return Value{}, true
+}
+
+// discard is a command handler that aborts the transaction started by MULTI and
+// drops all the queued commands.
+// If the session is not inside a transaction, it returns an error.
+func discard(s *Session, args []Value) Value {
+	if len(args) != 0 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'discard' command"}
+	}
+
+	if !s.inMulti {
+		return Value{typ: "error", str: "ERR DISCARD without MULTI"}
+	}
+
+	s.inMulti = false
+	s.queued = nil
+	s.queueFailed = false
+
+	return Value{typ: "string", str: "OK"}
+}
+
+// exec runs the commands queued since MULTI using the given execute function and
+// returns an array with the reply of each command, in order. The transaction is
+// ended before the commands run, so they are executed rather than queued again.
+// Every command runs even if others fail, like in Redis, and the errors are returned in
+// its place in the array, since nothing is rolled back.
+// The changes the commands make are written to the append-only file (AOF) together,
+// wrapped in MULTI and EXEC, once they have all run, see propagate. The persistMu read
+// lock and the applyMu mutex are held until then, so no write of another connection runs
+// in the middle of the transaction, and the AOF replays the changes in the order they
+// were made. Commands that take either of them themselves are skipped while the session
+// is in the transaction, see inTx.
+// If the session is not inside a transaction, it returns an error. If a command could not
+// be queued, see queueCheck, the transaction is discarded and it returns an EXECABORT
+// error.
+func (s *Session) exec(aof *Aof, execute func(value Value) Value) Value {
+	if !s.inMulti {
+		return Value{typ: "error", str: "ERR EXEC without MULTI"}
+	}
+
+	queued := s.queued
+	failed := s.queueFailed
+	s.inMulti = false
+	s.queued = nil
+	s.queueFailed = false
+
+	if failed {
+		return Value{typ: "error", str: "EXECABORT Transaction discarded because of previous errors."}
+	}
+
+	// inExec tells blocking commands not to wait, since nothing else can run in between
+	s.inExec = true
+	defer func() { s.inExec = false }()
+
+	persistMu.RLock()
+	defer persistMu.RUnlock()
+
+	applyMu.Lock()
+	defer applyMu.Unlock()
+
+	s.tx = aof.beginTx()
+	defer func() {
+		aof.commitTx(s.tx)
+		s.tx = nil
+	}()
+
+	results := make([]Value, 0, len(queued))
+	for _, value := range queued {
+		results = append(results, execute(value))
+	}
+
+	return Value{typ: "array", array: results}
+}
+
+// inTx reports whether EXEC is running the queued commands of the session, and so holds
+// the persistMu read lock and the applyMu mutex for them. It is false for a nil session.
+func (s *Session) inTx() bool {
+	return s != nil && s.tx != nil
+}
+
+// propagate writes a change made by the session to the append-only file (AOF). While EXEC
+// runs the queued commands, the change is added to the transaction instead, so the
+// changes of the whole transaction are replayed together. s may be nil for a change no
+// session made.
+func (s *Session) propagate(aof *Aof, value Value) {
+	if s.inTx() {
+		aof.writeTx(s.tx, value)
+		return
+	}
+
+	aof.Write(value)
+}
+
+// reset is a command handler that returns the session to the state of a freshly
+// accepted connection: any transaction is aborted, the session is unsubscribed from
+// all channels, monitor mode is left, and the client name is cleared.
+// Client libraries use it to clean up a pooled connection before reusing it.
+// It returns the simple string "RESET".
+func reset(s *Session, args []Value) Value {
+	if len(args) != 0 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'reset' command"}
+	}
+
+	s.inMulti = false
+	s.queued = nil
+	s.queueFailed = false
+	s.unsubscribeAll()
+	s.stopMonitor()
+	s.SetName("")
+
+	return Value{typ: "string", str: "RESET"}
+}
@@ -0,0 +1,598 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ZSETs is a map that stores sorted sets for the sorted set commands. The outer map maps
+// sorted set names to inner maps, which map each member to its score. The members are
+// only ordered when a command needs them in order, see sortedMembers.
+var ZSETs = map[string]map[string]float64{}
+
+// ZSETsMu is a read-write mutex that protects access to the ZSETs map.
+var ZSETsMu = sync.RWMutex{}
+
+// zsetMember is a member of a sorted set together with its score.
+type zsetMember struct {
+	member string
+	score  float64
+}
+
+// sortedMembers returns the members of the sorted set ordered by score, and members with
+// the same score in lexicographical order, like Redis orders them.
+// The caller must hold a lock on the ZSETsMu mutex.
+func sortedMembers(zset map[string]float64) []zsetMember {
+	members := make([]zsetMember, 0, len(zset))
+	for member, score := range zset {
+		members = append(members, zsetMember{member: member, score: score})
+	}
+
+	sort.Slice(members, func(i, j int) bool {
+		if members[i].score != members[j].score {
+			return members[i].score < members[j].score
+		}
+		return members[i].member < members[j].member
+	})
+
+	return members
+}
+
+// parseScore parses a score given to a sorted set command. Like Redis, it accepts any
+// floating point number, including "inf", "+inf" and "-inf", but not NaN.
+func parseScore(s string) (float64, bool) {
+	score, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(score) {
+		return 0, false
+	}
+
+	return score, true
+}
+
+// formatScore returns the shortest representation of the score that parses back to the
+// same value, with infinities written as "inf" and "-inf" like Redis does.
+func formatScore(score float64) string {
+	switch {
+	case math.IsInf(score, 1):
+		return "inf"
+	case math.IsInf(score, -1):
+		return "-inf"
+	default:
+		return strconv.FormatFloat(score, 'g', -1, 64)
+	}
+}
+
+// scoreBound is one end of a score range given to ZRANGEBYSCORE. It includes the score
+// itself unless it is exclusive.
+type scoreBound struct {
+	score     float64
+	exclusive bool
+}
+
+// parseScoreBound parses a score range bound: a score, optionally prefixed with "(" to
+// exclude it from the range. "-inf" and "+inf" are the unbounded ends.
+func parseScoreBound(s string) (scoreBound, bool) {
+	bound := scoreBound{}
+	if strings.HasPrefix(s, "(") {
+		bound.exclusive = true
+		s = s[1:]
+	}
+
+	score, ok := parseScore(s)
+	if !ok {
+		return scoreBound{}, false
+	}
+	bound.score = score
+
+	return bound, true
+}
+
+// aboveMin reports whether score is within the range starting at the bound.
+func (b scoreBound) aboveMin(score float64) bool {
+	if b.exclusive {
+		return score > b.score
+	}
+	return score >= b.score
+}
+
+// belowMax reports whether score is within the range ending at the bound.
+func (b scoreBound) belowMax(score float64) bool {
+	if b.exclusive {
+		return score < b.score
+	}
+	return score <= b.score
+}
+
+// lexBound is one end of a lexicographical range given to ZRANGEBYLEX. It includes the
+// value itself unless it is exclusive. The unbounded ends "-" and "+" are given by infinite,
+// which is -1 and 1 for them, and 0 for a bound with a value.
+type lexBound struct {
+	value     string
+	exclusive bool
+	infinite  int
+}
+
+// parseLexBound parses a lexicographical range bound: a value prefixed with "[" to include
+// it in the range or "(" to exclude it, or "-" and "+" for the unbounded ends.
+func parseLexBound(s string) (lexBound, bool) {
+	switch {
+	case s == "-":
+		return lexBound{infinite: -1}, true
+	case s == "+":
+		return lexBound{infinite: 1}, true
+	case strings.HasPrefix(s, "["):
+		return lexBound{value: s[1:]}, true
+	case strings.HasPrefix(s, "("):
+		return lexBound{value: s[1:], exclusive: true}, true
+	default:
+		return lexBound{}, false
+	}
+}
+
+// aboveMin reports whether member is within the range starting at the bound.
+func (b lexBound) aboveMin(member string) bool {
+	if b.infinite != 0 {
+		return b.infinite < 0
+	}
+	if b.exclusive {
+		return member > b.value
+	}
+	return member >= b.value
+}
+
+// belowMax reports whether member is within the range ending at the bound.
+func (b lexBound) belowMax(member string) bool {
+	if b.infinite != 0 {
+		return b.infinite > 0
+	}
+	if b.exclusive {
+		return member < b.value
+	}
+	return member <= b.value
+}
+
+// zadd is a command handler that adds members with their scores to a sorted set:
+// ZADD key [NX | XX] [GT | LT] [CH] [INCR] score member [score member ...].
+// If a member is already in the sorted set, its score is updated. The options are:
+// - NX: only add new members, never update existing ones.
+// - XX: only update existing members, never add new ones.
+// - GT: only update a member if the new score is greater than its current one.
+// - LT: only update a member if the new score is less than its current one.
+// - CH: return the number of members added or whose score changed.
+// - INCR: increment the score of a single member like ZINCRBY, and return the new score.
+// GT and LT do not prevent new members from being added, like in Redis.
+// If the arguments are not score and member pairs, a score is not a valid float,
+// incompatible options are given, or INCR is given several pairs, it returns an error.
+// If the key holds a value of another type, it returns an error.
+// The function acquires a write lock on the ZSETsMu mutex before modifying the ZSETs map,
+// and releases the lock after the operation is complete. The sorted set is only created
+// if a member is added.
+// It returns the number of members that were not already in the sorted set as an integer,
+// or with INCR, the new score as a bulk string, or a null value if the conditions were
+// not met.
+func zadd(args []Value) Value {
+	if len(args) < 3 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'zadd' command"}
+	}
+
+	key := args[0].bulk
+	pairs := args[1:]
+
+	// the options come before the first score, which is never one of them
+	var nx, xx, gt, lt, ch, incr bool
+	options := map[string]*bool{"NX": &nx, "XX": &xx, "GT": &gt, "LT": &lt, "CH": &ch, "INCR": &incr}
+	for len(pairs) > 0 {
+		option, ok := options[strings.ToUpper(pairs[0].bulk)]
+		if !ok {
+			break
+		}
+		*option = true
+		pairs = pairs[1:]
+	}
+
+	if len(pairs) == 0 || len(pairs)%2 != 0 {
+		return Value{typ: "error", str: "ERR syntax error"}
+	}
+	if nx && xx {
+		return Value{typ: "error", str: "ERR XX and NX options at the same time are not compatible"}
+	}
+	if (gt && nx) || (lt && nx) || (gt && lt) {
+		return Value{typ: "error", str: "ERR GT, LT, and/or NX options at the same time are not compatible"}
+	}
+	if incr && len(pairs) > 2 {
+		return Value{typ: "error", str: "ERR INCR option supports a single increment-element pair"}
+	}
+
+	// every score is checked before anything is added, so an invalid one adds nothing
+	scores := make([]float64, 0, len(pairs)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		score, ok := parseScore(pairs[i].bulk)
+		if !ok {
+			return Value{typ: "error", str: "ERR value is not a valid float"}
+		}
+		scores = append(scores, score)
+	}
+
+	if t := keyType(key); t != "zset" && t != "none" {
+		return Value{typ: "error", str: "WRONGTYPE Operation against a key holding the wrong kind of value"}
+	}
+
+	ZSETsMu.Lock()
+	defer ZSETsMu.Unlock()
+
+	zset := ZSETs[key]
+
+	added, changed := 0, 0
+	var result Value
+	for i, score := range scores {
+		member := pairs[2*i+1].bulk
+
+		current, exists := zset[member]
+		if incr {
+			score += current
+			if math.IsNaN(score) {
+				return Value{typ: "error", str: "ERR resulting score is not a number (NaN)"}
+			}
+		}
+
+		switch {
+		case exists && (nx || (gt && score <= current) || (lt && score >= current)):
+			result = Value{typ: "null"}
+			continue
+		case !exists && xx:
+			result = Value{typ: "null"}
+			continue
+		}
+
+		if zset == nil {
+			zset = map[string]float64{}
+			ZSETs[key] = zset
+		}
+
+		if !exists {
+			added++
+		} else if score != current {
+			changed++
+		}
+		zset[member] = score
+		result = Value{typ: "bulk", bulk: formatScore(score)}
+	}
+
+	if zset != nil {
+		touch(key)
+	}
+
+	if incr {
+		return result
+	}
+	if ch {
+		return Value{typ: "integer", num: added + changed}
+	}
+
+	return Value{typ: "integer", num: added}
+}
+
+// zincrby is a command handler that increments the score of a member of a sorted set:
+// ZINCRBY key increment member.
+// If the member is not in the sorted set, it is added with the increment as its score,
+// and the sorted set is created if it does not exist.
+// If the increment is not a valid float, the key holds a value of another type, or the
+// new score would be NaN, it returns an error.
+// The function acquires a write lock on the ZSETsMu mutex before modifying the ZSETs map,
+// and releases the lock after the operation is complete.
+// It returns the new score as a bulk string.
+func zincrby(args []Value) Value {
+	if len(args) != 3 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'zincrby' command"}
+	}
+
+	key := args[0].bulk
+	member := args[2].bulk
+
+	increment, ok := parseScore(args[1].bulk)
+	if !ok {
+		return Value{typ: "error", str: "ERR value is not a valid float"}
+	}
+
+	if t := keyType(key); t != "zset" && t != "none" {
+		return Value{typ: "error", str: "WRONGTYPE Operation against a key holding the wrong kind of value"}
+	}
+
+	ZSETsMu.Lock()
+	defer ZSETsMu.Unlock()
+
+	score := ZSETs[key][member] + increment
+	if math.IsNaN(score) {
+		return Value{typ: "error", str: "ERR resulting score is not a number (NaN)"}
+	}
+
+	zset, ok := ZSETs[key]
+	if !ok {
+		zset = map[string]float64{}
+		ZSETs[key] = zset
+	}
+	zset[member] = score
+
+	touch(key)
+
+	return Value{typ: "bulk", bulk: formatScore(score)}
+}
+
+// zrangebyscore is a command handler that returns the members of a sorted set with a
+// score within a range, ordered by score:
+// ZRANGEBYSCORE key min max [WITHSCORES] [LIMIT offset count].
+// The min and max are included in the range, unless they are prefixed with "(", and
+// "-inf" and "+inf" leave the range unbounded. WITHSCORES adds the score of every member
+// after it. LIMIT returns only count members starting at offset in the range, where a
+// negative count means all the remaining members.
+// If the bounds or options are invalid, or the key holds a value of another type, it
+// returns an error. If the sorted set does not exist, it returns an empty array.
+// The function acquires a read lock on the ZSETsMu mutex while collecting the members,
+// and releases the lock after the operation is complete.
+func zrangebyscore(args []Value) Value {
+	if len(args) < 3 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'zrangebyscore' command"}
+	}
+
+	key := args[0].bulk
+
+	lower, ok := parseScoreBound(args[1].bulk)
+	if !ok {
+		return Value{typ: "error", str: "ERR min or max is not a float"}
+	}
+	upper, ok := parseScoreBound(args[2].bulk)
+	if !ok {
+		return Value{typ: "error", str: "ERR min or max is not a float"}
+	}
+
+	withScores := false
+	offset, count := 0, -1
+	for i := 3; i < len(args); i++ {
+		switch strings.ToUpper(args[i].bulk) {
+		case "WITHSCORES":
+			withScores = true
+		case "LIMIT":
+			if i+2 >= len(args) {
+				return Value{typ: "error", str: "ERR syntax error"}
+			}
+
+			o, err := strconv.Atoi(args[i+1].bulk)
+			if err != nil {
+				return Value{typ: "error", str: "ERR value is not an integer or out of range"}
+			}
+			c, err := strconv.Atoi(args[i+2].bulk)
+			if err != nil {
+				return Value{typ: "error", str: "ERR value is not an integer or out of range"}
+			}
+
+			offset, count = o, c
+			i += 2
+		default:
+			return Value{typ: "error", str: "ERR syntax error"}
+		}
+	}
+
+	if t := keyType(key); t != "zset" && t != "none" {
+		return Value{typ: "error", str: "WRONGTYPE Operation against a key holding the wrong kind of value"}
+	}
+
+	ZSETsMu.RLock()
+	zset, ok := ZSETs[key]
+	members := sortedMembers(zset)
+	ZSETsMu.RUnlock()
+
+	if ok {
+		touch(key)
+	}
+
+	values := []Value{}
+	if offset < 0 {
+		return Value{typ: "array", array: values}
+	}
+
+	for _, m := range members {
+		if !lower.aboveMin(m.score) {
+			continue
+		}
+		if !upper.belowMax(m.score) || count == 0 {
+			break
+		}
+
+		if offset > 0 {
+			offset--
+			continue
+		}
+
+		values = append(values, Value{typ: "bulk", bulk: m.member})
+		if withScores {
+			values = append(values, Value{typ: "bulk", bulk: formatScore(m.score)})
+		}
+		count--
+	}
+
+	return Value{typ: "array", array: values}
+}
+
+// zrangebylex is a command handler that returns the members of a sorted set within a
+// lexicographical range, ordered lexicographically:
+// ZRANGEBYLEX key min max [LIMIT offset count].
+// The min and max are prefixed with "[" to include them in the range or "(" to exclude
+// them, and "-" and "+" leave the range unbounded. LIMIT returns only count members
+// starting at offset in the range, where a negative count means all the remaining
+// members. Like in Redis, the members are expected to all have the same score. Otherwise
+// they are walked in the order of sortedMembers, so the result is unspecified.
+// If the bounds or options are invalid, or the key holds a value of another type, it
+// returns an error. If the sorted set does not exist, it returns an empty array.
+// The function acquires a read lock on the ZSETsMu mutex while collecting the members,
+// and releases the lock after the operation is complete.
+func zrangebylex(args []Value) Value {
+	if len(args) < 3 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'zrangebylex' command"}
+	}
+
+	key := args[0].bulk
+
+	lower, ok := parseLexBound(args[1].bulk)
+	if !ok {
+		return Value{typ: "error", str: "ERR min or max not valid string range item"}
+	}
+	upper, ok := parseLexBound(args[2].bulk)
+	if !ok {
+		return Value{typ: "error", str: "ERR min or max not valid string range item"}
+	}
+
+	offset, count := 0, -1
+	for i := 3; i < len(args); i++ {
+		if strings.ToUpper(args[i].bulk) != "LIMIT" || i+2 >= len(args) {
+			return Value{typ: "error", str: "ERR syntax error"}
+		}
+
+		o, err := strconv.Atoi(args[i+1].bulk)
+		if err != nil {
+			return Value{typ: "error", str: "ERR value is not an integer or out of range"}
+		}
+		c, err := strconv.Atoi(args[i+2].bulk)
+		if err != nil {
+			return Value{typ: "error", str: "ERR value is not an integer or out of range"}
+		}
+
+		offset, count = o, c
+		i += 2
+	}
+
+	if t := keyType(key); t != "zset" && t != "none" {
+		return Value{typ: "error", str: "WRONGTYPE Operation against a key holding the wrong kind of value"}
+	}
+
+	ZSETsMu.RLock()
+	zset, ok := ZSETs[key]
+	members := sortedMembers(zset)
+	ZSETsMu.RUnlock()
+
+	if ok {
+		touch(key)
+	}
+
+	values := []Value{}
+	if offset < 0 {
+		return Value{typ: "array", array: values}
+	}
+
+	for _, m := range members {
+		if !lower.aboveMin(m.member) {
+			continue
+		}
+		if !upper.belowMax(m.member) || count == 0 {
+			break
+		}
+
+		if offset > 0 {
+			offset--
+			continue
+		}
+
+		values = append(values, Value{typ: "bulk", bulk: m.member})
+		count--
+	}
+
+	return Value{typ: "array", array: values}
+}
+
+// zrem is a command handler that removes one or more members from a sorted set.
+// It takes at least two arguments: the name of the sorted set and the members to remove.
+// If fewer than 2 arguments are given, or the key holds a value of another type, it
+// returns an error.
+// The function acquires a write lock on the ZSETsMu mutex before modifying the ZSETs map,
+// and releases the lock after the operation is complete.
+// If the sorted set becomes empty, the key is deleted.
+// It returns the number of members that were removed as an integer.
+func zrem(args []Value) Value {
+	if len(args) < 2 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'zrem' command"}
+	}
+
+	key := args[0].bulk
+
+	if t := keyType(key); t != "zset" && t != "none" {
+		return Value{typ: "error", str: "WRONGTYPE Operation against a key holding the wrong kind of value"}
+	}
+
+	ZSETsMu.Lock()
+	defer ZSETsMu.Unlock()
+
+	zset, ok := ZSETs[key]
+	if !ok {
+		return Value{typ: "integer", num: 0}
+	}
+
+	removed := 0
+	for _, arg := range args[1:] {
+		if _, ok := zset[arg.bulk]; ok {
+			delete(zset, arg.bulk)
+			removed++
+		}
+	}
+
+	if len(zset) == 0 {
+		delete(ZSETs, key)
+		forget(key)
+	}
+
+	return Value{typ: "integer", num: removed}
+}
+
+// zremrangebyrank is a command handler that removes the members of a sorted set within a
+// range of ranks: ZREMRANGEBYRANK key start stop.
+// The ranks are the 0-based positions of the members ordered by score, and both ends are
+// included. Negative ranks count back from the highest score, so -1 is the last member.
+// If the ranks are not integers, or the key holds a value of another type, it returns an
+// error.
+// The function acquires a write lock on the ZSETsMu mutex before modifying the ZSETs map,
+// and releases the lock after the operation is complete.
+// If the sorted set becomes empty, the key is deleted.
+// It returns the number of members that were removed as an integer.
+func zremrangebyrank(args []Value) Value {
+	if len(args) != 3 {
+		return Value{typ: "error", str: "ERR wrong number of arguments for 'zremrangebyrank' command"}
+	}
+
+	key := args[0].bulk
+
+	start, err := strconv.Atoi(args[1].bulk)
+	if err != nil {
+		return Value{typ: "error", str: "ERR value is not an integer or out of range"}
+	}
+	stop, err := strconv.Atoi(args[2].bulk)
+	if err != nil {
+		return Value{typ: "error", str: "ERR value is not an integer or out of range"}
+	}
+
+	if t := keyType(key); t != "zset" && t != "none" {
+		return Value{typ: "error", str: "WRONGTYPE Operation against a key holding the wrong kind of value"}
+	}
+
+	ZSETsMu.Lock()
+	defer ZSETsMu.Unlock()
+
+	zset := ZSETs[key]
+	members := sortedMembers(zset)
+
+	from, to, ok := listRange(start, stop, len(members))
+	if !ok {
+		return Value{typ: "integer", num: 0}
+	}
+
+	for _, m := range members[from:to] {
+		delete(zset, m.member)
+	}
+
+	if len(zset) == 0 {
+		delete(ZSETs, key)
+		forget(key)
+	}
+
+	return Value{typ: "integer", num: to - from}
+}